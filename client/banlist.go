@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BanList holds the addresses of peers we refuse to connect to,
+// persisted to a file with one "ip reason" per line.
+type BanList struct {
+	mu   sync.Mutex
+	path string
+	ips  map[string]string // IP to reason.
+}
+
+// Default location of the ban list, in the user's config directory.
+func DefaultBanListPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "bittorrent-go", "banned")
+}
+
+// LoadBanList reads the ban list at path, a missing file is an empty list.
+// With an empty path, the list is kept in memory only.
+func LoadBanList(path string) (*BanList, error) {
+	b := &BanList{path: path, ips: make(map[string]string)}
+	if path == "" {
+		return b, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return b, fmt.Errorf("failed to load ban list: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if fields[0] == "" || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		reason := ""
+		if len(fields) == 2 {
+			reason = fields[1]
+		}
+		b.ips[ip.String()] = reason
+	}
+	return b, scanner.Err()
+}
+
+// Ban adds an IP to the list and saves it.
+func (b *BanList) Ban(ip net.IP, reason string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ips[ip.String()] = reason
+	return b.save()
+}
+
+// Banned reports whether the IP is on the list.
+func (b *BanList) Banned(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.ips[ip.String()]
+	return ok
+}
+
+// List returns the banned IPs and reasons, sorted.
+func (b *BanList) List() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]string, 0, len(b.ips))
+	for ip, reason := range b.ips {
+		list = append(list, strings.TrimSpace(ip+" "+reason))
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Writes the list to a temporary file then renames it over the old one.
+func (b *BanList) save() error {
+	if b.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0o755); err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for ip, reason := range b.ips {
+		fmt.Fprintln(w, strings.TrimSpace(ip+" "+reason))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/0xNathanW/bittorrent-go/p2p"
+)
+
+const (
+	DefaultUploadSlots = 4
+	chokeInterval      = 10 * time.Second
+	// The optimistic unchoke moves on every third round, every 30s.
+	optimisticRounds = 3
+	// Peers connected for less than this are more likely to be
+	// optimistically unchoked, they have nothing to offer us yet.
+	newPeerAge = time.Minute
+)
+
+// Choker state, only touched by the choker goroutine.
+type choker struct {
+	round      int
+	optimistic *p2p.Peer
+	last       map[*p2p.Peer]p2p.Snapshot // Peers' states last round.
+}
+
+// Amount transferred with a peer over the last round.
+type rated struct {
+	peer *p2p.Peer
+	snap p2p.Snapshot
+	rate int
+}
+
+// Reruns the choker every interval.
+func (c *Client) runChoker() {
+	tick := time.NewTicker(chokeInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			c.rechoke()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// Tit-for-tat, uploads to the interested peers that give us the most
+// while downloading, or that take the most while seeding, plus one
+// optimistic unchoke to find better peers.
+func (c *Client) rechoke() {
+
+	seeding := c.Picker.Complete()
+	var interested []rated
+
+	// Peers are read through snapshots, their own goroutines change them.
+	peers := c.peerList()
+	snaps := make(map[*p2p.Peer]p2p.Snapshot, len(peers))
+	for _, peer := range peers {
+		snap := peer.Snapshot()
+		snaps[peer] = snap
+		last := c.choker.last[peer]
+		down := snap.Downloaded - last.Downloaded
+		up := snap.Uploaded - last.Uploaded
+
+		// Partial seeds won't download from us, so get no slot.
+		if !snap.Active || !snap.IsInterested || snap.IsUploadOnly {
+			continue
+		}
+		if seeding {
+			interested = append(interested, rated{peer, snap, up})
+		} else {
+			interested = append(interested, rated{peer, snap, down})
+		}
+	}
+	c.choker.last = snaps
+
+	// Sort peers by rate.
+	sort.Slice(interested, func(i, j int) bool {
+		return interested[i].rate > interested[j].rate
+	})
+
+	slots := c.UploadSlots
+	if slots < 1 {
+		slots = 1
+	}
+	unchoke := make(map[*p2p.Peer]bool)
+	for _, r := range interested {
+		if len(unchoke) == slots-1 {
+			break
+		}
+		unchoke[r.peer] = true
+	}
+
+	// Rotate the optimistic unchoke, or replace it if it left or
+	// earned a regular slot, which would leave a slot unused.
+	opt := c.choker.optimistic
+	snap := snaps[opt]
+	if c.choker.round%optimisticRounds == 0 || opt == nil || !snap.Active || !snap.IsInterested || unchoke[opt] {
+		opt = c.pickOptimistic(interested, unchoke)
+	}
+	c.choker.optimistic = opt
+	c.choker.round++
+	if opt != nil {
+		unchoke[opt] = true
+	}
+
+	for _, peer := range peers {
+		if snaps[peer].Active {
+			peer.SetChoked(!unchoke[peer])
+		}
+	}
+
+	c.publish(PeersChanged{})
+}
+
+// Picks a random choked peer, newly connected peers are three
+// times as likely to be picked.
+func (c *Client) pickOptimistic(interested []rated, unchoked map[*p2p.Peer]bool) *p2p.Peer {
+	var candidates []*p2p.Peer
+	for _, r := range interested {
+		if unchoked[r.peer] {
+			continue
+		}
+		candidates = append(candidates, r.peer)
+		if time.Since(r.snap.Start) < newPeerAge {
+			candidates = append(candidates, r.peer, r.peer)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
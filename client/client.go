@@ -1,34 +1,117 @@
 package client
 
 import (
+	"context"
 	"encoding/binary"
-	"fmt"
-	"log"
-	"math/rand"
 	"net"
 	"strconv"
 	"sync"
-	"time"
 
+	"github.com/0xNathanW/bittorrent-go/ipfilter"
+	"github.com/0xNathanW/bittorrent-go/logging"
 	"github.com/0xNathanW/bittorrent-go/p2p"
 	"github.com/0xNathanW/bittorrent-go/p2p/message"
+	"github.com/0xNathanW/bittorrent-go/p2p/mse"
+	"github.com/0xNathanW/bittorrent-go/p2p/peerid"
+	"github.com/0xNathanW/bittorrent-go/p2p/webseed"
+	"github.com/0xNathanW/bittorrent-go/picker"
+	"github.com/0xNathanW/bittorrent-go/ratelimit"
 	"github.com/0xNathanW/bittorrent-go/torrent"
 	"github.com/0xNathanW/bittorrent-go/tracker"
-	"github.com/0xNathanW/bittorrent-go/ui"
+	"github.com/0xNathanW/bittorrent-go/utp"
 )
 
 // Client is the highest level of the application.
 type Client struct {
-	ID       [20]byte // The client's unique ID.
-	Torrent  *torrent.Torrent
-	Peers    map[string]*p2p.Peer
-	Active   *active
-	Tracker  *tracker.Tracker
-	BitField message.Bitfield
-	UI       *ui.UI
+	ID      [20]byte // The client's unique ID.
+	Torrent *torrent.Torrent
+	Peers   map[string]*p2p.Peer
+	peersMu sync.Mutex // Guards Peers, inbound peers are added while running.
+	Active  *active
+	Tracker *tracker.Tracker
+	Picker  *picker.Picker // Pieces we have, safe to use from any goroutine.
+	// Extension protocol (BEP 10) extensions offered to peers.
+	Extensions *message.Registry
+	// Whether peer connections are encrypted (MSE/PE).
+	Encryption mse.Policy
+	// uTP socket shared by all peers, nil if uTP is unavailable.
+	UTP       *utp.Socket
+	PreferUTP bool // Dial peers over uTP before TCP.
+	// Port we accept peers on, sent to them so they can connect back.
+	Port int
+	// Number of peers uploaded to at once, including the optimistic unchoke.
+	UploadSlots int
+	choker      choker
+	// Bandwidth limits for the torrent, the global limits also apply.
+	UpLimit   *ratelimit.Limiter
+	DownLimit *ratelimit.Limiter
+	// Limits given to each peer, in bytes per second.
+	PeerUpLimit   int
+	PeerDownLimit int
+	CountOverhead bool // Count protocol overhead against the limits.
+	// Given to each peer, see p2p.Peer.
+	PeerTimeouts p2p.Timeouts
+	MaxStrikes   int
+	// Connection caps, Conns is shared with other torrents.
+	Conns      *ConnLimits
+	MaxPeers   int // Connections for this torrent.
+	connStates map[string]*connState
+	wake       chan struct{} // Prompts the connection manager.
+	announceQ  chan struct{} // Asks the manager to announce, see announce.
+	// Peers that sent corrupt data, never connected to again.
+	Bans     *BanList
+	smartBan *smartBan
+	// Blocked address ranges, shared with other torrents.
+	Filter *ipfilter.Filter
+	// Hides our pieces, revealing them one at a time (BEP 16).
+	superSeed *superSeed
+	// Files not downloaded, see SelectFiles.
+	skipFiles map[int]bool
+	// Directory the torrent is saved to, see Verify.
+	OutputDir string
+	// HTTP servers hosting the torrent's files (BEP 19).
+	WebSeeds []*webseed.WebSeed
 	Seed     *sync.Cond // Used to signal when to start seeding.
+	stats    Stats
+	statsMu  sync.Mutex
+	// Receivers of the torrent's events, see Subscribe.
+	subs   map[*subscriber]bool
+	subsMu sync.Mutex
 
-	Logger *log.Logger
+	// Web seeds that sent corrupt data, by URL, never started again.
+	// Guarded by stateMu.
+	badWebSeeds map[string]bool
+	// Pieces that failed with data only from each web seed, see webSeedFailed.
+	webSeedFailures map[string]int
+
+	// Running state, see Start, Pause and Stop.
+	stateMu  sync.Mutex
+	started  bool
+	paused   bool
+	closed   bool
+	ctx      context.Context // Cancelled by Stop, stops the torrent's goroutines.
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup          // Goroutines Stop waits for, see track.
+	writeErr error                   // Saving the data failed, see save.
+	dataQ    chan *torrent.BlockData // Blocks received from peers and web seeds.
+	requestQ chan p2p.Request        // Blocks requested by peers.
+	buf      []byte                  // The torrent's data.
+
+	// Nil logs nothing, see logger.
+	Logger *logging.Logger
+}
+
+// Stats are running totals for the download.
+type Stats struct {
+	Downloaded int     // Bytes of piece data received.
+	Duplicate  int     // Bytes received more than once, eg. during endgame.
+	Uploaded   int     // Bytes of piece data sent.
+	DownRate   float64 // Bytes per second, over the last half second.
+	Pieces     int     // Pieces we have.
+	NumPieces  int
+	Peers      int // Connected peers.
+	Paused     bool
+	Complete   bool // Every wanted piece is downloaded.
 }
 
 type active struct {
@@ -36,73 +119,86 @@ type active struct {
 	int
 }
 
-// Create a new client instance.
-// Contains all information required to start download.
-func NewClient(path string) (*Client, error) {
-
-	// Unpack and parse torrent file.
-	torrent, err := torrent.NewTorrent(path)
+// Open returns a client for the torrent file at path, with a new peer ID.
+// Nothing happens until it is started.
+func Open(path string) (*Client, error) {
+	t, err := torrent.NewTorrent(path)
+	if err != nil {
+		return nil, err
+	}
+	id, err := peerid.New()
 	if err != nil {
 		return nil, err
 	}
+	return New(t, id)
+}
+
+// New returns a client for a single torrent, identified to trackers
+// and peers by id. Nothing happens until it is started.
+func New(t *torrent.Torrent, id [20]byte) (*Client, error) {
 
 	client := &Client{ // Client instance.
-		ID:      idGenerator(),
-		Torrent: torrent,
+		ID:      id,
+		Torrent: t,
 		Active:  &active{int: 0},
-	}
+		Peers:   make(map[string]*p2p.Peer),
+		Picker:  picker.New(t),
 
-	// Generate empty bitfield.
-	numPieces := len(torrent.Pieces)
-	if numPieces%8 == 0 {
-		client.BitField = make(message.Bitfield, numPieces/8)
-	} else {
-		client.BitField = make(message.Bitfield, numPieces/8+1)
-	}
+		Extensions: message.NewRegistry(),
+		Encryption: mse.Prefer,
+		PreferUTP:  true,
 
-	// Setup tracker.
-	tracker, err := tracker.NewTracker(torrent.Announce, torrent.AnnounceList)
-	if err != nil {
-		return nil, err
-	}
-	tracker.InitParams(torrent.InfoHash, client.ID, torrent.Size)
-	client.Tracker = tracker
+		UploadSlots: DefaultUploadSlots,
 
-	if err = client.GetPeers(); err != nil {
-		return nil, err
+		PeerTimeouts: p2p.DefaultTimeouts,
+		MaxStrikes:   p2p.DefaultMaxStrikes,
+
+		Conns:      GlobalConns,
+		MaxPeers:   DefaultMaxPeers,
+		connStates: make(map[string]*connState),
+		wake:       make(chan struct{}, 1),
+		announceQ:  make(chan struct{}, 1),
+		smartBan:   newSmartBan(),
+		Filter:     ipfilter.Global,
+		UpLimit:    ratelimit.NewLimiter(ratelimit.Unlimited),
+		DownLimit:  ratelimit.NewLimiter(ratelimit.Unlimited),
+		subs:       make(map[*subscriber]bool),
+		buf:        make([]byte, t.Size),
+
+		badWebSeeds:     make(map[string]bool),
+		webSeedFailures: make(map[string]int),
 	}
 
-	ui, err := ui.NewUI(torrent, client.Peers)
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+
+	client.superSeed = newSuperSeed(client)
+
+	// Kept in memory only, unless shared with a persisted list.
+	client.Bans, _ = LoadBanList("")
+
+	// Setup tracker.
+	tracker, err := tracker.NewTracker(t.Announce, t.AnnounceList)
 	if err != nil {
 		return nil, err
 	}
-	client.UI = ui
+	tracker.InitParams(t.InfoHash, client.ID, t.Size)
+	client.Tracker = tracker
 
 	return client, nil
 }
 
-// Generate a new client ID.
-func idGenerator() [20]byte {
-	rand.Seed(time.Now().UnixNano())
-	var id [20]byte
-	rand.Read(id[:])
-	return id
-}
-
-// Client retrieves and parses peers from tracker.
+// Client retrieves and parses peers from tracker,
+// adding any it doesn't already know of.
 func (c *Client) GetPeers() error {
 
-	peerString, err := c.Tracker.RequestPeers()
+	peerString, err := c.Tracker.RequestPeers(c.ctx, c.progress())
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("here")
-
 	// Each peer is a string of length 6.
 	numPeers := len(peerString) / 6
-
-	peers := make(map[string]*p2p.Peer, numPeers)
+	addrs := make([]*net.TCPAddr, 0, numPeers)
 
 	for i := 0; i < numPeers; i++ {
 
@@ -121,14 +217,102 @@ func (c *Client) GetPeers() error {
 
 		address, err := net.ResolveTCPAddr("tcp", tcpIP)
 		if err != nil {
-			print("failed to resolve address:", peerString[i*6:(i+1)*6], err, "\n")
+			c.logger("tracker").Debug("invalid peer address", "addr", tcpIP, "err", err)
 			continue
 		}
+		addrs = append(addrs, address)
+	}
+	c.AddPeers(addrs)
 
-		peers[address.String()] = p2p.NewPeer(address, len(c.BitField))
+	return nil
+}
 
+// Transfer totals for the tracker, left counts skipped pieces too.
+func (c *Client) progress() tracker.Progress {
+	stats := c.Stats()
+	left := 0
+	for idx := range c.Torrent.Pieces {
+		if !c.Picker.HasPiece(idx) {
+			left += c.Torrent.PieceSize(idx)
+		}
 	}
-	c.Peers = peers
+	return tracker.Progress{Uploaded: stats.Uploaded, Downloaded: stats.Downloaded, Left: left}
+}
 
-	return nil
+// AddPeers adds peers from any source, eg. the tracker, DHT or PEX,
+// skipping those already known, banned or filtered.
+func (c *Client) AddPeers(addrs []*net.TCPAddr) {
+	for _, address := range addrs {
+		if _, ok := c.peer(address.String()); ok || c.refused(address.IP) {
+			continue
+		}
+		peer := p2p.NewPeer(address, c.bitfieldLength())
+		c.configurePeer(peer)
+		c.addPeer(peer)
+	}
+}
+
+// Bytes in a bitfield of the torrent's pieces.
+func (c *Client) bitfieldLength() int {
+	return (len(c.Torrent.Pieces) + 7) / 8
+}
+
+// Reports whether connections with the IP are refused.
+func (c *Client) refused(ip net.IP) bool {
+	return c.Bans.Banned(ip) || c.Filter.Blocked(ip)
+}
+
+// Applies the client's settings to a new peer.
+func (c *Client) configurePeer(peer *p2p.Peer) {
+	peer.Extensions = c.Extensions
+	peer.Encryption = c.Encryption
+	peer.UTP = c.UTP
+	peer.PreferUTP = c.PreferUTP
+	peer.Port = c.Port
+	peer.Filter = c.Filter
+
+	peer.UpLimit.SetRate(c.PeerUpLimit)
+	peer.DownLimit.SetRate(c.PeerDownLimit)
+	peer.UpLimits = ratelimit.Group{ratelimit.GlobalUp, c.UpLimit}
+	peer.DownLimits = ratelimit.Group{ratelimit.GlobalDown, c.DownLimit}
+	peer.CountOverhead = c.CountOverhead
+	peer.Timeouts = c.PeerTimeouts
+	peer.MaxStrikes = c.MaxStrikes
+	peer.OnActivity = func(a p2p.Activity) { c.publish(PeerActivity{a}) }
+	peer.Logger = c.logger("peer").With("peer", peer.IP.String())
+}
+
+// Returns a logger for part of the client, with the torrent's info hash.
+func (c *Client) logger(component string) *logging.Logger {
+	return c.Logger.With("component", component, "info_hash", c.Torrent.GetInfoHash())
+}
+
+// SetPeerLimits changes the per peer limits, in bytes per second,
+// for connected peers and those that follow.
+func (c *Client) SetPeerLimits(up, down int) {
+	c.PeerUpLimit, c.PeerDownLimit = up, down
+	for _, peer := range c.peerList() {
+		peer.UpLimit.SetRate(up)
+		peer.DownLimit.SetRate(down)
+	}
+}
+
+// Stats returns the torrent's progress and transfer totals.
+func (c *Client) Stats() Stats {
+	c.statsMu.Lock()
+	stats := c.stats
+	c.statsMu.Unlock()
+
+	for _, peer := range c.peerList() {
+		snap := peer.Snapshot()
+		stats.Uploaded += snap.Uploaded
+		if snap.Active {
+			stats.Peers++
+		}
+	}
+	stats.Pieces = c.Picker.NumDone()
+	stats.NumPieces = len(c.Torrent.Pieces)
+	stats.Paused = c.Paused()
+	stats.Complete = c.Picker.Complete()
+	return stats
 }
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/0xNathanW/bittorrent-go/p2p"
+)
+
+const (
+	DefaultMaxPeers    = 50  // Connections per torrent.
+	DefaultMaxConns    = 200 // Connections across all torrents.
+	DefaultMaxHalfOpen = 20  // Outgoing connections yet to complete the handshake.
+
+	connectInterval = time.Second
+	// Failed peers are retried after retryBase, doubling with each
+	// failure up to retryMax.
+	retryBase = 30 * time.Second
+	retryMax  = 30 * time.Minute
+	// Time between announces, and the least before asking for more
+	// peers early, unless the tracker says otherwise.
+	announceInterval   = 30 * time.Minute
+	reannounceInterval = 5 * time.Minute
+)
+
+// ConnLimits caps the number of connections, it is shared by
+// every torrent so that the caps are global.
+type ConnLimits struct {
+	mu          sync.Mutex
+	MaxConns    int
+	MaxHalfOpen int
+	conns       int
+	halfOpen    int
+}
+
+func NewConnLimits(maxConns, maxHalfOpen int) *ConnLimits {
+	return &ConnLimits{MaxConns: maxConns, MaxHalfOpen: maxHalfOpen}
+}
+
+// Connection caps shared by every torrent.
+var GlobalConns = NewConnLimits(DefaultMaxConns, DefaultMaxHalfOpen)
+
+// Reserves a half-open connection slot for dialling out.
+func (l *ConnLimits) dial() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns >= l.MaxConns || l.halfOpen >= l.MaxHalfOpen {
+		return false
+	}
+	l.conns++
+	l.halfOpen++
+	return true
+}
+
+// Marks a dialled connection as established, freeing its half-open slot.
+func (l *ConnLimits) connected() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.halfOpen--
+}
+
+// Reserves a connection slot for an incoming connection.
+func (l *ConnLimits) accept() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns >= l.MaxConns {
+		return false
+	}
+	l.conns++
+	return true
+}
+
+// Frees a connection slot.
+func (l *ConnLimits) release(halfOpen bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns--
+	if halfOpen {
+		l.halfOpen--
+	}
+}
+
+// Counts returns the open and half-open connections.
+func (l *ConnLimits) Counts() (conns, halfOpen int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns, l.halfOpen
+}
+
+// Connection history of a peer, guarded by peersMu.
+type connState struct {
+	running  bool      // A goroutine is operating the peer.
+	failures int       // Consecutive failed connection attempts.
+	retryAt  time.Time // Not dialled again before this.
+}
+
+// Keeps the torrent connected to as many peers as the caps allow,
+// dialling the most promising peers as connections drop, and announces
+// to the tracker as often as it asks.
+func (c *Client) manageConns() {
+	tick := time.NewTicker(connectInterval)
+	defer tick.Stop()
+
+	var (
+		lastAnnounce time.Time
+		nextAnnounce time.Time // Announce at once.
+		announcing   bool
+		forced       bool // Requested with announce, eg. the event changed.
+		failures     int  // Consecutive failed announces.
+		announced    = make(chan error, 1)
+	)
+	var lastRanges int
+	var lastBlocked uint64
+	for {
+		// Paused torrents connect to no one until resumed.
+		if !c.Paused() {
+			starved := !c.connectPeers()
+			// Out of peers to try, ask the tracker for more early.
+			_, minInterval := c.Tracker.Interval()
+			if minInterval == 0 {
+				minInterval = reannounceInterval
+			}
+			early := starved && failures == 0 && time.Since(lastAnnounce) > minInterval
+			due := forced || early || time.Now().After(nextAnnounce)
+			if !announcing && due && c.track() {
+				announcing, forced = true, false
+				lastAnnounce = time.Now()
+				go func() {
+					defer c.wg.Done()
+					announced <- c.GetPeers()
+				}()
+			}
+		}
+		// The filter may have been reloaded or blocked more peers.
+		if ranges, blocked := c.Filter.Stats(); ranges != lastRanges || blocked != lastBlocked {
+			lastRanges, lastBlocked = ranges, blocked
+			c.publish(FilterChanged{Ranges: ranges, Blocked: blocked})
+		}
+		select {
+		case <-tick.C:
+		case <-c.wake:
+		case <-c.announceQ:
+			forced = true
+		case err := <-announced:
+			announcing = false
+			if err != nil {
+				failures++
+				nextAnnounce = time.Now().Add(backoff(failures))
+				break
+			}
+			failures = 0
+			interval, _ := c.Tracker.Interval()
+			if interval == 0 {
+				interval = announceInterval
+			}
+			nextAnnounce = time.Now().Add(interval)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// Dials candidates until the caps are reached, reporting whether
+// there were any candidates left to dial.
+func (c *Client) connectPeers() bool {
+
+	c.peersMu.Lock()
+	running := 0
+	var candidates []*p2p.Peer
+	for addr, peer := range c.Peers {
+		state := c.connStates[addr]
+		switch {
+		case state.running:
+			running++
+		case c.Bans.Banned(peer.IP.IP):
+		case time.Now().After(state.retryAt):
+			candidates = append(candidates, peer)
+		}
+	}
+	c.peersMu.Unlock()
+
+	// Peers that gave us the most in the past are tried first,
+	// then those that have failed the least.
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if down, downB := a.Snapshot().Downloaded, b.Snapshot().Downloaded; down != downB {
+			return down > downB
+		}
+		return c.failures(a) < c.failures(b)
+	})
+
+	for _, peer := range candidates {
+		if running >= c.MaxPeers || !c.Conns.dial() {
+			break
+		}
+		if !c.track() {
+			c.Conns.release(true)
+			break
+		}
+		if !c.startPeer(peer) {
+			c.Conns.release(true)
+			c.wg.Done()
+			continue
+		}
+		running++
+		go func(peer *p2p.Peer) {
+			defer c.wg.Done()
+			c.operatePeer(peer)
+		}(peer)
+	}
+	return len(candidates) > 0 || running > 0
+}
+
+// Marks the peer as running, false if it already is.
+func (c *Client) startPeer(peer *p2p.Peer) bool {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+	state := c.connStates[peer.IP.String()]
+	if state.running {
+		return false
+	}
+	state.running = true
+	return true
+}
+
+// Records how a connection went once its peer stops, scheduling a retry.
+func (c *Client) stopPeer(peer *p2p.Peer, established bool) {
+	c.peersMu.Lock()
+	state := c.connStates[peer.IP.String()]
+	state.running = false
+	if established {
+		state.failures = 0
+		state.retryAt = time.Now().Add(retryBase)
+	} else {
+		state.failures++
+		state.retryAt = time.Now().Add(backoff(state.failures))
+	}
+	c.peersMu.Unlock()
+
+	// Let the manager replace the connection.
+	c.wakeManager()
+}
+
+func (c *Client) failures(peer *p2p.Peer) int {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+	return c.connStates[peer.IP.String()].failures
+}
+
+// Time to wait before retrying after n consecutive failures.
+func backoff(n int) time.Duration {
+	d := retryBase
+	for i := 1; i < n && d < retryMax; i++ {
+		d *= 2
+	}
+	if d > retryMax {
+		d = retryMax
+	}
+	return d
+}
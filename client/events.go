@@ -0,0 +1,209 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/0xNathanW/bittorrent-go/p2p"
+)
+
+// ------------------------------- Events -------------------------------//
+
+/* Whatever the torrent does is published as events, so a UI, or a
+ * service embedding the client, follows along without the client knowing
+ * about it. Each subscriber has its own queue, a slow one never holds up
+ * the download. Once maxPending events are queued, peer activity is
+ * dropped and Transfer, PieceDone, PeersChanged and FilterChanged are
+ * merged into the latest queued event of the same type. A subscriber
+ * with maxStalled events queued is cut off, its channel is closed.
+ */
+
+const (
+	maxPending = 1024
+	maxStalled = 4 * maxPending
+)
+
+// Event is one of the event types below.
+type Event interface{}
+
+// PeerAdded is sent when a peer is connected to or accepted.
+type PeerAdded struct {
+	Peer     *p2p.Peer
+	Replaced *p2p.Peer // Earlier peer at the same address, if any.
+}
+
+// PeerRemoved is sent when a peer is forgotten, eg. an incoming
+// connection from a port it doesn't listen on closes.
+type PeerRemoved struct {
+	Peer *p2p.Peer
+}
+
+// PeerActivity is something that happened on a peer's connection.
+type PeerActivity struct {
+	p2p.Activity
+}
+
+// PeersChanged is sent when peers' states may have changed, eg. after
+// the choker runs.
+type PeersChanged struct{}
+
+// PieceDone is sent when a piece is downloaded and verified.
+type PieceDone struct {
+	Index int // -1 when sent on subscribing.
+	Done  int // Pieces we have.
+	Total int
+}
+
+// Transfer is the piece data downloaded over the last interval.
+type Transfer struct {
+	Downloaded int
+	Interval   time.Duration
+}
+
+// BansChanged is sent when a peer is banned.
+type BansChanged struct {
+	Bans []string // One per line, with the reason.
+}
+
+// FilterChanged is sent when the IP filter is reloaded or blocks a peer.
+type FilterChanged struct {
+	Ranges  int
+	Blocked uint64
+}
+
+// Completed is sent once every wanted piece is downloaded and saved,
+// Err is set if saving failed.
+type Completed struct {
+	Err error
+}
+
+type subscriber struct {
+	mu      sync.Mutex
+	pending []Event
+	ready   chan struct{} // Signalled when pending is added to.
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Subscribe returns a channel of the torrent's events, starting with
+// its current peers, progress and bans. Call cancel to stop receiving,
+// the channel is then closed. It is also closed if events aren't
+// received for long enough that too many are queued.
+func (c *Client) Subscribe() (events <-chan Event, cancel func()) {
+	s := &subscriber{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	// Registered along with the snapshot so nothing is missed, though a
+	// peer being added may be sent twice.
+	c.subsMu.Lock()
+	for _, peer := range c.peerList() {
+		s.pending = append(s.pending, PeerAdded{Peer: peer})
+	}
+	s.pending = append(s.pending,
+		PieceDone{Index: -1, Done: c.Picker.NumDone(), Total: len(c.Torrent.Pieces)},
+		BansChanged{Bans: c.Bans.List()},
+	)
+	s.ready <- struct{}{}
+	c.subs[s] = true
+	c.subsMu.Unlock()
+
+	ch := make(chan Event)
+	go s.forward(ch)
+	return ch, func() {
+		c.subsMu.Lock()
+		delete(c.subs, s)
+		c.subsMu.Unlock()
+		s.once.Do(func() { close(s.done) })
+	}
+}
+
+// Sends an event to every subscriber.
+func (c *Client) publish(e Event) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	for s := range c.subs {
+		if !s.queue(e) {
+			delete(c.subs, s)
+			s.once.Do(func() { close(s.done) })
+			continue
+		}
+		select {
+		case s.ready <- struct{}{}:
+		default: // Already signalled.
+		}
+	}
+}
+
+// Adds an event to the queue, false if the subscriber has stalled.
+func (s *subscriber) queue(e Event) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= maxPending && merge(s.pending, e) {
+		return true
+	}
+	if len(s.pending) >= maxStalled {
+		return false
+	}
+	s.pending = append(s.pending, e)
+	return true
+}
+
+// Merges an event into the latest queued one of its type, or drops it,
+// reporting false if it must be queued.
+func merge(pending []Event, e Event) bool {
+	if _, ok := e.(PeerActivity); ok {
+		return true
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		switch queued := pending[i].(type) {
+		case Transfer:
+			if e, ok := e.(Transfer); ok {
+				pending[i] = Transfer{
+					Downloaded: queued.Downloaded + e.Downloaded,
+					Interval:   queued.Interval + e.Interval,
+				}
+				return true
+			}
+		case PieceDone:
+			if _, ok := e.(PieceDone); ok {
+				pending[i] = e
+				return true
+			}
+		case PeersChanged:
+			if _, ok := e.(PeersChanged); ok {
+				return true
+			}
+		case FilterChanged:
+			if _, ok := e.(FilterChanged); ok {
+				pending[i] = e
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Delivers queued events in order until cancelled.
+func (s *subscriber) forward(ch chan<- Event) {
+	defer close(ch)
+	for {
+		select {
+		case <-s.ready:
+		case <-s.done:
+			return
+		}
+		s.mu.Lock()
+		pending := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+
+		for _, e := range pending {
+			select {
+			case ch <- e:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
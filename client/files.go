@@ -0,0 +1,77 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/0xNathanW/bittorrent-go/picker"
+	"github.com/0xNathanW/bittorrent-go/tracker"
+)
+
+// SelectFiles limits the download to the files with the given indexes,
+// pieces only covering other files are skipped. Once every selected
+// file is downloaded we are a partial seed.
+func (c *Client) SelectFiles(indexes []int) error {
+	files := c.Torrent.Files
+	selected := make(map[int]bool, len(indexes))
+	for _, i := range indexes {
+		if i < 0 || (i >= len(files) && !(len(files) == 0 && i == 0)) {
+			return fmt.Errorf("no file %d in torrent", i)
+		}
+		selected[i] = true
+	}
+	if len(files) == 0 { // Single file, always selected.
+		return nil
+	}
+
+	c.skipFiles = make(map[int]bool)
+	for i := range files {
+		if !selected[i] {
+			c.skipFiles[i] = true
+		}
+	}
+	for idx, want := range c.wantedPieces() {
+		if want {
+			c.Picker.SetPriority(idx, picker.Normal)
+		} else {
+			c.Picker.SetPriority(idx, picker.Skip)
+		}
+	}
+	return nil
+}
+
+// Returns which pieces cover any of the selected files.
+func (c *Client) wantedPieces() []bool {
+	wanted := make([]bool, len(c.Torrent.Pieces))
+	if len(c.Torrent.Files) == 0 {
+		for idx := range wanted {
+			wanted[idx] = true
+		}
+		return wanted
+	}
+	start := 0 // Of the current file, within the torrent.
+	for i, f := range c.Torrent.Files {
+		end := start + f.Length
+		if !c.skipFiles[i] && f.Length > 0 {
+			for idx := start / c.Torrent.PieceLength; idx*c.Torrent.PieceLength < end; idx++ {
+				wanted[idx] = true
+			}
+		}
+		start = end
+	}
+	return wanted
+}
+
+// Called once every wanted piece is downloaded. Peers are told we want
+// nothing more, and if files were skipped trackers that we are paused.
+func (c *Client) finished() {
+	for _, peer := range c.peerList() {
+		if peer.Snapshot().Active {
+			peer.SetUploadOnly()
+		}
+	}
+	if c.Picker.NumDone() == len(c.Torrent.Pieces) {
+		return
+	}
+	c.Tracker.SetEvent(tracker.EventPaused)
+	c.announce()
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/0xNathanW/bittorrent-go/p2p"
+	"github.com/0xNathanW/bittorrent-go/p2p/webseed"
+	"github.com/0xNathanW/bittorrent-go/ratelimit"
+	"github.com/0xNathanW/bittorrent-go/torrent"
+)
+
+var errClosed = errors.New("torrent closed")
+
+// Start begins downloading, or seeding once complete. Peers are found
+// through the tracker and accepted from the session's listener.
+// Subscribe first to see every event. Cancelling ctx stops the torrent
+// at once, Stop also saves it and tells the tracker.
+func (c *Client) Start(ctx context.Context) error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	switch {
+	case c.closed:
+		return errClosed
+	case c.started:
+		return nil
+	}
+	c.started = true
+
+	c.dataQ = make(chan *torrent.BlockData) // dataQ recieves block data from workers.
+	c.requestQ = make(chan p2p.Request)     // requestQ is the queue of requests we need to send to peers.
+
+	c.Tracker.Logger = c.logger("tracker")
+	c.Picker.Logger = c.logger("picker")
+	for _, peer := range c.peerList() {
+		c.configurePeer(peer) // Settings may have changed since New.
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.cancel()
+		case <-c.ctx.Done():
+		}
+	}()
+	c.wg.Add(4)
+	for _, run := range []func(){c.manageConns, c.collectPieces, c.serveRequests, c.runChoker} {
+		go func(run func()) {
+			defer c.wg.Done()
+			run()
+		}(run)
+	}
+	if !c.paused {
+		c.startWebSeeds()
+	}
+	return nil
+}
+
+// Pause disconnects every peer and stops connecting to new ones,
+// downloaded pieces are kept.
+func (c *Client) Pause() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.paused || c.closed {
+		return
+	}
+	c.paused = true
+	c.stopWebSeeds()
+	for _, peer := range c.peerList() {
+		if peer.Snapshot().Active {
+			peer.Disconnect()
+		}
+	}
+}
+
+// Resume undoes Pause.
+func (c *Client) Resume() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if !c.paused || c.closed {
+		return
+	}
+	c.paused = false
+	if c.started {
+		c.startWebSeeds()
+	}
+	c.wakeManager()
+}
+
+// Paused reports whether the torrent is paused.
+func (c *Client) Paused() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.paused
+}
+
+// Stop disconnects every peer, saves what has been downloaded and tells
+// the tracker we have gone, giving up once ctx is done. The torrent
+// can't be started again.
+func (c *Client) Stop(ctx context.Context) error {
+	c.Pause()
+	c.stateMu.Lock()
+	if c.closed {
+		c.stateMu.Unlock()
+		return nil
+	}
+	c.closed = true
+	started := c.started
+	c.stateMu.Unlock()
+	c.cancel()
+
+	// Peers close their connections and the data is saved on the way out.
+	stopped := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return fmt.Errorf("%s: %w", c.Torrent.Name, ctx.Err())
+	}
+	if !started {
+		return nil
+	}
+	// Best effort, the tracker forgets us eventually anyway.
+	c.Tracker.Stopped(ctx, c.progress())
+
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.writeErr != nil {
+		return fmt.Errorf("%s: failed to save: %w", c.Torrent.Name, c.writeErr)
+	}
+	return nil
+}
+
+// Counts a goroutine Stop waits for, false once stopped.
+// The goroutine calls c.wg.Done when it returns.
+func (c *Client) track() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.wg.Add(1)
+	return true
+}
+
+// Runs a fresh set of web seeds, a stopped one can't be restarted.
+// Called with stateMu held.
+func (c *Client) startWebSeeds() {
+	c.WebSeeds = c.WebSeeds[:0]
+	// Web seeds with unsupported schemes, eg. ftp, are skipped.
+	for _, url := range c.Torrent.URLList {
+		if c.badWebSeeds[url] {
+			continue
+		}
+		ws, err := webseed.New(url, c.Torrent, c.Picker)
+		if err != nil {
+			c.logger("webseed").Warn("web seed skipped", "url", url, "err", err)
+			continue
+		}
+		ws.DownLimits = ratelimit.Group{ratelimit.GlobalDown, c.DownLimit}
+		c.WebSeeds = append(c.WebSeeds, ws)
+		go ws.Run(c.dataQ)
+	}
+}
+
+// Called with stateMu held.
+func (c *Client) stopWebSeeds() {
+	for _, ws := range c.WebSeeds {
+		ws.Stop()
+	}
+	c.WebSeeds = nil
+}
+
+// Has the connection manager announce to the tracker now.
+func (c *Client) announce() {
+	select {
+	case c.announceQ <- struct{}{}:
+	default:
+	}
+}
+
+// Prompts the connection manager to run.
+func (c *Client) wakeManager() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"net"
+
+	"github.com/0xNathanW/bittorrent-go/p2p"
+)
+
+// AcceptConn runs an incoming connection as a peer. Encryption has
+// already been negotiated and the handshake is for this torrent.
+func (c *Client) AcceptConn(conn net.Conn) {
+	if c.refused(remoteIP(conn)) || c.Paused() {
+		conn.Close()
+		return
+	}
+	if !c.track() {
+		conn.Close()
+		return
+	}
+	defer c.wg.Done()
+
+	peer := p2p.NewInboundPeer(conn, c.bitfieldLength())
+	c.configurePeer(peer)
+	if !c.Conns.accept() {
+		conn.Close()
+		return
+	}
+	if !c.addPeer(peer) || !c.startPeer(peer) {
+		c.Conns.release(false)
+		conn.Close()
+		return
+	}
+	c.operatePeer(peer)
+}
+
+// Adds a peer to the client, false if it is already connected.
+func (c *Client) addPeer(peer *p2p.Peer) bool {
+	c.peersMu.Lock()
+	addr := peer.IP.String()
+	state, ok := c.connStates[addr]
+	if ok && state.running {
+		c.peersMu.Unlock()
+		return false
+	}
+	if !ok {
+		c.connStates[addr] = &connState{}
+	}
+	old := c.Peers[addr]
+	c.Peers[addr] = peer
+	c.peersMu.Unlock()
+	if old != nil {
+		c.keepUploaded(old)
+	}
+
+	c.publish(PeerAdded{Peer: peer, Replaced: old})
+	return true
+}
+
+// Removes a peer that connected to us once it disconnects, its address
+// has an ephemeral port so it can't be dialled. The port it listens on
+// is dialled instead, if it sent one.
+func (c *Client) forgetInbound(peer *p2p.Peer) {
+	addr := peer.IP.String()
+	c.peersMu.Lock()
+	if c.Peers[addr] != peer || c.connStates[addr].running {
+		c.peersMu.Unlock()
+		return
+	}
+	delete(c.Peers, addr)
+	delete(c.connStates, addr)
+	c.peersMu.Unlock()
+	c.publish(PeerRemoved{Peer: peer})
+	c.keepUploaded(peer)
+
+	if peer.ListenPort > 0 {
+		c.AddPeers([]*net.TCPAddr{{IP: peer.IP.IP, Port: peer.ListenPort}})
+	}
+}
+
+// Adds a forgotten peer's uploads to the totals, Stats only sums the
+// peers still known.
+func (c *Client) keepUploaded(peer *p2p.Peer) {
+	c.statsMu.Lock()
+	c.stats.Uploaded += peer.Snapshot().Uploaded
+	c.statsMu.Unlock()
+}
+
+// Returns the peer with the given address.
+func (c *Client) peer(addr string) (*p2p.Peer, bool) {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+	peer, ok := c.Peers[addr]
+	return peer, ok
+}
+
+// Returns a snapshot of all peers.
+func (c *Client) peerList() []*p2p.Peer {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+	peers := make([]*p2p.Peer, 0, len(c.Peers))
+	for _, peer := range c.Peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Returns the IP of the remote end of a TCP or uTP connection.
+func remoteIP(conn net.Conn) net.IP {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -1,202 +1,204 @@
 package client
 
 import (
-	"os"
-	"sort"
+	"crypto/sha1"
 	"time"
 
 	"github.com/0xNathanW/bittorrent-go/p2p"
-	msg "github.com/0xNathanW/bittorrent-go/p2p/message"
-	"github.com/0xNathanW/bittorrent-go/torrent"
+	"github.com/0xNathanW/bittorrent-go/picker"
 )
 
-func (c *Client) Run() {
+// How often download speed is published, see Transfer.
+const speedInterval = time.Second / 2
 
-	workQ := c.Torrent.NewWorkQueue()      // workQ is the queue of pieces we need to download.
-	dataQ := make(chan *torrent.PieceData) // dataQ recieves piece data from workers.
-	requestQ := make(chan p2p.Request)     // requestQ is the queue of requests we need to send to peers.
-	defer close(requestQ)
-	buf := make([]byte, c.Torrent.Size)
-
-	for _, peer := range c.Peers {
-		go c.operatePeer(peer, workQ, dataQ, requestQ)
-	}
-
-	go func() {
-		c.collectPieces(buf, dataQ)
-		// Closing workQ causes peers to switch to seeding.
-		close(workQ)
-	}()
-
-	go c.serveRequests(buf, requestQ)
-
-	// Run tview event loop.
-	if err := c.UI.App.SetFocus(c.UI.PeerTable).Run(); err != nil {
-		panic(err)
-	}
-}
-
-func (c *Client) operatePeer(
-	p *p2p.Peer,
-	workQ chan torrent.Piece,
-	dataQ chan<- *torrent.PieceData,
-	requestQ chan<- p2p.Request,
-) {
+func (c *Client) operatePeer(p *p2p.Peer) {
 	c.Active.Lock()
 	c.Active.int += 1
 	c.Active.Unlock()
 
-	p.Run(c.ID, c.Torrent, workQ, dataQ, requestQ)
+	// Outgoing connections hold a half-open slot until the handshake is done.
+	inbound := p.Inbound
+	halfOpen := !inbound
+	established := false
+	p.OnConnect = func() {
+		if halfOpen {
+			c.Conns.connected()
+			halfOpen = false
+		}
+		established = true
+	}
+
+	p.SuperSeeder = c.superSeed.seeder()
+	p.UploadOnly = c.Picker.Complete()
+	p.Run(c.ctx, c.ID, c.Torrent, c.Picker, c.dataQ, c.requestQ)
 	// When peer disconnects, it returns from Run().
+	c.superSeed.remove(p.IP.String())
+
+	c.Conns.release(halfOpen)
+	c.stopPeer(p, established)
+	if inbound {
+		c.forgetInbound(p)
+	}
 
 	c.Active.Lock()
 	c.Active.int -= 1
 	c.Active.Unlock()
 }
 
-func (c *Client) collectPieces(buf []byte, dataQ <-chan *torrent.PieceData) {
+func (c *Client) collectPieces() {
 
-	var done int            // Number of pieces downloaded.
 	var bytesDownloaded int // Tracks number of bytes downloaded.
 
-	speedTick := time.NewTicker(time.Second / 2)
-	sec10 := time.NewTicker(time.Second * 10)
+	speedTick := time.NewTicker(speedInterval)
+	defer speedTick.Stop()
+	buf := c.buf
 
-	// Collect downloaded pieces.
-	for done < len(c.Torrent.Pieces) {
+	// Collect downloaded blocks.
+	for !c.Picker.Complete() {
 
 		select {
-		// Piece data received and written to buffer.
-		case piece := <-dataQ:
+		// Block data received and written to buffer.
+		case block := <-c.dataQ:
 
-			start, end, err := c.Torrent.PiecePosition(piece.Index)
+			start, end, err := c.Torrent.PiecePosition(block.Index)
 			if err != nil {
-				panic(err) //fix
+				continue
+			}
+			b := picker.Block{
+				Index:  block.Index,
+				Begin:  block.Begin,
+				Length: len(block.Data),
+			}
+			others, complete, ok := c.Picker.Received(block.Peer, b)
+			if !ok { // Duplicate or unexpected block.
+				c.statsMu.Lock()
+				c.stats.Duplicate += len(block.Data)
+				c.statsMu.Unlock()
+				continue
+			}
+			c.smartBan.received(block.Index, block.Begin, block.Peer, block.Data)
+			// Endgame, other peers no longer need to send the block.
+			for _, addr := range others {
+				if peer, ok := c.peer(addr); ok {
+					peer.Cancel(b)
+				}
 			}
 
-			n := copy(buf[start:end], piece.Data)
-			c.BitField.SetPiece(piece.Index)
-
+			n := copy(buf[start+block.Begin:end], block.Data)
 			bytesDownloaded += n
-			done++
-			c.UI.App.QueueUpdateDraw(func() {
-				c.UI.UpdateProgress(done)
-				c.UI.UpdateTable()
+			c.statsMu.Lock()
+			c.stats.Downloaded += n
+			c.statsMu.Unlock()
+			if !complete {
+				continue
+			}
+
+			// verify piece hash.
+			if sha1.Sum(buf[start:end]) != c.Torrent.Pieces[block.Index] {
+				c.Picker.PieceFailed(block.Index)
+				// A piece from a single web seed is down to it alone.
+				if sources := c.smartBan.pieceFailed(block.Index); len(sources) == 1 {
+					c.webSeedFailed(sources[0], block.Index)
+				}
+				if peer, ok := c.peer(block.Peer); ok {
+					peer.Log(p2p.ActivityError, "piece %d hash mismatch.", block.Index)
+				}
+				continue
+			}
+
+			c.Picker.PieceDone(block.Index)
+			for _, addr := range c.smartBan.piecePassed(block.Index) {
+				c.banPeer(addr, block.Index)
+			}
+			for _, peer := range c.peerList() {
+				if peer.Snapshot().Active {
+					peer.Have(block.Index)
+				}
+			}
+			c.publish(PieceDone{
+				Index: block.Index,
+				Done:  c.Picker.NumDone(),
+				Total: len(c.Torrent.Pieces),
 			})
 
 		case <-speedTick.C:
-			// Update graph with new mb per second speed.
-			mbps := float64(bytesDownloaded) / (1024 * 1024)
-			c.UI.App.QueueUpdateDraw(func() { c.UI.Graph.Update(mbps) })
+			c.publish(Transfer{Downloaded: bytesDownloaded, Interval: speedInterval})
+			c.statsMu.Lock()
+			c.stats.DownRate = float64(bytesDownloaded) / speedInterval.Seconds()
+			c.statsMu.Unlock()
 			bytesDownloaded = 0
 
-		case <-sec10.C:
-			// Check for all inactive.
-			if c.Active.int == 0 {
-				c.shutdown()
-			}
-			go c.chokingAlgo()
+		case <-c.ctx.Done():
+			// Verified pieces are found by Verify on the next run.
+			c.save()
+			return
 		}
 	}
-	// Write output buffer to file.
-	c.writeToFile(buf)
-}
-
-func (c *Client) writeToFile(buf []byte) error {
-	// If torrent is single file.
-	if len(c.Torrent.Files) == 0 {
-
-		f, err := os.Create(c.Torrent.Name)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		_, err = f.Write(buf)
-		if err != nil {
-			return err
-		}
-		return nil
-
-	} else {
-		// If torrent is multi file.
-		start := 0
-		for _, file := range c.Torrent.Files {
-
-			f, err := os.Create(file.Path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
+	c.finished()
+	c.publish(Completed{Err: c.save()})
 
-			_, err = f.Write(buf[start : start+file.Length])
-			if err != nil {
-				return err
-			}
-			start += file.Length
+	// Blocks still arrive, eg. cancelled in endgame. They are discarded
+	// so the peers and web seeds sending them don't block.
+	for {
+		select {
+		case block := <-c.dataQ:
+			c.statsMu.Lock()
+			c.stats.Duplicate += len(block.Data)
+			c.statsMu.Unlock()
+		case <-c.ctx.Done():
+			return
 		}
 	}
-	return nil
 }
 
-// Allows uploading to the top 4 peers that provide the most data.
-func (c *Client) chokingAlgo() {
-
-	top := make([]struct {
-		peer string
-		down int
-	}, len(c.Peers))
-
-	for _, peer := range c.Peers {
-
-		per10down := peer.Rates.Downloaded - peer.Rates.LastDownloaded
-		peer.Rates.LastDownloaded = peer.Rates.Downloaded
-
-		top = append(top, struct {
-			peer string
-			down int
-		}{peer: peer.IP.String(), down: per10down})
+// Writes the torrent's data out, unless it was all there already,
+// keeping the error for Stop.
+func (c *Client) save() error {
+	if c.Stats().Downloaded == 0 {
+		return nil
 	}
-
-	// Sort peers by download rate.
-	sort.Slice(top, func(i, j int) bool {
-		return top[i].down > top[j].down
-	})
-
-	for _, peer := range c.Peers {
-		peer.Downloading = false
-
-		for _, t := range top[:4] {
-			if peer.IP.String() == t.peer && t.down > 0 {
-				peer.Downloading = true
-			}
-		}
+	log := c.logger("storage")
+	err := c.writeToFile(c.buf)
+	if err != nil {
+		log.Error("failed to save", "dir", c.OutputDir, "err", err)
+	} else {
+		log.Info("saved", "dir", c.OutputDir, "pieces", c.Picker.NumDone())
 	}
-
-	c.UI.App.QueueUpdateDraw(func() { c.UI.UpdateTable() })
+	c.statsMu.Lock()
+	c.writeErr = err
+	c.statsMu.Unlock()
+	return err
 }
 
-func (c *Client) serveRequests(buf []byte, requestQ <-chan p2p.Request) {
-	for request := range requestQ {
+func (c *Client) serveRequests() {
+	buf := c.buf
+	for {
+		var request p2p.Request
+		select {
+		case request = <-c.requestQ:
+		case <-c.ctx.Done():
+			return
+		}
 
-		if !c.BitField.HasPiece(request.Idx) {
-			// Send bitfield?
+		if !c.Picker.HasPiece(request.Idx) {
+			request.Reject()
 			continue
 		}
 
-		start, _, err := c.Torrent.PiecePosition(request.Idx)
+		start, end, err := c.Torrent.PiecePosition(request.Idx)
 		if err != nil {
+			request.Reject()
+			continue
+		}
+		begin := start + request.Offset
+		if request.Offset < 0 || begin+request.Length > end {
+			request.Reject()
 			continue
 		}
 
-		// Retrieve piece from buffer.
-		var block []byte
-		_ = copy(block, buf[start+request.Offset:start+request.Offset+request.Length])
-
-		request.Peer.BlockOut <- msg.Block(request.Idx, request.Offset, block)
+		// Retrieve block from buffer.
+		block := make([]byte, request.Length)
+		copy(block, buf[begin:begin+request.Length])
+		request.Serve(block)
 	}
 }
-
-func (c *Client) shutdown() {
-	panic("No active peers, unable to continue...")
-}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/0xNathanW/bittorrent-go/p2p"
+	"github.com/0xNathanW/bittorrent-go/p2p/message"
+	"github.com/0xNathanW/bittorrent-go/picker"
+	"github.com/0xNathanW/bittorrent-go/torrent"
+)
+
+const (
+	testPieceLength = 32 * 1024
+	testBlockSize   = 8 * 1024
+)
+
+// Returns a client for a single file torrent of random data, and the data.
+func newTestClient(t *testing.T, size int) (*Client, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	tor := &torrent.Torrent{
+		Name:        "file",
+		Announce:    "http://127.0.0.1:1/announce",
+		Size:        size,
+		PieceLength: testPieceLength,
+	}
+	for start := 0; start < size; start += testPieceLength {
+		end := start + testPieceLength
+		if end > size {
+			end = size
+		}
+		tor.Pieces = append(tor.Pieces, sha1.Sum(data[start:end]))
+	}
+	c, err := New(tor, [20]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Picker.SetBlockSize(testBlockSize)
+	c.OutputDir = t.TempDir()
+	c.dataQ = make(chan *torrent.BlockData)
+	c.requestQ = make(chan p2p.Request)
+	return c, data
+}
+
+// Serves requests for every piece while they are being collected,
+// run with -race to check pieces are marked done safely.
+func TestCollectAndServe(t *testing.T) {
+	c, data := newTestClient(t, 8*testPieceLength+100)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.collectPieces()
+	}()
+	go func() {
+		defer wg.Done()
+		c.serveRequests()
+	}()
+	defer func() {
+		c.cancel()
+		wg.Wait()
+	}()
+
+	// Requests a block of every piece until the download completes.
+	served := make(chan struct{})
+	go func() {
+		replies := make(chan p2p.Reply, 1)
+		for !c.Picker.Complete() {
+			for idx := range c.Torrent.Pieces {
+				b := picker.Block{Index: idx, Begin: 0, Length: 100}
+				c.requestQ <- p2p.NewRequest(b, replies)
+				r := <-replies
+				if r.Block != b {
+					t.Errorf("reply for %+v, want %+v", r.Block, b)
+				}
+				if r.Data == nil {
+					continue
+				}
+				start, _ := c.Torrent.PieceBounds(idx)
+				if !bytes.Equal(r.Data, data[start:start+100]) {
+					t.Errorf("piece %d: served data differs", idx)
+				}
+			}
+		}
+		close(served)
+	}()
+
+	have := make(message.Bitfield, c.bitfieldLength())
+	for idx := range c.Torrent.Pieces {
+		have.SetPiece(idx)
+	}
+	for {
+		blocks := c.Picker.Pick("seed", have, 4)
+		if len(blocks) == 0 {
+			break
+		}
+		for _, b := range blocks {
+			start, _ := c.Torrent.PieceBounds(b.Index)
+			begin := start + b.Begin
+			c.dataQ <- &torrent.BlockData{
+				Index: b.Index,
+				Begin: b.Begin,
+				Data:  data[begin : begin+b.Length],
+				Peer:  "seed",
+			}
+		}
+	}
+	<-served
+
+	// Every piece is served once done.
+	replies := make(chan p2p.Reply, 1)
+	for idx := range c.Torrent.Pieces {
+		c.requestQ <- p2p.NewRequest(picker.Block{Index: idx, Length: 100}, replies)
+		if r := <-replies; r.Data == nil {
+			t.Errorf("piece %d rejected once downloaded", idx)
+		}
+	}
+	// Requests outside a piece are rejected.
+	c.requestQ <- p2p.NewRequest(picker.Block{Index: 0, Begin: testPieceLength - 10, Length: 100}, replies)
+	if r := <-replies; r.Data != nil {
+		t.Error("request past the end of a piece served")
+	}
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+
+	"github.com/0xNathanW/bittorrent-go/p2p"
+)
+
+// Where a block came from, and a hash of what was sent.
+type blockRecord struct {
+	peer string
+	hash [20]byte
+}
+
+// Smart-ban works out which peer corrupted a piece when its blocks came
+// from several. The blocks of a failed piece are remembered, once the
+// piece is downloaded again and passes, a peer whose block differed
+// from the good copy sent bad data.
+type smartBan struct {
+	current map[int]map[int]blockRecord // Blocks of pieces being downloaded, by offset.
+	failed  map[int]map[int]blockRecord // Blocks of pieces that failed their hash.
+}
+
+func newSmartBan() *smartBan {
+	return &smartBan{
+		current: make(map[int]map[int]blockRecord),
+		failed:  make(map[int]map[int]blockRecord),
+	}
+}
+
+// Records the source of a block.
+func (s *smartBan) received(idx, begin int, peer string, data []byte) {
+	if s.current[idx] == nil {
+		s.current[idx] = make(map[int]blockRecord)
+	}
+	s.current[idx][begin] = blockRecord{peer: peer, hash: sha1.Sum(data)}
+}
+
+// Remembers the blocks of a piece that failed its hash check, returning
+// the peers that sent them. Blocks from an earlier failure are kept,
+// they may implicate other peers.
+func (s *smartBan) pieceFailed(idx int) []string {
+	if s.failed[idx] == nil {
+		s.failed[idx] = make(map[int]blockRecord)
+	}
+	var peers []string
+	seen := make(map[string]bool)
+	for begin, r := range s.current[idx] {
+		if _, ok := s.failed[idx][begin]; !ok {
+			s.failed[idx][begin] = r
+		}
+		if !seen[r.peer] {
+			seen[r.peer] = true
+			peers = append(peers, r.peer)
+		}
+	}
+	delete(s.current, idx)
+	return peers
+}
+
+// Compares the blocks of a piece that passed against any earlier failure,
+// returning the peers that sent blocks which differed.
+func (s *smartBan) piecePassed(idx int) []string {
+	good, failed := s.current[idx], s.failed[idx]
+	delete(s.current, idx)
+	delete(s.failed, idx)
+
+	var bad []string
+	seen := make(map[string]bool)
+	for begin, r := range failed {
+		if g, ok := good[begin]; ok && g.hash != r.hash && !seen[r.peer] {
+			seen[r.peer] = true
+			bad = append(bad, r.peer)
+		}
+	}
+	return bad
+}
+
+// Bans a peer that sent corrupt data, disconnecting it. Web seeds,
+// named by URL, are disabled instead.
+func (c *Client) banPeer(addr string, idx int) {
+	reason := fmt.Sprintf("corrupt data in piece %d", idx)
+	if c.isWebSeed(addr) {
+		c.disableWebSeed(addr, reason)
+		return
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return
+	}
+	err = c.Bans.Ban(ip, reason)
+
+	if peer, ok := c.peer(addr); ok {
+		peer.Log(p2p.ActivityError, "banned, %s.", reason)
+		if err != nil {
+			peer.Log(p2p.ActivityError, "failed to save ban list: %v.", err)
+		}
+		peer.Disconnect()
+	}
+	c.publish(BansChanged{Bans: c.Bans.List()})
+}
+
+// Pieces that may fail with data only from a web seed before it is
+// disabled. Smart-ban disables it after one if it is caught out.
+const maxWebSeedFailures = 3
+
+// Counts a piece that failed its hash with every block sent by addr,
+// disabling it once a web seed has failed too many. Called by
+// collectPieces only.
+func (c *Client) webSeedFailed(addr string, idx int) {
+	if !c.isWebSeed(addr) {
+		return
+	}
+	c.webSeedFailures[addr]++
+	if n := c.webSeedFailures[addr]; n >= maxWebSeedFailures {
+		c.disableWebSeed(addr, fmt.Sprintf("%d corrupt pieces, the last %d", n, idx))
+	}
+}
+
+func (c *Client) isWebSeed(addr string) bool {
+	for _, url := range c.Torrent.URLList {
+		if url == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Stops the web seed at url, it isn't started again on Resume.
+func (c *Client) disableWebSeed(url, reason string) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.badWebSeeds[url] {
+		return
+	}
+	c.badWebSeeds[url] = true
+	for i, ws := range c.WebSeeds {
+		if ws.URL == url {
+			ws.Stop()
+			c.WebSeeds = append(c.WebSeeds[:i], c.WebSeeds[i+1:]...)
+			break
+		}
+	}
+	c.logger("webseed").Warn("web seed disabled", "url", url, "reason", reason)
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSmartBan(t *testing.T) {
+	s := newSmartBan()
+	s.received(0, 0, "a", []byte("good"))
+	s.received(0, 4, "b", []byte("evil"))
+	sources := s.pieceFailed(0)
+	sort.Strings(sources)
+	if !reflect.DeepEqual(sources, []string{"a", "b"}) {
+		t.Errorf("failed piece sources %v, want [a b]", sources)
+	}
+
+	// Downloaded again, b's block differs from the good copy.
+	s.received(0, 0, "c", []byte("good"))
+	s.received(0, 4, "c", []byte("fine"))
+	if bad := s.piecePassed(0); !reflect.DeepEqual(bad, []string{"b"}) {
+		t.Errorf("bad peers %v, want [b]", bad)
+	}
+	if len(s.current) != 0 || len(s.failed) != 0 {
+		t.Error("passed piece not forgotten")
+	}
+}
+
+func TestWebSeedDisabled(t *testing.T) {
+	c, _ := newTestClient(t, 4*testPieceLength)
+	// Nothing listens on port 1, requests fail until the seeds stop.
+	urls := []string{"http://127.0.0.1:1/a", "http://127.0.0.1:1/b"}
+	c.Torrent.URLList = urls
+	c.stateMu.Lock()
+	c.startWebSeeds()
+	c.stateMu.Unlock()
+	defer func() {
+		c.stateMu.Lock()
+		c.stopWebSeeds()
+		c.stateMu.Unlock()
+	}()
+
+	// Pieces failing with data from only a web seed.
+	for i := 0; i < maxWebSeedFailures-1; i++ {
+		c.webSeedFailed(urls[0], i)
+	}
+	if len(c.WebSeeds) != 2 {
+		t.Fatalf("disabled after %d failures", maxWebSeedFailures-1)
+	}
+	c.webSeedFailed(urls[0], 0)
+	if len(c.WebSeeds) != 1 || c.WebSeeds[0].URL != urls[1] {
+		t.Fatalf("not disabled after %d failures", maxWebSeedFailures)
+	}
+
+	// Caught by smart-ban, disabled at once.
+	c.banPeer(urls[1], 0)
+	if len(c.WebSeeds) != 0 {
+		t.Fatal("not disabled once banned")
+	}
+	if len(c.Bans.List()) != 0 {
+		t.Error("web seed added to the ban list")
+	}
+
+	// Not started again on resume.
+	c.stateMu.Lock()
+	c.startWebSeeds()
+	c.stateMu.Unlock()
+	if len(c.WebSeeds) != 0 {
+		t.Errorf("%d disabled web seeds restarted", len(c.WebSeeds))
+	}
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ------------------------------- Storage ------------------------------//
+
+/* Torrent data is held in memory and written out once downloaded. A single
+ * file torrent is saved as OutputDir/Name, a multi file torrent as
+ * OutputDir/Name/path/to/file.
+ *
+ * Skipped files aren't written, but the pieces at either end of one may
+ * also cover a selected file. Their bytes in the skipped file are kept in
+ * a partfile, OutputDir/.<info hash>.parts, so the pieces verify again.
+ */
+
+// A file of the torrent on disk.
+type diskFile struct {
+	path   string
+	length int
+	skip   bool // Not selected for download.
+}
+
+// Returns the torrent's files in order, as laid out on disk. Paths
+// are checked on parsing, but none may lead outside OutputDir.
+func (c *Client) diskFiles() ([]diskFile, error) {
+	t := c.Torrent
+	if len(t.Files) == 0 {
+		f := diskFile{path: filepath.Join(c.OutputDir, t.Name), length: t.Size}
+		return []diskFile{f}, c.checkPath(f.path)
+	}
+	files := make([]diskFile, len(t.Files))
+	for i, f := range t.Files {
+		parts := append([]string{c.OutputDir, t.Name}, f.Parts...)
+		files[i] = diskFile{path: filepath.Join(parts...), length: f.Length, skip: c.skipFiles[i]}
+		if err := c.checkPath(files[i].path); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func (c *Client) checkPath(path string) error {
+	rel, err := filepath.Rel(c.OutputDir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("file path %q is outside %s", path, c.OutputDir)
+	}
+	return nil
+}
+
+// Verify reads any of the torrent's data already on disk, keeping the
+// pieces that match their hash so they aren't downloaded again. Returns
+// the number of pieces we have, call before Start.
+func (c *Client) Verify() (int, error) {
+	files, err := c.diskFiles()
+	if err != nil {
+		return 0, err
+	}
+	start := 0
+	for _, f := range files {
+		err := readFile(f.path, c.buf[start:start+f.length])
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		start += f.length
+	}
+	if err := c.readParts(); err != nil {
+		return 0, err
+	}
+
+	for idx, hash := range c.Torrent.Pieces {
+		begin, end := c.Torrent.PieceBounds(idx)
+		if sha1.Sum(c.buf[begin:end]) == hash {
+			c.Picker.PieceDone(idx)
+		}
+	}
+	c.logger("storage").Info("verified", "pieces", c.Picker.NumDone(), "total", len(c.Torrent.Pieces))
+	return c.Picker.NumDone(), nil
+}
+
+// Reads as much of buf from the file as it holds, short files
+// leave the rest of buf untouched.
+func readFile(path string, buf []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.ReadFull(f, buf); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
+
+// Writes the downloaded data out to the torrent's files.
+func (c *Client) writeToFile(buf []byte) error {
+	files, err := c.diskFiles()
+	if err != nil {
+		return err
+	}
+	start := 0
+	for _, f := range files {
+		data := buf[start : start+f.length]
+		start += f.length
+		if f.skip {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(f.path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return c.writeParts(files, buf)
+}
+
+func (c *Client) partsPath() string {
+	return filepath.Join(c.OutputDir, "."+c.Torrent.GetInfoHash()+".parts")
+}
+
+// Writes the partfile, each range of a skipped file held by a piece we
+// have is its offset within the torrent and length, then the data.
+// Without any the partfile is removed.
+func (c *Client) writeParts(files []diskFile, buf []byte) error {
+	var parts bytes.Buffer
+	wanted := c.wantedPieces()
+	pieceLength := c.Torrent.PieceLength
+	start := 0
+	for _, f := range files {
+		end := start + f.length
+		if f.skip && f.length > 0 {
+			// Pieces between the first and last only cover this file.
+			for _, idx := range []int{start / pieceLength, (end - 1) / pieceLength} {
+				if !wanted[idx] || !c.Picker.HasPiece(idx) {
+					continue
+				}
+				begin, pieceEnd := c.Torrent.PieceBounds(idx)
+				if begin < start {
+					begin = start
+				}
+				if pieceEnd > end {
+					pieceEnd = end
+				}
+				var header [16]byte
+				binary.BigEndian.PutUint64(header[:8], uint64(begin))
+				binary.BigEndian.PutUint64(header[8:], uint64(pieceEnd-begin))
+				parts.Write(header[:])
+				parts.Write(buf[begin:pieceEnd])
+				if start/pieceLength == (end-1)/pieceLength {
+					break // One piece covers the whole file.
+				}
+			}
+		}
+		start = end
+	}
+
+	if parts.Len() == 0 {
+		if err := os.Remove(c.partsPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(c.OutputDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.partsPath(), parts.Bytes(), 0644)
+}
+
+// Reads the partfile back into the torrent's data. A damaged partfile
+// is read up to the damage, the pieces it held then fail their hash.
+func (c *Client) readParts() error {
+	f, err := os.Open(c.partsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read partfile: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var header [16]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil
+		}
+		begin := binary.BigEndian.Uint64(header[:8])
+		length := binary.BigEndian.Uint64(header[8:])
+		if begin > uint64(len(c.buf)) || length > uint64(len(c.buf))-begin {
+			return nil
+		}
+		if _, err := io.ReadFull(r, c.buf[begin:begin+length]); err != nil {
+			return nil
+		}
+	}
+}
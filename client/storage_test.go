@@ -0,0 +1,113 @@
+package client
+
+import (
+	"crypto/sha1"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/0xNathanW/bittorrent-go/torrent"
+)
+
+// Returns a client for a torrent of random data split into files of
+// the given lengths, saving to dir, and the data.
+func newMultiFileClient(t *testing.T, dir string, lengths []int) (*Client, []byte) {
+	t.Helper()
+	tor := &torrent.Torrent{
+		Name:        "dir",
+		Announce:    "http://127.0.0.1:1/announce",
+		PieceLength: testPieceLength,
+	}
+	for i, length := range lengths {
+		name := string(rune('a' + i))
+		tor.Files = append(tor.Files, torrent.File{Path: name, Parts: []string{name}, Length: length})
+		tor.Size += length
+	}
+	data := make([]byte, tor.Size)
+	rand.New(rand.NewSource(1)).Read(data)
+	for idx := 0; idx*testPieceLength < tor.Size; idx++ {
+		begin, end := tor.PieceBounds(idx)
+		tor.Pieces = append(tor.Pieces, sha1.Sum(data[begin:end]))
+	}
+	c, err := New(tor, [20]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputDir = dir
+	return c, data
+}
+
+// Pieces straddling a skipped file verify after being saved.
+func TestSkippedFileBoundaries(t *testing.T) {
+	dir := t.TempDir()
+	// Piece 1 covers a and b, piece 3 covers b and c.
+	lengths := []int{40000, 60000, 30000}
+	selected := []int{0, 2}
+	c, data := newMultiFileClient(t, dir, lengths)
+	if err := c.SelectFiles(selected); err != nil {
+		t.Fatal(err)
+	}
+	wanted := 0
+	for idx, want := range c.wantedPieces() {
+		if want {
+			begin, end := c.Torrent.PieceBounds(idx)
+			copy(c.buf[begin:end], data[begin:end])
+			c.Picker.PieceDone(idx)
+			wanted++
+		}
+	}
+	if err := c.writeToFile(c.buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir", "b")); !os.IsNotExist(err) {
+		t.Errorf("skipped file written: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		parts bool
+		want  int
+	}{
+		{"with partfile", true, wanted},
+		{"without partfile", false, wanted - 2},
+	} {
+		if !tt.parts {
+			os.Remove(c.partsPath())
+		}
+		c2, _ := newMultiFileClient(t, dir, lengths)
+		if err := c2.SelectFiles(selected); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c2.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: %d pieces verified, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// With every file selected the partfile is no longer needed.
+	if err := c.SelectFiles([]int{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeToFile(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.partsPath()); !os.IsNotExist(err) {
+		t.Errorf("partfile left behind: %v", err)
+	}
+}
+
+func TestReadPartsDamaged(t *testing.T) {
+	c, _ := newMultiFileClient(t, t.TempDir(), []int{1000})
+	// A range past the end of the torrent is ignored.
+	damaged := []byte{0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 1, 2, 3}
+	if err := os.WriteFile(c.partsPath(), damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.readParts(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/0xNathanW/bittorrent-go/p2p"
+	msg "github.com/0xNathanW/bittorrent-go/p2p/message"
+)
+
+// Chooses the pieces offered to each peer while super-seeding,
+// implements p2p.SuperSeeder.
+type superSeed struct {
+	c       *Client
+	mu      sync.Mutex
+	on      bool
+	offered map[string]int // Piece last offered to each peer, by address.
+}
+
+func newSuperSeed(c *Client) *superSeed {
+	return &superSeed{c: c, offered: make(map[string]int)}
+}
+
+// SetSuperSeed turns super-seeding (BEP 16) on or off. Turning it on
+// hides pieces we haven't yet announced to connected peers, turning it
+// off reveals every piece to them.
+func (c *Client) SetSuperSeed(on bool) {
+	s := c.superSeed
+	s.mu.Lock()
+	s.on = on
+	s.offered = make(map[string]int)
+	s.mu.Unlock()
+
+	var seeder p2p.SuperSeeder
+	if on {
+		seeder = s
+	}
+	// Peers yet to connect already have the setting, applying it
+	// again once they have is harmless.
+	for _, peer := range c.peerList() {
+		peer.SetSuperSeeder(seeder)
+	}
+}
+
+// SuperSeeding reports whether super-seeding is on.
+func (c *Client) SuperSeeding() bool {
+	c.superSeed.mu.Lock()
+	defer c.superSeed.mu.Unlock()
+	return c.superSeed.on
+}
+
+// Offer picks the rarest piece the peer lacks, preferring pieces not
+// already offered to someone else.
+func (s *superSeed) Offer(peer string, has msg.Bitfield) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	taken := make(map[int]bool, len(s.offered))
+	for addr, idx := range s.offered {
+		if addr != peer {
+			taken[idx] = true
+		}
+	}
+	pk := s.c.Picker
+	best, bestTaken := -1, false
+	for idx := range s.c.Torrent.Pieces {
+		if has.HasPiece(idx) || !pk.HasPiece(idx) {
+			continue
+		}
+		switch {
+		case best < 0,
+			bestTaken && !taken[idx],
+			bestTaken == taken[idx] && pk.Availability(idx) < pk.Availability(best):
+			best, bestTaken = idx, taken[idx]
+		}
+	}
+	if best >= 0 {
+		s.offered[peer] = best
+	}
+	return best
+}
+
+// Seen offers a new piece to any other peer whose offered piece has now
+// turned up here, as it has been passed on.
+func (s *superSeed) Seen(peer string, idx int) {
+	s.mu.Lock()
+	var next []string
+	for addr, offered := range s.offered {
+		if offered == idx && addr != peer {
+			next = append(next, addr)
+			delete(s.offered, addr)
+		}
+	}
+	// With no one to pass it on to, a peer gets a new piece
+	// as soon as it has downloaded the last.
+	if own, ok := s.offered[peer]; ok && own == idx && len(s.offered) == 1 && len(next) == 0 {
+		next = append(next, peer)
+	}
+	s.mu.Unlock()
+
+	for _, addr := range next {
+		if p, ok := s.c.peer(addr); ok {
+			p.OfferPiece()
+		}
+	}
+}
+
+// Returns the super-seeder for a new connection, nil when off.
+func (s *superSeed) seeder() p2p.SuperSeeder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.on {
+		return nil
+	}
+	return s
+}
+
+// Forgets a disconnected peer's offer.
+func (s *superSeed) remove(peer string) {
+	s.mu.Lock()
+	delete(s.offered, peer)
+	s.mu.Unlock()
+}
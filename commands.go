@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	cli "github.com/0xNathanW/bittorrent-go/client"
+	"github.com/0xNathanW/bittorrent-go/ipfilter"
+	"github.com/0xNathanW/bittorrent-go/ratelimit"
+	"github.com/0xNathanW/bittorrent-go/session"
+	"github.com/0xNathanW/bittorrent-go/torrent"
+	"github.com/0xNathanW/bittorrent-go/ui"
+)
+
+// ---------------------------- Download, seed --------------------------//
+
+// Time allowed to save torrents and tell trackers we have gone on exit.
+const shutdownTimeout = 10 * time.Second
+
+// Flags shared by download and seed.
+type runOptions struct {
+	settings
+	noUI      bool
+	files     string
+	superSeed bool
+}
+
+func (o *runOptions) register(fs *flag.FlagSet) {
+	o.settings.register(fs)
+	o.setting(fs, "o", "output_dir", "directory torrents are saved to")
+	o.setting(fs, "port", "port", "port to listen for peers on")
+	o.setting(fs, "max-peers", "max_peers", "connections per torrent")
+	o.setting(fs, "max-conns", "max_conns", "connections across all torrents")
+	o.setting(fs, "max-half-open", "max_half_open", "outgoing connections being established at once")
+	o.setting(fs, "up", "up_limit", "global upload limit in KiB/s")
+	o.setting(fs, "down", "down_limit", "global download limit in KiB/s")
+	o.setting(fs, "peer-up", "peer_up_limit", "per peer upload limit in KiB/s")
+	o.setting(fs, "peer-down", "peer_down_limit", "per peer download limit in KiB/s")
+	o.setting(fs, "overhead", "count_overhead", "count protocol overhead against the limits")
+	o.setting(fs, "log-level", "log_level", "least severe messages logged: debug, info, warn or error")
+	o.setting(fs, "log-file", "log_file", "file to log to, rotated as it grows, stderr without the dashboard by default")
+	o.setting(fs, "ipfilter", "ip_filter", "blocklist of addresses never connected to (ipfilter.dat, P2P or CIDR, optionally gzipped)")
+	fs.BoolVar(&o.noUI, "no-ui", false, "run without the dashboard, logging progress instead")
+	fs.StringVar(&o.files, "files", "", "comma separated indexes of the files to download from each torrent, all by default")
+	fs.BoolVar(&o.superSeed, "super-seed", false, "reveal pieces one at a time when seeding (BEP 16)")
+}
+
+func download(args []string) int {
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bittorrent-go download [flags] <file.torrent>...")
+		fs.PrintDefaults()
+	}
+	var o runOptions
+	o.register(fs)
+	if code, ok := parseFlags(fs, args, 1); !ok {
+		return code
+	}
+	return o.run(fs.Args(), false)
+}
+
+func seed(args []string) int {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bittorrent-go seed [flags] <file.torrent>...")
+		fs.PrintDefaults()
+	}
+	var o runOptions
+	o.register(fs)
+	if code, ok := parseFlags(fs, args, 1); !ok {
+		return code
+	}
+	return o.run(fs.Args(), true)
+}
+
+// Runs the torrents at paths until they are downloaded, or when seeding
+// or showing the dashboard, until quit.
+func (o *runOptions) run(paths []string, seeding bool) int {
+	cfg, err := o.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	for _, p := range paths {
+		if err := verifyPath(p); err != nil {
+			return fail(err)
+		}
+	}
+	var indexes []int
+	if o.files != "" {
+		var err error
+		if indexes, err = parseIndexes(o.files); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+	logger, closeLog, err := newLogger(cfg, !o.noUI)
+	if err != nil {
+		return fail(err)
+	}
+	defer closeLog()
+
+	// Blocklist is reloaded whenever the file changes.
+	if cfg.IPFilter != "" {
+		if err := ipfilter.Global.Load(cfg.IPFilter); err != nil {
+			return fail(err)
+		}
+		if n := ipfilter.Global.Skipped(); n > 0 {
+			logger.Warn("ip filter lines skipped", "path", cfg.IPFilter, "lines", n)
+		}
+		go ipfilter.Global.Watch(time.Minute, nil)
+	}
+	ratelimit.GlobalUp.SetRate(cfg.UpLimit << 10)
+	ratelimit.GlobalDown.SetRate(cfg.DownLimit << 10)
+	cli.GlobalConns.MaxConns = cfg.MaxConns
+	cli.GlobalConns.MaxHalfOpen = cfg.MaxHalfOpen
+
+	// The first SIGINT or SIGTERM shuts down gracefully, see shutdown.
+	ctx, sig, stopSignals := onSignal()
+	defer stopSignals()
+
+	s, err := session.New(context.Background(), cfg.Port)
+	if err != nil {
+		return fail(err)
+	}
+	s.HandshakeTimeout = time.Duration(cfg.HandshakeTimeout)
+	s.MaxHandshakes = cfg.MaxHalfOpen
+	s.Logger = logger
+
+	var completed sync.WaitGroup // Torrents yet to finish downloading.
+	var clients []*cli.Client
+	for _, p := range paths {
+		client, err := s.Add(p, func(client *cli.Client) error {
+			client.OutputDir = cfg.OutputDir
+			client.MaxPeers = cfg.MaxPeers
+			client.UploadSlots = cfg.UploadSlots
+			client.CountOverhead = cfg.CountOverhead
+			client.PeerTimeouts = cfg.PeerTimeouts()
+			client.MaxStrikes = cfg.MaxStrikes
+			client.Picker.SetBlockSize(cfg.BlockSize)
+			client.Tracker.Client.Timeout = time.Duration(cfg.TrackerTimeout)
+			client.SetSuperSeed(o.superSeed)
+			client.SetPeerLimits(cfg.PeerUpLimit<<10, cfg.PeerDownLimit<<10)
+			if indexes != nil {
+				if err := client.SelectFiles(indexes); err != nil {
+					return err
+				}
+			}
+			// Anything already on disk isn't downloaded again.
+			have, err := client.Verify()
+			if err != nil {
+				return err
+			}
+			if seeding && !client.Stats().Complete {
+				return fmt.Errorf("%s: only %d of %d pieces in %s",
+					client.Torrent.Name, have, len(client.Torrent.Pieces), cfg.OutputDir)
+			}
+			// Subscribed before starting, so nothing is missed.
+			events, _ := client.Subscribe()
+			completed.Add(1)
+			log := logger.Component("client").With("torrent", client.Torrent.Name, "info_hash", client.Torrent.GetInfoHash())
+			go logEvents(client, events, log, completed.Done)
+			return nil
+		})
+		if err != nil {
+			shutdown(s, exitError)
+			return fail(err)
+		}
+		clients = append(clients, client)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		completed.Wait()
+		close(done)
+	}()
+
+	if !o.noUI {
+		// The dashboard shows the first torrent, the rest run alongside it.
+		if err := ui.Run(ctx, clients[0], time.Duration(cfg.RefreshRate)); err != nil {
+			shutdown(s, exitError)
+			return fail(err)
+		}
+	} else {
+		wait := done
+		if seeding {
+			wait = nil // Seeds run until stopped.
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+		}
+	}
+	if received := sig(); received != nil {
+		logger.Info("stopping", "signal", received)
+	}
+	stopSignals() // A second signal kills us outright.
+
+	code := exitOK
+	select {
+	case <-done:
+	default:
+		// Quitting the dashboard early counts as an interrupt.
+		if seeding {
+			break
+		}
+		code = exitInterrupted
+		if sig() == syscall.SIGTERM {
+			code = exitTerminated
+		}
+	}
+	return shutdown(s, code)
+}
+
+// Stops every torrent, saving them and telling their trackers, returns
+// code, or exitError if that fails or takes longer than shutdownTimeout.
+func shutdown(s *session.Session, code int) int {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		return fail(err)
+	}
+	return code
+}
+
+// Returns a context cancelled on SIGINT or SIGTERM, and sig to get the
+// signal received, if any. stop restores the default handling.
+func onSignal() (ctx context.Context, sig func() os.Signal, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	var mu sync.Mutex
+	var received os.Signal
+	go func() {
+		select {
+		case s := <-signals:
+			mu.Lock()
+			received = s
+			mu.Unlock()
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	sig = func() os.Signal {
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+	stop = func() {
+		signal.Stop(signals)
+		cancel()
+	}
+	return ctx, sig, stop
+}
+
+// -------------------------------- Create ------------------------------//
+
+func create(args []string) int {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bittorrent-go create [flags] <file or directory>")
+		fs.PrintDefaults()
+	}
+	out := fs.String("o", "", "torrent file to write, <name>.torrent by default")
+	trackers := fs.String("tracker", "", "comma separated tracker announce URLs, in order of preference")
+	webSeeds := fs.String("webseed", "", "comma separated web seed URLs (BEP 19)")
+	pieceLength := fs.Int("piece-length", torrent.DefaultPieceLength>>10, "piece length in KiB, a power of two")
+	if code, ok := parseFlags(fs, args, 1); !ok {
+		return code
+	}
+
+	src := fs.Arg(0)
+	data, err := torrent.Create(src, splitList(*trackers), splitList(*webSeeds), *pieceLength<<10)
+	if err != nil {
+		return fail(err)
+	}
+	if *out == "" {
+		*out = filepath.Base(filepath.Clean(src)) + ".torrent"
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		return fail(err)
+	}
+	fmt.Println(*out)
+	return exitOK
+}
+
+// ------------------------------ Info, magnet --------------------------//
+
+func info(args []string) int {
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bittorrent-go info <file.torrent>")
+		fs.PrintDefaults()
+	}
+	t, code, ok := openTorrent(fs, args)
+	if !ok {
+		return code
+	}
+
+	fmt.Printf("Name:       %s\n", t.Name)
+	fmt.Printf("Info hash:  %s\n", t.GetInfoHash())
+	fmt.Printf("Size:       %s (%d bytes)\n", t.GetSize(), t.Size)
+	fmt.Printf("Pieces:     %d of %d KiB\n", len(t.Pieces), t.PieceLength>>10)
+	if t.Announce != "" {
+		fmt.Printf("Tracker:    %s\n", t.Announce)
+	}
+	for _, tr := range t.AnnounceList {
+		if tr != t.Announce {
+			fmt.Printf("Tracker:    %s\n", tr)
+		}
+	}
+	for _, ws := range t.URLList {
+		fmt.Printf("Web seed:   %s\n", ws)
+	}
+	if len(t.Files) > 0 {
+		fmt.Println("Files:")
+		for i, f := range t.Files {
+			fmt.Printf("  %3d  %12d  %s\n", i, f.Length, strings.Join(f.Parts, "/"))
+		}
+	}
+	return exitOK
+}
+
+func magnet(args []string) int {
+	fs := flag.NewFlagSet("magnet", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bittorrent-go magnet <file.torrent>")
+		fs.PrintDefaults()
+	}
+	t, code, ok := openTorrent(fs, args)
+	if !ok {
+		return code
+	}
+	fmt.Println(t.Magnet())
+	return exitOK
+}
+
+// -------------------------------- Verify ------------------------------//
+
+func verify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: bittorrent-go verify [flags] <file.torrent>")
+		fs.PrintDefaults()
+	}
+	var o settings
+	o.register(fs)
+	o.setting(fs, "o", "output_dir", "directory the torrent was saved to")
+	t, code, ok := openTorrent(fs, args)
+	if !ok {
+		return code
+	}
+	cfg, err := o.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	client, err := cli.New(t, [20]byte{})
+	if err != nil {
+		return fail(err)
+	}
+	client.OutputDir = cfg.OutputDir
+	have, err := client.Verify()
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Printf("%s: %d of %d pieces\n", t.Name, have, len(t.Pieces))
+	if have < len(t.Pieces) {
+		return exitIncomplete
+	}
+	return exitOK
+}
+
+// Parses the flags of a command taking one torrent file, and loads it.
+func openTorrent(fs *flag.FlagSet, args []string) (t *torrent.Torrent, code int, ok bool) {
+	if code, ok := parseFlags(fs, args, 1); !ok {
+		return nil, code, false
+	}
+	if err := verifyPath(fs.Arg(0)); err != nil {
+		return nil, fail(err), false
+	}
+	t, err := torrent.NewTorrent(fs.Arg(0))
+	if err != nil {
+		return nil, fail(err), false
+	}
+	return t, exitOK, true
+}
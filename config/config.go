@@ -0,0 +1,378 @@
+// Package config loads settings in layers, each overriding the last:
+// defaults, JSON config files, environment variables, then flags.
+//
+// Config files are read from bittorrent-go/config.json in each of
+// $XDG_CONFIG_DIRS (default /etc/xdg), then $XDG_CONFIG_HOME (default
+// ~/.config), or only from the file given to Load. Environment variables
+// are the keys in upper case prefixed with BITTORRENT_GO_, eg.
+// BITTORRENT_GO_MAX_PEERS=80.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0xNathanW/bittorrent-go/client"
+	"github.com/0xNathanW/bittorrent-go/logging"
+	"github.com/0xNathanW/bittorrent-go/p2p"
+	"github.com/0xNathanW/bittorrent-go/picker"
+	"github.com/0xNathanW/bittorrent-go/tracker"
+	"github.com/0xNathanW/bittorrent-go/ui"
+)
+
+const (
+	appName   = "bittorrent-go"
+	fileName  = "config.json"
+	envPrefix = "BITTORRENT_GO_"
+)
+
+// Config is every setting, keys are the JSON names.
+type Config struct {
+	Port      int    `json:"port"`
+	OutputDir string `json:"output_dir"`
+	// Connection caps.
+	MaxPeers    int `json:"max_peers"`
+	MaxConns    int `json:"max_conns"`
+	MaxHalfOpen int `json:"max_half_open"`
+	UploadSlots int `json:"upload_slots"`
+	// Bandwidth limits in KiB/s, 0 for unlimited.
+	UpLimit       int  `json:"up_limit"`
+	DownLimit     int  `json:"down_limit"`
+	PeerUpLimit   int  `json:"peer_up_limit"`
+	PeerDownLimit int  `json:"peer_down_limit"`
+	CountOverhead bool `json:"count_overhead"`
+	// Peer wire protocol.
+	BlockSize         int      `json:"block_size"`
+	MaxStrikes        int      `json:"max_strikes"`
+	DialTimeout       Duration `json:"dial_timeout"`
+	HandshakeTimeout  Duration `json:"handshake_timeout"`
+	RequestTimeout    Duration `json:"request_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	SnubTimeout       Duration `json:"snub_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	UploadOnlyTimeout Duration `json:"upload_only_timeout"` // Idle timeout for seeds.
+	TrackerTimeout    Duration `json:"tracker_timeout"`
+	IPFilter          string   `json:"ip_filter"`
+
+	RefreshRate Duration `json:"refresh_rate"`
+	LogLevel    string   `json:"log_level"`
+	LogFile     string   `json:"log_file"`
+	LogMaxSize  int      `json:"log_max_size"` // MiB before the log file is rotated.
+	LogBackups  int      `json:"log_backups"`  // Rotated log files kept.
+}
+
+// Default returns the built in settings.
+func Default() *Config {
+	return &Config{
+		Port:              tracker.ClientPort,
+		OutputDir:         ".",
+		MaxPeers:          client.DefaultMaxPeers,
+		MaxConns:          client.DefaultMaxConns,
+		MaxHalfOpen:       client.DefaultMaxHalfOpen,
+		UploadSlots:       client.DefaultUploadSlots,
+		BlockSize:         picker.DefaultBlockSize,
+		MaxStrikes:        p2p.DefaultMaxStrikes,
+		DialTimeout:       Duration(p2p.DefaultTimeouts.Dial),
+		HandshakeTimeout:  Duration(p2p.DefaultTimeouts.Handshake),
+		RequestTimeout:    Duration(p2p.DefaultTimeouts.Request),
+		WriteTimeout:      Duration(p2p.DefaultTimeouts.Write),
+		ReadTimeout:       Duration(p2p.DefaultTimeouts.Read),
+		SnubTimeout:       Duration(p2p.DefaultTimeouts.Snub),
+		IdleTimeout:       Duration(p2p.DefaultTimeouts.Idle),
+		UploadOnlyTimeout: Duration(p2p.DefaultTimeouts.UploadOnly),
+		TrackerTimeout:    Duration(tracker.DefaultTimeout),
+		RefreshRate:       Duration(ui.DefaultRefreshRate),
+		LogLevel:          "info",
+		LogMaxSize:        10,
+		LogBackups:        3,
+	}
+}
+
+// Load returns the settings from the config files, or only from path if
+// it isn't empty, the environment, then overrides, eg. from flags.
+func Load(path string, overrides map[string]string) (*Config, error) {
+	c := Default()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, p := range Paths() {
+			err := c.loadFile(p)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+	if err := c.loadEnv(); err != nil {
+		return nil, err
+	}
+	for key, value := range overrides {
+		if err := c.Set(key, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Paths returns the config files read by Load, least important first.
+func Paths() []string {
+	dirs := os.Getenv("XDG_CONFIG_DIRS")
+	if dirs == "" {
+		dirs = "/etc/xdg"
+	}
+	var paths []string
+	list := filepath.SplitList(dirs)
+	for i := len(list) - 1; i >= 0; i-- { // The first directory is most important.
+		if list[i] != "" {
+			paths = append(paths, filepath.Join(list[i], appName, fileName))
+		}
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, appName, fileName))
+	}
+	return paths
+}
+
+// Settings in the file replace those already set.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	for _, key := range Keys() {
+		value, ok := os.LookupEnv(envPrefix + strings.ToUpper(key))
+		if !ok {
+			continue
+		}
+		if err := c.Set(key, value); err != nil {
+			return fmt.Errorf("%s%s: %w", envPrefix, strings.ToUpper(key), err)
+		}
+	}
+	return nil
+}
+
+// Keys returns the name of every setting.
+func Keys() []string {
+	var keys []string
+	for _, f := range fields(Default()) {
+		keys = append(keys, f.key)
+	}
+	return keys
+}
+
+// Value returns a pointer to the setting with the given key, or nil.
+func (c *Config) Value(key string) interface{} {
+	for _, f := range fields(c) {
+		if f.key == key {
+			return f.ptr
+		}
+	}
+	return nil
+}
+
+// Get returns the setting with the given key as text, as passed to Set.
+func (c *Config) Get(key string) string {
+	switch ptr := c.Value(key).(type) {
+	case *string:
+		return *ptr
+	case *int:
+		return strconv.Itoa(*ptr)
+	case *bool:
+		return strconv.FormatBool(*ptr)
+	case *Duration:
+		return ptr.String()
+	}
+	return ""
+}
+
+// Set parses value into the setting with the given key.
+func (c *Config) Set(key, value string) error {
+	switch ptr := c.Value(key).(type) {
+	case *string:
+		*ptr = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a whole number", key, value)
+		}
+		*ptr = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not true or false", key, value)
+		}
+		*ptr = b
+	case *Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a duration, eg. 30s", key, value)
+		}
+		*ptr = Duration(d)
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+// A setting and where it is stored.
+type field struct {
+	key string
+	ptr interface{}
+}
+
+func fields(c *Config) []field {
+	return []field{
+		{"port", &c.Port},
+		{"output_dir", &c.OutputDir},
+		{"max_peers", &c.MaxPeers},
+		{"max_conns", &c.MaxConns},
+		{"max_half_open", &c.MaxHalfOpen},
+		{"upload_slots", &c.UploadSlots},
+		{"up_limit", &c.UpLimit},
+		{"down_limit", &c.DownLimit},
+		{"peer_up_limit", &c.PeerUpLimit},
+		{"peer_down_limit", &c.PeerDownLimit},
+		{"count_overhead", &c.CountOverhead},
+		{"block_size", &c.BlockSize},
+		{"max_strikes", &c.MaxStrikes},
+		{"dial_timeout", &c.DialTimeout},
+		{"handshake_timeout", &c.HandshakeTimeout},
+		{"request_timeout", &c.RequestTimeout},
+		{"write_timeout", &c.WriteTimeout},
+		{"read_timeout", &c.ReadTimeout},
+		{"snub_timeout", &c.SnubTimeout},
+		{"idle_timeout", &c.IdleTimeout},
+		{"upload_only_timeout", &c.UploadOnlyTimeout},
+		{"tracker_timeout", &c.TrackerTimeout},
+		{"ip_filter", &c.IPFilter},
+		{"refresh_rate", &c.RefreshRate},
+		{"log_level", &c.LogLevel},
+		{"log_file", &c.LogFile},
+		{"log_max_size", &c.LogMaxSize},
+		{"log_backups", &c.LogBackups},
+	}
+}
+
+// Validate checks every setting is usable.
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.Port >= 1 && c.Port <= 65535, "port: %d is not between 1 and 65535", c.Port)
+	check(c.OutputDir != "", "output_dir: must be set")
+	for _, n := range []struct {
+		key   string
+		value int
+	}{
+		{"max_peers", c.MaxPeers},
+		{"max_conns", c.MaxConns},
+		{"max_half_open", c.MaxHalfOpen},
+		{"upload_slots", c.UploadSlots},
+		{"max_strikes", c.MaxStrikes},
+		{"log_max_size", c.LogMaxSize},
+	} {
+		check(n.value >= 1, "%s: must be at least 1, not %d", n.key, n.value)
+	}
+	for _, n := range []struct {
+		key   string
+		value int
+	}{
+		{"up_limit", c.UpLimit},
+		{"down_limit", c.DownLimit},
+		{"peer_up_limit", c.PeerUpLimit},
+		{"peer_down_limit", c.PeerDownLimit},
+	} {
+		check(n.value >= 0, "%s: can't be negative, use 0 for unlimited", n.key)
+	}
+	check(c.LogBackups >= 0, "log_backups: can't be negative")
+	// Peers refuse requests for more than 16 KiB, or 128 KiB at most.
+	check(c.BlockSize >= 1<<10 && c.BlockSize <= 1<<17 && c.BlockSize&(c.BlockSize-1) == 0,
+		"block_size: %d is not a power of two between 1024 and 131072", c.BlockSize)
+	for _, d := range []struct {
+		key   string
+		value Duration
+	}{
+		{"dial_timeout", c.DialTimeout},
+		{"handshake_timeout", c.HandshakeTimeout},
+		{"request_timeout", c.RequestTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"read_timeout", c.ReadTimeout},
+		{"snub_timeout", c.SnubTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"upload_only_timeout", c.UploadOnlyTimeout},
+		{"tracker_timeout", c.TrackerTimeout},
+		{"refresh_rate", c.RefreshRate},
+	} {
+		check(d.value > 0, "%s: must be more than 0", d.key)
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, "log_level: "+err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// PeerTimeouts returns the timeouts given to peers.
+func (c *Config) PeerTimeouts() p2p.Timeouts {
+	return p2p.Timeouts{
+		Dial:       time.Duration(c.DialTimeout),
+		Handshake:  time.Duration(c.HandshakeTimeout),
+		Request:    time.Duration(c.RequestTimeout),
+		Write:      time.Duration(c.WriteTimeout),
+		Read:       time.Duration(c.ReadTimeout),
+		Snub:       time.Duration(c.SnubTimeout),
+		Idle:       time.Duration(c.IdleTimeout),
+		UploadOnly: time.Duration(c.UploadOnlyTimeout),
+	}
+}
+
+// Duration is a time.Duration written as a string in JSON, eg. "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string, eg. \"30s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a config file, returning its path.
+func writeFile(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), fileName)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadLayers(t *testing.T) {
+	path := writeFile(t, `{"max_peers": 10, "up_limit": 20, "down_limit": 30, "snub_timeout": "2m"}`)
+	t.Setenv(envPrefix+"UP_LIMIT", "21")
+	t.Setenv(envPrefix+"DOWN_LIMIT", "31")
+	c, err := Load(path, map[string]string{"down_limit": "32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		key, want string
+	}{
+		{"port", Default().Get("port")}, // Only the default.
+		{"max_peers", "10"},             // File over the default.
+		{"up_limit", "21"},              // Environment over the file.
+		{"down_limit", "32"},            // Flags over the environment.
+		{"snub_timeout", "2m0s"},
+	} {
+		if got := c.Get(tt.key); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.key, got, tt.want)
+		}
+	}
+	if got := c.PeerTimeouts().Snub; got != 2*time.Minute {
+		t.Errorf("peer snub timeout %v, want 2m", got)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, file string
+		env        string
+		overrides  map[string]string
+		want       string
+	}{
+		{"unknown key in file", `{"max_peer": 10}`, "", nil, `unknown field "max_peer"`},
+		{"wrong type in file", `{"max_peers": "ten"}`, "", nil, "max_peers"},
+		{"bad duration in file", `{"read_timeout": 30}`, "", nil, "duration must be a string"},
+		{"bad environment value", `{}`, "ten", nil, envPrefix + "MAX_PEERS: max_peers: \"ten\" is not a whole number"},
+		{"unknown flag", `{}`, "", map[string]string{"nope": "1"}, `unknown setting "nope"`},
+		{"bad flag duration", `{}`, "", map[string]string{"idle_timeout": "10"}, "idle_timeout: \"10\" is not a duration"},
+		{"invalid after layering", `{"max_peers": 10}`, "", map[string]string{"max_peers": "0"}, "max_peers: must be at least 1, not 0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv(envPrefix+"MAX_PEERS", tt.env)
+			}
+			_, err := Load(writeFile(t, tt.file), tt.overrides)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json"), nil); err == nil {
+		t.Error("no error for a missing config file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+	for _, tt := range []struct {
+		key, value, want string
+	}{
+		{"port", "0", "port: 0 is not between 1 and 65535"},
+		{"port", "65536", "port: 65536 is not between 1 and 65535"},
+		{"output_dir", "", "output_dir: must be set"},
+		{"max_half_open", "0", "max_half_open: must be at least 1, not 0"},
+		{"up_limit", "-1", "up_limit: can't be negative, use 0 for unlimited"},
+		{"log_backups", "-1", "log_backups: can't be negative"},
+		{"block_size", "1000", "block_size: 1000 is not a power of two between 1024 and 131072"},
+		{"block_size", "262144", "block_size: 262144 is not a power of two"},
+		{"read_timeout", "0s", "read_timeout: must be more than 0"},
+		{"upload_only_timeout", "-1s", "upload_only_timeout: must be more than 0"},
+		{"log_level", "loud", "log_level: "},
+	} {
+		c := Default()
+		if err := c.Set(tt.key, tt.value); err != nil {
+			t.Fatalf("%s=%s: %v", tt.key, tt.value, err)
+		}
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s=%s: got %v, want %q", tt.key, tt.value, err, tt.want)
+		}
+	}
+
+	// Every problem is reported at once.
+	c := Default()
+	c.Port, c.MaxPeers = 0, 0
+	err := c.Validate()
+	if err == nil || strings.Count(err.Error(), "\n  ") != 2 {
+		t.Errorf("got %v, want two problems", err)
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	c := Default()
+	for _, key := range Keys() {
+		if err := c.Set(key, c.Get(key)); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+	if c.Value("nope") != nil || c.Get("nope") != "" {
+		t.Error("unknown key has a value")
+	}
+}
@@ -0,0 +1,327 @@
+// Package ipfilter blocks address ranges loaded from blocklist files.
+//
+// Supported formats, optionally gzip compressed:
+//   - eMule ipfilter.dat: "1.2.3.0 - 1.2.3.255 , 000 , description"
+//   - PeerGuardian P2P:   "description:1.2.3.0-1.2.3.255"
+//   - CIDR lists:         "1.2.3.0/24", or a single address per line
+//
+// Lines starting with '#' or "//" are comments. Malformed lines, common
+// in published lists, are skipped and counted.
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eMule access levels at or above this are allowed, not blocked.
+const allowLevel = 128
+
+// Blocked addresses remembered so repeats aren't counted again,
+// all are forgotten once there are more.
+const maxRecent = 4096
+
+// Global filter shared by every torrent, empty unless loaded.
+var Global = New()
+
+// Range is an inclusive span of addresses, IPv4 held in IPv6 form.
+type Range struct {
+	Start [16]byte
+	End   [16]byte
+}
+
+// Filter reports whether addresses fall in any blocked range.
+// A nil Filter blocks nothing.
+type Filter struct {
+	mu      sync.RWMutex
+	ranges  []Range // Sorted and merged, so lookups are a binary search.
+	path    string
+	modTime time.Time
+	size    int64
+	skipped int // Malformed lines in the file.
+
+	blockedMu sync.Mutex
+	blocked   uint64            // Addresses refused, see recent.
+	recent    map[[16]byte]bool // Addresses counted in blocked.
+}
+
+// New returns an empty filter.
+func New() *Filter {
+	return &Filter{recent: make(map[[16]byte]bool)}
+}
+
+// Load replaces the filter's ranges with those in the file at path,
+// which is remembered for Watch.
+func (f *Filter) Load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to load ip filter: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to load ip filter: %w", err)
+	}
+	ranges, skipped, err := Parse(file)
+	if err != nil {
+		return fmt.Errorf("failed to load ip filter %s: %w", path, err)
+	}
+
+	f.mu.Lock()
+	f.ranges, f.skipped = ranges, skipped
+	f.path, f.modTime, f.size = path, info.ModTime(), info.Size()
+	f.mu.Unlock()
+	return nil
+}
+
+// Skipped returns the number of malformed lines in the loaded file.
+func (f *Filter) Skipped() int {
+	if f == nil {
+		return 0
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.skipped
+}
+
+// Watch reloads the file whenever it changes, checking every interval.
+// A file that fails to reload leaves the previous ranges in place.
+func (f *Filter) Watch(interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+		f.mu.RLock()
+		path, modTime, size := f.path, f.modTime, f.size
+		f.mu.RUnlock()
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+			continue
+		}
+		f.Load(path)
+	}
+}
+
+// Blocked reports whether ip is in a blocked range, counting the
+// address unless it was blocked recently.
+func (f *Filter) Blocked(ip net.IP) bool {
+	if f == nil {
+		return false
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	var key [16]byte
+	copy(key[:], ip16)
+
+	f.mu.RLock()
+	ranges := f.ranges
+	f.mu.RUnlock()
+
+	// First range ending at or after the address.
+	i := sort.Search(len(ranges), func(i int) bool {
+		return bytes.Compare(ranges[i].End[:], key[:]) >= 0
+	})
+	if i == len(ranges) || bytes.Compare(ranges[i].Start[:], key[:]) > 0 {
+		return false
+	}
+	f.blockedMu.Lock()
+	if !f.recent[key] {
+		if len(f.recent) == maxRecent {
+			f.recent = make(map[[16]byte]bool)
+		}
+		f.recent[key] = true
+		f.blocked++
+	}
+	f.blockedMu.Unlock()
+	return true
+}
+
+// Stats returns the number of ranges loaded and addresses blocked so
+// far, an address blocked again soon after is counted once.
+func (f *Filter) Stats() (ranges int, blocked uint64) {
+	if f == nil {
+		return 0, 0
+	}
+	f.mu.RLock()
+	ranges = len(f.ranges)
+	f.mu.RUnlock()
+	f.blockedMu.Lock()
+	defer f.blockedMu.Unlock()
+	return ranges, f.blocked
+}
+
+// Parse reads blocked ranges in any supported format, the result is
+// sorted with overlapping ranges merged. Malformed lines are skipped,
+// only failing to read is an error.
+func Parse(r io.Reader) (ranges []Range, skipped int, err error) {
+	br := bufio.NewReader(r)
+	// Gzip streams start with 0x1f 0x8b.
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	scanner := bufio.NewScanner(br)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rng, ok, err := parseLine(line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if ok {
+			ranges = append(ranges, rng)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, err
+	}
+	return merge(ranges), skipped, nil
+}
+
+// Parses a single rule, ok is false for rules that allow the range.
+func parseLine(line string) (rng Range, ok bool, err error) {
+	// eMule, the description may itself contain commas.
+	if fields := strings.SplitN(line, ",", 3); len(fields) >= 2 {
+		if rng, err := parseRange(fields[0]); err == nil {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return rng, false, fmt.Errorf("bad access level %q", fields[1])
+			}
+			return rng, level < allowLevel, nil
+		}
+	}
+	// PeerGuardian, the description may contain colons so the range
+	// follows the last one.
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		if rng, err := parseRange(line[i+1:]); err == nil {
+			return rng, true, nil
+		}
+	}
+	if strings.Contains(line, "/") {
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			return rng, false, err
+		}
+		return cidrRange(ipNet), true, nil
+	}
+	// A bare range or address, including IPv6 ones.
+	rng, err = parseRange(line)
+	return rng, err == nil, err
+}
+
+// Parses "start - end" or a single address.
+func parseRange(s string) (Range, error) {
+	var rng Range
+	start, end := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		start, end = s[:i], s[i+1:]
+	}
+	a, b := parseIP(start), parseIP(end)
+	if a == nil || b == nil {
+		return rng, fmt.Errorf("bad range %q", strings.TrimSpace(s))
+	}
+	copy(rng.Start[:], a)
+	copy(rng.End[:], b)
+	if bytes.Compare(rng.Start[:], rng.End[:]) > 0 {
+		rng.Start, rng.End = rng.End, rng.Start
+	}
+	return rng, nil
+}
+
+// Parses an address in IPv6 form, eMule lists pad octets with zeros
+// (eg. 001.002.003.004), which net.ParseIP rejects.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.To16()
+	}
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil
+	}
+	var ip [4]byte
+	for i, o := range octets {
+		n, err := strconv.Atoi(o)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3]).To16()
+}
+
+func cidrRange(ipNet *net.IPNet) Range {
+	var rng Range
+	start := ipNet.IP.To16()
+	mask := ipNet.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	copy(rng.Start[:], start)
+	for i := range rng.End {
+		rng.End[i] = start[i] | ^mask[i]
+	}
+	return rng
+}
+
+// Sorts ranges by start, joining any that overlap or touch.
+func merge(ranges []Range) []Range {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].Start[:], ranges[j].Start[:]) < 0
+	})
+	merged := ranges[:0]
+	for _, rng := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next := last.End
+			// Wrapping past the maximum address means everything follows.
+			if !increment(&next) || bytes.Compare(rng.Start[:], next[:]) <= 0 {
+				if bytes.Compare(rng.End[:], last.End[:]) > 0 {
+					last.End = rng.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, rng)
+	}
+	return merged
+}
+
+// Adds one to an address, false if it wrapped past the maximum.
+func increment(ip *[16]byte) bool {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
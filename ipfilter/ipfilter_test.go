@@ -0,0 +1,215 @@
+package ipfilter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns the range from start to end, both inclusive.
+func r(start, end string) Range {
+	var rng Range
+	copy(rng.Start[:], net.ParseIP(start).To16())
+	copy(rng.End[:], net.ParseIP(end).To16())
+	return rng
+}
+
+func TestParseLine(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		line  string
+		want  Range
+		block bool
+	}{
+		{"eMule", "1.2.3.0 - 1.2.3.255 , 000 , Some ISP", r("1.2.3.0", "1.2.3.255"), true},
+		{"eMule padded octets", "001.002.003.000 - 001.002.003.255 , 100 , x", r("1.2.3.0", "1.2.3.255"), true},
+		{"eMule commas in description", "1.2.3.0 - 1.2.3.255 , 0 , a, b, c", r("1.2.3.0", "1.2.3.255"), true},
+		{"eMule last blocked level", "1.2.3.0 - 1.2.3.255 , 127 , x", r("1.2.3.0", "1.2.3.255"), true},
+		{"eMule allowed level", "1.2.3.0 - 1.2.3.255 , 128 , x", r("1.2.3.0", "1.2.3.255"), false},
+		{"eMule no description", "1.2.3.0 - 1.2.3.255 , 0", r("1.2.3.0", "1.2.3.255"), true},
+		{"PeerGuardian", "Some ISP:1.2.3.0-1.2.3.255", r("1.2.3.0", "1.2.3.255"), true},
+		{"PeerGuardian colons in description", "a:b:c:1.2.3.0-1.2.3.255", r("1.2.3.0", "1.2.3.255"), true},
+		{"CIDR", "10.0.0.0/8", r("10.0.0.0", "10.255.255.255"), true},
+		{"CIDR host bits set", "10.1.2.3/16", r("10.1.0.0", "10.1.255.255"), true},
+		{"CIDR single address", "10.1.2.3/32", r("10.1.2.3", "10.1.2.3"), true},
+		{"CIDR IPv6", "2001:db8::/32", r("2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"), true},
+		{"address", "1.2.3.4", r("1.2.3.4", "1.2.3.4"), true},
+		{"IPv6 address", "2001:db8::1", r("2001:db8::1", "2001:db8::1"), true},
+		{"IPv6 range", "2001:db8::-2001:db8::ff", r("2001:db8::", "2001:db8::ff"), true},
+		{"swapped range", "1.2.3.255 - 1.2.3.0", r("1.2.3.0", "1.2.3.255"), true},
+	} {
+		got, block, err := parseLine(tt.line)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want || block != tt.block {
+			t.Errorf("%s: got %v blocking %v, want %v blocking %v", tt.name, got, block, tt.want, tt.block)
+		}
+	}
+}
+
+func TestParseLineRejects(t *testing.T) {
+	for _, line := range []string{
+		"garbage",
+		"1.2.3",
+		"1.2.3.256",
+		"1.2.3.0 - 1.2.3.255 , level , x",
+		"desc:1.2.3.0-nowhere",
+		"10.0.0.0/33",
+		"1.2.3.0 - ",
+	} {
+		if _, _, err := parseLine(line); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+const blocklist = `# eMule
+1.2.3.0 - 1.2.3.255 , 000 , blocked
+5.0.0.0 - 5.0.0.255 , 200 , allowed
+// PeerGuardian
+ISP:9.9.9.0-9.9.9.9
+not a rule
+10.0.0.0/8
+
+2001:db8::/64
+`
+
+func TestParse(t *testing.T) {
+	want := []Range{
+		r("1.2.3.0", "1.2.3.255"),
+		r("9.9.9.0", "9.9.9.9"),
+		r("10.0.0.0", "10.255.255.255"),
+		r("2001:db8::", "2001:db8::ffff:ffff:ffff:ffff"),
+	}
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(blocklist))
+	w.Close()
+
+	for name, data := range map[string][]byte{
+		"plain": []byte(blocklist),
+		"gzip":  gz.Bytes(),
+	} {
+		got, skipped, err := Parse(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if skipped != 1 {
+			t.Errorf("%s: skipped %d lines, want 1", name, skipped)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   []Range
+		want []Range
+	}{
+		{
+			"sorted",
+			[]Range{r("5.0.0.0", "5.0.0.9"), r("1.0.0.0", "1.0.0.9")},
+			[]Range{r("1.0.0.0", "1.0.0.9"), r("5.0.0.0", "5.0.0.9")},
+		},
+		{
+			"overlapping",
+			[]Range{r("1.0.0.0", "1.0.0.9"), r("1.0.0.5", "1.0.0.20")},
+			[]Range{r("1.0.0.0", "1.0.0.20")},
+		},
+		{
+			"touching",
+			[]Range{r("1.0.0.0", "1.0.0.255"), r("1.0.1.0", "1.0.1.9")},
+			[]Range{r("1.0.0.0", "1.0.1.9")},
+		},
+		{
+			"one apart",
+			[]Range{r("1.0.0.0", "1.0.0.9"), r("1.0.0.11", "1.0.0.20")},
+			[]Range{r("1.0.0.0", "1.0.0.9"), r("1.0.0.11", "1.0.0.20")},
+		},
+		{
+			"contained",
+			[]Range{r("1.0.0.0", "1.0.0.255"), r("1.0.0.5", "1.0.0.6"), r("1.0.0.7", "1.0.0.8")},
+			[]Range{r("1.0.0.0", "1.0.0.255")},
+		},
+		{
+			"ending at the last address",
+			[]Range{
+				r("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"),
+				r("ffff:ffff:ffff:ffff:ffff:ffff:ffff:fff0", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"),
+			},
+			[]Range{r("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")},
+		},
+	} {
+		if got := merge(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	for _, tt := range []struct {
+		ip, want string
+		ok       bool
+	}{
+		{"1.2.3.4", "1.2.3.5", true},
+		{"1.2.3.255", "1.2.4.0", true},
+		{"2001:db8::ffff", "2001:db8::1:0", true},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "::", false},
+	} {
+		var ip, want [16]byte
+		copy(ip[:], net.ParseIP(tt.ip).To16())
+		copy(want[:], net.ParseIP(tt.want).To16())
+		if ok := increment(&ip); ip != want || ok != tt.ok {
+			t.Errorf("%s: got %v %v, want %s %v", tt.ip, net.IP(ip[:]), ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	f := New()
+	var err error
+	f.ranges, _, err = Parse(strings.NewReader(blocklist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"1.2.3.0":        true,
+		"1.2.3.255":      true,
+		"1.2.4.0":        false,
+		"5.0.0.1":        false, // Allowed by its access level.
+		"10.20.30.40":    true,
+		"9.9.9.10":       false,
+		"2001:db8::1":    true,
+		"2001:db9::1":    false,
+		"::ffff:1.2.3.4": true,
+	} {
+		if got := f.Blocked(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: blocked %v, want %v", ip, got, want)
+		}
+	}
+
+	// Repeats of an address are counted once.
+	f.Blocked(net.ParseIP("1.2.3.0"))
+	if ranges, blocked := f.Stats(); ranges != 4 || blocked != 5 {
+		t.Errorf("stats %d ranges %d blocked, want 4 and 5", ranges, blocked)
+	}
+	// Remembering them is bounded.
+	for i := 0; i < 2*maxRecent; i++ {
+		f.Blocked(net.IPv4(10, 0, byte(i>>8), byte(i)))
+	}
+	if _, blocked := f.Stats(); blocked != 5+2*maxRecent || len(f.recent) > maxRecent {
+		t.Errorf("%d blocked, %d remembered", blocked, len(f.recent))
+	}
+	var nilFilter *Filter
+	if nilFilter.Blocked(net.ParseIP("1.2.3.4")) {
+		t.Error("nil filter blocked an address")
+	}
+}
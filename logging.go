@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	cli "github.com/0xNathanW/bittorrent-go/client"
+	"github.com/0xNathanW/bittorrent-go/config"
+	"github.com/0xNathanW/bittorrent-go/logging"
+)
+
+// Returns a logger writing to the log file, or stderr without the
+// dashboard. With the dashboard and no log file, logs go to
+// bittorrent-go/bittorrent-go.log in the user's cache directory,
+// as stderr would be drawn over.
+func newLogger(cfg *config.Config, dashboard bool) (*logging.Logger, func(), error) {
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+	path := cfg.LogFile
+	if path == "" && dashboard {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, nil, fmt.Errorf("no log file given: %w", err)
+		}
+		path = filepath.Join(dir, "bittorrent-go", "bittorrent-go.log")
+	}
+	if path == "" {
+		return logging.New(os.Stderr, level), func() {}, nil
+	}
+	f, err := logging.OpenFile(path, int64(cfg.LogMaxSize)<<20, cfg.LogBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+	return logging.New(f, level), func() { f.Close() }, nil
+}
+
+// Logs a torrent's events, calling completed once it is downloaded.
+// Peers, trackers and storage log for themselves.
+func logEvents(c *cli.Client, events <-chan cli.Event, l *logging.Logger, completed func()) {
+	var once sync.Once
+	for {
+		logUntilClosed(events, l, func() { once.Do(completed) })
+		// Cut off for falling behind, Completed may have been lost.
+		l.Warn("events dropped, too slow to log them")
+		events, _ = c.Subscribe()
+		if c.Stats().Complete {
+			once.Do(completed)
+		}
+	}
+}
+
+func logUntilClosed(events <-chan cli.Event, l *logging.Logger, completed func()) {
+	for e := range events {
+		switch e := e.(type) {
+		case cli.PeerAdded:
+			l.Debug("peer added", "peer", e.Peer.IP)
+		case cli.PeerRemoved:
+			l.Debug("peer removed", "peer", e.Peer.IP)
+		case cli.PieceDone:
+			if e.Index >= 0 {
+				l.Info("piece done", "index", e.Index, "done", e.Done, "total", e.Total)
+			}
+		case cli.BansChanged:
+			if len(e.Bans) > 0 {
+				l.Warn("peers banned", "count", len(e.Bans))
+			}
+		case cli.Completed:
+			if e.Err == nil { // Failures are logged by storage.
+				l.Info("complete")
+			}
+			completed()
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Package logging writes levelled, structured log records, one per line
+// as key=value pairs, eg.
+//
+//	time=2024-01-02T15:04:05.000Z level=WARN msg="piece failed" component=picker index=3
+//
+// Loggers carry attributes added with With, such as the component logging
+// and the info hash or peer address it concerns. A nil *Logger discards
+// everything, so packages log through theirs whether or not it is set.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a record.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return strings.ToUpper(levelNames[l])
+}
+
+// ParseLevel returns the level with the given name, in any case.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// Logger writes records at or above its level.
+type Logger struct {
+	out   *output
+	attrs []interface{} // Key value pairs added to every record.
+}
+
+// Shared by a logger and those derived from it.
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	buf   []byte
+}
+
+// New returns a logger writing records at or above level to w.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{w: w, level: level}}
+}
+
+// With returns a logger adding key value pairs to every record,
+// after those already added.
+func (l *Logger) With(args ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	attrs := make([]interface{}, 0, len(l.attrs)+len(args))
+	attrs = append(attrs, l.attrs...)
+	attrs = append(attrs, args...)
+	return &Logger{out: l.out, attrs: attrs}
+}
+
+// Component returns a logger for part of the program, eg. "tracker".
+func (l *Logger) Component(name string) *Logger {
+	return l.With("component", name)
+}
+
+// Enabled reports whether records at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.out.level
+}
+
+// Debug, Info, Warn and Error write a record with msg, followed by the
+// logger's attributes then args, alternating keys and values.
+func (l *Logger) Debug(msg string, args ...interface{}) { l.Log(Debug, msg, args...) }
+func (l *Logger) Info(msg string, args ...interface{})  { l.Log(Info, msg, args...) }
+func (l *Logger) Warn(msg string, args ...interface{})  { l.Log(Warn, msg, args...) }
+func (l *Logger) Error(msg string, args ...interface{}) { l.Log(Error, msg, args...) }
+
+// Log writes a record at level.
+func (l *Logger) Log(level Level, msg string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now()
+	o := l.out
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	b := o.buf[:0]
+	b = append(b, "time="...)
+	b = now.AppendFormat(b, "2006-01-02T15:04:05.000Z07:00")
+	b = append(b, " level="...)
+	b = append(b, level.String()...)
+	b = append(b, " msg="...)
+	b = appendValue(b, msg)
+	b = appendAttrs(b, l.attrs)
+	b = appendAttrs(b, args)
+	b = append(b, '\n')
+	o.w.Write(b) // Nowhere to report a failed write.
+	o.buf = b
+}
+
+// A key without a value is logged under !BADKEY, as slog does.
+func appendAttrs(b []byte, args []interface{}) []byte {
+	for i := 0; i < len(args); i += 2 {
+		key, value := fmt.Sprint(args[i]), interface{}(nil)
+		if i+1 < len(args) {
+			value = args[i+1]
+		} else {
+			key, value = "!BADKEY", args[i]
+		}
+		b = append(b, ' ')
+		b = append(b, key...)
+		b = append(b, '=')
+		b = appendValue(b, value)
+	}
+	return b
+}
+
+// Values are quoted if they would otherwise be ambiguous.
+func appendValue(b []byte, v interface{}) []byte {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	case time.Duration:
+		s = v.String()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if needsQuoting(s) {
+		return strconv.AppendQuote(b, s)
+	}
+	return append(b, s...)
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
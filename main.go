@@ -1,28 +1,120 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"os"
 	"path"
-	cli "github.com/0xNathanW/bittorrent-go/client"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
+// Exit codes.
+const (
+	exitOK         = 0
+	exitError      = 1 // The command failed.
+	exitUsage      = 2 // Bad command or flags.
+	exitIncomplete = 3 // verify found missing or corrupt pieces.
+	// Stopped by a signal, or the dashboard, before every torrent was
+	// downloaded, 128 plus the signal number as shells report it.
+	exitInterrupted = 128 + int(syscall.SIGINT)
+	exitTerminated  = 128 + int(syscall.SIGTERM)
+)
+
+const usage = `Usage: bittorrent-go <command> [flags] <args>
+
+Commands:
+  download  download torrents, seeding them until quit
+  seed      seed torrents already on disk
+  create    create a torrent file from a file or directory
+  info      show what a torrent file contains
+  verify    check the pieces of a torrent on disk
+  magnet    print a magnet link for a torrent file
+
+Run 'bittorrent-go <command> -h' for the command's flags.
+`
+
+// A subcommand, returning the exit code.
+type command func(args []string) int
+
+var commands = map[string]command{
+	"download": download,
+	"seed":     seed,
+	"create":   create,
+	"info":     info,
+	"verify":   verify,
+	"magnet":   magnet,
+}
+
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return exitOK
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+	return cmd(args[1:])
+}
 
-	// Torrent path is first arg.
-	torrentPath := os.Args[1]
-	if err := verifyPath(torrentPath); err != nil {
-		log.Fatal(err)
+// Parses a command's flags, ok is false if the command shouldn't run
+// and code is then the exit code.
+func parseFlags(fs *flag.FlagSet, args []string, minArgs int) (code int, ok bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
 	}
-	// Setup client ready for download.
-	// Any error before this stage means the process cant continue.
-	// So panic will be raised.
-	client, err := cli.NewClient(torrentPath)
-	if err != nil {
-		log.Fatal(err)
+	if fs.NArg() < minArgs {
+		fmt.Fprintf(fs.Output(), "%s: missing arguments\n", fs.Name())
+		fs.Usage()
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// Prints an error, returning the exit code for a failed command.
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "bittorrent-go: %v\n", err)
+	return exitError
+}
+
+// Parses a comma separated list of file indexes.
+func parseIndexes(list string) ([]int, error) {
+	var indexes []int
+	for _, s := range strings.Split(list, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid file index %q", s)
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+// Splits a comma separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			items = append(items, s)
+		}
 	}
-	client.Run()
+	return items
 }
 
 // Verifies torrent file exists.
@@ -0,0 +1,66 @@
+package p2p
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/0xNathanW/bittorrent-go/logging"
+)
+
+// ------------------------------ Activity ------------------------------//
+
+// ActivityKind classifies a peer's activity, eg. for colouring.
+type ActivityKind int
+
+const (
+	ActivitySent     ActivityKind = iota // A message was sent, Text names it.
+	ActivityReceived                     // A message was received, Text names it.
+	ActivityOK                           // Progress, eg. a completed handshake.
+	ActivityError                        // Failures and disconnects.
+	ActivityInfo                         // Anything else worth noting.
+)
+
+// Activity is something that happened on a peer's connection.
+type Activity struct {
+	Peer string // Address of the peer.
+	Kind ActivityKind
+	Text string
+	Time time.Time
+}
+
+// Levels activity is logged at, messages are only of interest when debugging.
+var activityLevels = map[ActivityKind]logging.Level{
+	ActivitySent:     logging.Debug,
+	ActivityReceived: logging.Debug,
+	ActivityOK:       logging.Info,
+	ActivityError:    logging.Warn,
+	ActivityInfo:     logging.Info,
+}
+
+// Log writes activity on the peer to its Logger and reports it
+// to OnActivity, if set.
+func (p *Peer) Log(kind ActivityKind, format string, args ...interface{}) {
+	level := activityLevels[kind]
+	if p.OnActivity == nil && !p.Logger.Enabled(level) {
+		return
+	}
+	text := fmt.Sprintf(format, args...)
+	switch kind {
+	case ActivitySent:
+		p.Logger.Log(level, "sent", "msg_type", text)
+	case ActivityReceived:
+		p.Logger.Log(level, "received", "msg_type", text)
+	default:
+		p.Logger.Log(level, strings.TrimSuffix(text, "."))
+	}
+	if p.OnActivity == nil {
+		return
+	}
+	p.OnActivity(Activity{
+		Peer: p.IP.String(),
+		Kind: kind,
+		Text: text,
+		Time: time.Now(),
+	})
+}
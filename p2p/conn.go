@@ -0,0 +1,183 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	msg "github.com/0xNathanW/bittorrent-go/p2p/message"
+	"github.com/0xNathanW/bittorrent-go/ratelimit"
+)
+
+const (
+	outQueueSize = 256 // Messages queued for the writer.
+	// Outbound silence before a keep-alive is sent.
+	keepAliveInterval = 2 * time.Minute
+)
+
+var (
+	errClosed   = errors.New("connection closed")
+	errFiltered = errors.New("address blocked by ip filter")
+)
+
+// Starts the reader and writer goroutines for the connection,
+// messages are then sent through the writer's queue.
+func (p *Peer) startIO() {
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.stopLoops = cancel
+	p.readQ = make(chan msg.Msg)
+	p.readErr = make(chan error, 1)
+	p.outQ = make(chan msg.Msg, outQueueSize)
+	p.writerDone = make(chan struct{})
+	p.writeErr = nil
+
+	go p.readLoop(ctx, p.readQ, p.readErr)
+	go p.writeLoop(ctx, p.outQ, p.writerDone)
+}
+
+// Stops the reader and writer, closing the connection.
+func (p *Peer) stopIO() {
+	if p.stopLoops != nil {
+		p.stopLoops()
+		p.stopLoops = nil
+	}
+	if p.Conn != nil {
+		p.Conn.Close()
+	}
+}
+
+// Closes conn if ctx is cancelled before stop is called,
+// so a handshake in progress gives up.
+func closeOnCancel(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Decodes messages from the connection until it fails or the peer stops.
+func (p *Peer) readLoop(ctx context.Context, readQ chan<- msg.Msg, readErr chan<- error) {
+	for {
+		m, err := p.read()
+		if err != nil {
+			readErr <- err
+			return
+		}
+		if m == nil { // Keep-alive.
+			continue
+		}
+		if p.limit(ctx, p.DownLimit, p.DownLimits, m) != nil {
+			return
+		}
+		select {
+		// The reader's buffer is reused, so the message is copied.
+		case readQ <- msg.Copy(m):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Writes queued messages to the connection, closing writerDone on failure.
+// A keep-alive is written whenever nothing else has been for a while.
+func (p *Peer) writeLoop(ctx context.Context, outQ <-chan msg.Msg, writerDone chan<- struct{}) {
+	defer close(writerDone)
+	keepAlive := time.NewTimer(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case m := <-outQ:
+			if err := p.limit(ctx, p.UpLimit, p.UpLimits, m); err != nil {
+				p.writeErr = err
+				return
+			}
+			p.Conn.SetWriteDeadline(time.Now().Add(p.Timeouts.Write))
+			if err := p.writer.WriteMsg(m); err != nil {
+				p.writeErr = err
+				return
+			}
+			// Update activity, requests and blocks will clog feed.
+			if m.ID() != 6 && m.ID() != 7 {
+				p.Log(ActivitySent, "%s", msg.MsgIDmap[m.ID()])
+			}
+		case <-keepAlive.C:
+			p.Conn.SetWriteDeadline(time.Now().Add(p.Timeouts.Write))
+			if err := p.writer.WriteKeepAlive(); err != nil {
+				p.writeErr = err
+				return
+			}
+			p.Log(ActivitySent, "keep-Alive")
+		case <-ctx.Done():
+			return
+		}
+		// Silence is measured from the last write.
+		if !keepAlive.Stop() {
+			select {
+			case <-keepAlive.C:
+			default:
+			}
+		}
+		keepAlive.Reset(keepAliveInterval)
+	}
+}
+
+// Waits until the bandwidth limits allow m to be transferred, or the
+// connection stops. Only block data counts, unless protocol overhead
+// is counted too.
+func (p *Peer) limit(ctx context.Context, own *ratelimit.Limiter, shared ratelimit.Group, m msg.Msg) error {
+	var n int
+	switch {
+	case p.CountOverhead:
+		n = msg.Size(m)
+	case m.ID() == 7:
+		n = len(m.(msg.Piece).Block)
+	default:
+		return nil
+	}
+	return append(ratelimit.Group{own}, shared...).Wait(ctx, n)
+}
+
+// Queues a message for the writer.
+func (p *Peer) send(m msg.Msg) error {
+	select {
+	case p.outQ <- m:
+		return nil
+	case <-p.writerDone:
+		return fmt.Errorf("failed to send msg: %w", errClosed)
+	}
+}
+
+// Reads single message from peer connection, nil for a keep-alive.
+// Payloads are only valid until the next read.
+func (p *Peer) read() (msg.Msg, error) {
+	p.Conn.SetReadDeadline(time.Now().Add(p.Timeouts.Read))
+
+	m, err := p.reader.ReadMsg()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+	if m == nil { // Keep-alive message.
+		p.Log(ActivityReceived, "keep-Alive")
+		return nil, nil
+	}
+	if u, ok := m.(msg.Unknown); ok {
+		p.Log(ActivityReceived, "unknown message %d", u.MsgID)
+		return m, nil
+	}
+	// Fast Extension messages may only be sent if both sides support it.
+	if m.ID() >= 0x0D && m.ID() <= 0x11 && !p.fast {
+		return nil, fmt.Errorf("unexpected fast extension message: %v", m.ID())
+	}
+	if m.ID() != 7 { // Update activity, as long as not block, as they will clog feed.
+		p.Log(ActivityReceived, "%s", msg.MsgIDmap[m.ID()])
+	}
+
+	return m, nil
+}
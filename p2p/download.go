@@ -1,178 +1,436 @@
 package p2p
 
 import (
-	"crypto/sha1"
-	"encoding/binary"
-	"errors"
+	"context"
 	"fmt"
 	"time"
 
 	msg "github.com/0xNathanW/bittorrent-go/p2p/message"
+	"github.com/0xNathanW/bittorrent-go/picker"
 	"github.com/0xNathanW/bittorrent-go/torrent"
 )
 
+const (
+	// Default amount of time worth of data to keep requested from a peer,
+	// the queue length is derived from this and the peer's download rate.
+	DefaultQueueTime = 3 * time.Second
+	// Bounds on the number of outstanding block requests per peer.
+	MinQueueLength     = 2
+	DefaultMaxRequests = 250
+	// Failed requests and bad messages before the peer is disconnected.
+	DefaultMaxStrikes = 5
+	// Largest block the peer may request from us.
+	maxRequestLength = 1 << 17
+)
+
+// Timeouts bound how long a peer may take, see DefaultTimeouts.
+type Timeouts struct {
+	Dial       time.Duration // Connecting over TCP.
+	Handshake  time.Duration // Encryption and the handshake.
+	Request    time.Duration // Without a requested block before the requests are given up on.
+	Write      time.Duration // Writing a message.
+	Read       time.Duration // Without any message before the connection is dead.
+	Snub       time.Duration // Unchoked without a block before the peer is snubbed.
+	Idle       time.Duration // Neither side interested before the connection is dropped.
+	UploadOnly time.Duration // As above, when the peer is a seed or partial seed.
+}
+
+var DefaultTimeouts = Timeouts{
+	Dial:       10 * time.Second,
+	Handshake:  20 * time.Second,
+	Request:    20 * time.Second,
+	Write:      30 * time.Second,
+	Read:       3 * time.Minute, // Peers send keep-alives every two minutes.
+	Snub:       time.Minute,
+	Idle:       10 * time.Minute,
+	UploadOnly: 10 * time.Second,
+}
+
+// Run connects to the peer and exchanges messages until it disconnects
+// or ctx is cancelled.
 func (p *Peer) Run(
+	ctx context.Context,
 	ID [20]byte,
 	t *torrent.Torrent,
-	workQ chan torrent.Piece,
-	dataQ chan<- *torrent.PieceData,
+	pk *picker.Picker,
+	dataQ chan<- *torrent.BlockData,
 	requestQ chan<- Request,
 ) {
 
+	p.picker = pk
+	p.numPieces = len(t.Pieces)
+	// Drop a disconnect meant for a previous connection.
+	select {
+	case <-p.quit:
+	default:
+	}
+	p.ctx = ctx
+	p.dataQ = dataQ
+	p.requestQ = requestQ
+	p.revealed = make(map[int]bool)
+	// Pieces had before connecting are in the bitfield we send.
+	p.haveMu.Lock()
+	p.haves = nil
+	p.haveMu.Unlock()
+	// Answers for an earlier connection go to its own channel.
+	p.blockOut = make(chan Reply, p.MaxRequests)
+	p.serving = 0
+	// Limits from an earlier connection's reqq don't carry over.
+	p.Reqq = 0
+	p.maxRequests = p.MaxRequests
 	if err := p.establishPeer(ID, t.InfoHash); err != nil {
-		p.Activity.Write([]byte(fmt.Sprintf("[red]%v[-]\n\n", err)))
+		p.Log(ActivityError, "%v", err)
+		p.stopIO()
 		return
 	}
 	p.Active = true
 	p.Start = time.Now()
+	p.lastPiece = time.Now()
+	p.lastBlock = time.Now()
+	p.lastInterest = time.Now()
+	p.Snubbed = false
+	p.publish()
+	if p.OnConnect != nil {
+		p.OnConnect()
+	}
 
 	defer p.disconnect()
 
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
 	for {
 		select {
+		case m := <-p.readQ:
+			p.handle(m)
 
-		case block := <-p.BlockOut:
-			if err := p.send(block); err != nil {
-				p.Activity.Write([]byte(fmt.Sprintf("[red]failed to send block: %v.[-]\n\n", err)))
-				continue
-			}
-			p.Rates.Uploaded += (len(block) - 8) // -8 for header info.
+		case err := <-p.readErr:
+			p.Log(ActivityError, "%v", err)
+			return
 
-		case piece, ok := <-workQ:
+		case <-p.writerDone:
+			p.Log(ActivityError, "failed to write to connection: %v", p.writeErr)
+			return
 
-			if !ok { // All pieces downloaded, move to seed.
-				break
+		case <-p.quit:
+			return
+
+		case <-ctx.Done():
+			return
+
+		case r := <-p.blockOut:
+			p.upload(r)
+
+		case b := <-p.cancelQ:
+			p.cancel(b)
+
+		case choked := <-p.chokeQ:
+			p.Downloading = !choked
+			p.updateChoke()
+
+		case <-p.haveQ:
+			p.haveMu.Lock()
+			haves := p.haves
+			p.haves = nil
+			p.haveMu.Unlock()
+			for _, idx := range haves {
+				p.announce(idx)
 			}
 
-			// If peer doesnt have piece, put it back in the queue.
-			if !p.BitField.HasPiece(piece.Index) {
-				workQ <- piece
-				continue
+		case <-p.uploadOnlyQ:
+			if !p.UploadOnly {
+				p.UploadOnly = true
+				if p.Reserved.Has(msg.Extension) {
+					p.sendExtendedHandshake()
+				}
 			}
 
-			if err := p.downloadPiece(piece, dataQ, requestQ); err != nil {
-				workQ <- piece
-				p.Activity.Write([]byte("[red]" + err.Error() + "[-]\n\n"))
+		case <-p.offerQ:
+			p.offer()
 
-				p.strikes++        // Add a strike if download fails.
-				if p.strikes > 5 { // 5 strikes and peer gets disconnected.
-					p.Activity.Write([]byte("[red]too many strikes, disconnecting...[-]\n\n"))
-					return
-				}
+		case s := <-p.superSeedQ:
+			p.setSuperSeeder(s)
 
-				continue
+		case <-tick.C:
+			p.Rates.sample()
+			if p.checkSnub() {
+				p.returnRequests()
+			}
+			// Requested blocks have stopped arriving. A peer unchoking us
+			// has until the snub timeout, then is snubbed before it is struck.
+			if len(p.requests) > 0 && time.Since(p.lastPiece) > p.Timeouts.Request {
+				p.lastPiece = time.Now()
+				if p.IsChoking || time.Since(p.lastBlock) > p.Timeouts.Snub {
+					if p.strike(fmt.Errorf("requests timed out")) {
+						return
+					}
+				}
+				p.returnRequests()
+			}
+			if p.Interested || p.IsInterested {
+				p.lastInterest = time.Now()
+			} else if time.Since(p.lastInterest) > p.Timeouts.Idle {
+				p.Log(ActivityError, "idle, disconnecting...")
+				return
+			} else if p.IsUploadOnly && time.Since(p.lastInterest) > p.Timeouts.UploadOnly {
+				// Partial seeds won't download from us, so the connection
+				// is wasted once they have nothing we want.
+				p.Log(ActivityError, "upload only with nothing we want, disconnecting...")
+				return
 			}
 		}
-	}
 
-	// SEED LOGIC
+		// Keep the request queue topped up while we are allowed to download.
+		if err := p.fillQueue(); err != nil {
+			p.Log(ActivityError, "%v", err)
+			return
+		}
+		p.publish()
+	}
 }
 
-func (p *Peer) downloadPiece(piece torrent.Piece, dataQ chan<- *torrent.PieceData, requestQ chan<- Request) error {
-
-	p.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+// Adds a strike to the peer, reporting whether it should be disconnected.
+func (p *Peer) strike(err error) bool {
+	p.Log(ActivityError, "%v", err)
+	p.strikes++ // Add a strike if download fails.
+	if p.strikes > p.MaxStrikes {
+		p.Log(ActivityError, "too many strikes, disconnecting...")
+		return true
+	}
+	return false
+}
 
-	/* Pieces are too long to request in one go.
-	 * We will request a piece in chunks of 16384 bytes (16Kb) called blocks.
-	 * The last block will likely be smaller.
-	 */
+// Snubs the peer if it has sent no blocks for the snub timeout while
+// unchoking us, reporting whether it was just snubbed.
+func (p *Peer) checkSnub() bool {
+	if p.Snubbed || p.IsChoking || !p.Interested {
+		return false
+	}
+	// Nothing was expected without outstanding requests.
+	if len(p.requests) == 0 {
+		p.lastBlock = time.Now()
+		return false
+	}
+	if time.Since(p.lastBlock) <= p.Timeouts.Snub {
+		return false
+	}
+	p.Snubbed = true
+	p.Log(ActivityError, fmt.Sprintf("no blocks for %v, snubbed.", p.Timeouts.Snub))
+	return true
+}
 
-	p.Activity.Write([]byte(fmt.Sprintf("downloading piece %d.\n\n", piece.Index)))
+// queueLength returns the number of block requests to keep outstanding,
+// enough to cover QueueTime at the peer's measured download rate.
+// Snubbed peers are only trusted with one request at a time.
+func (p *Peer) queueLength() int {
+	if p.Snubbed {
+		return 1
+	}
+	n := int(p.Rates.DownRate*p.QueueTime.Seconds()) / p.picker.BlockSize()
+	if n < MinQueueLength {
+		n = MinQueueLength
+	}
+	if n > p.maxRequests {
+		n = p.maxRequests
+	}
+	return n
+}
 
-	requested, downloaded := 0, 0
-	data := make([]byte, piece.Length)
+// Sends block requests picked for this peer until its queue is full.
+// While choked, only allowed fast pieces are requested.
+func (p *Peer) fillQueue() error {
 
-	// Request all blocks in piece.
-	for requested < piece.Length {
+	n := p.queueLength() - len(p.requests)
+	if n <= 0 {
+		return nil
+	}
 
-		var blockSize int = 16384 // 16Kb
-		// If last block is smaller, set block size to remaining bytes.
-		if requested+blockSize > piece.Length {
-			blockSize = piece.Length - requested
+	var blocks []picker.Block
+	if p.IsChoking {
+		if len(p.allowedFast) == 0 {
+			return nil
+		}
+		blocks = p.picker.Pick(p.IP.String(), p.restrict(p.allowedFast), n)
+	} else {
+		// Suggested pieces are tried first.
+		for idx := range p.suggested {
+			if p.picker.HasPiece(idx) {
+				delete(p.suggested, idx)
+			}
+		}
+		if len(p.suggested) > 0 {
+			blocks = p.picker.Pick(p.IP.String(), p.restrict(p.suggested), n)
 		}
+		blocks = append(blocks, p.picker.Pick(p.IP.String(), p.BitField, n-len(blocks))...)
+	}
 
-		// Request block.
-		if err := p.send(msg.Request(piece.Index, requested, blockSize)); err != nil {
+	if len(p.requests) == 0 {
+		p.lastPiece = time.Now()
+	}
+	for _, b := range blocks {
+		if err := p.send(msg.Request(b)); err != nil {
+			p.picker.Return(p.IP.String(), b)
 			return fmt.Errorf("failed to send request: %v", err)
 		}
-		requested += blockSize
+		p.requests[b] = time.Now()
 	}
+	return nil
+}
 
-	// read responses.
-	for downloaded < piece.Length {
+// Passes a received block on to dataQ, where it is placed
+// into its piece by offset.
+func (p *Peer) handlePiece(m msg.Piece) {
 
-		// Read next message.
-		m, err := p.read()
-		if err != nil {
-			return fmt.Errorf("failed to read from connection: %v", err)
-		}
+	b := picker.Block{
+		Index:  m.Index,
+		Begin:  m.Begin,
+		Length: len(m.Block),
+	}
 
-		if m.ID == 6 {
-			// If the peer is allowed, add to the request queue.
-			if p.Downloading {
-				idx := int(binary.BigEndian.Uint32(m.Payload[0:4]))
-				off := int(binary.BigEndian.Uint32(m.Payload[4:8]))
-				length := int(binary.BigEndian.Uint32(m.Payload[8:12]))
-				requestQ <- Request{p, idx, off, length}
-				continue
-			} else { // If not allowed, choke.
-				p.send(msg.Choke())
-				continue
-			}
+	if _, ok := p.requests[b]; !ok {
+		// Cancelled blocks may still arrive, pass them on so they
+		// are counted as duplicates.
+		if !p.cancelled[b] {
+			return // Requests may have been returned after a choke.
 		}
+		delete(p.cancelled, b)
+	}
+	delete(p.requests, b)
+	p.Rates.Downloaded += b.Length
+	p.lastPiece = time.Now()
+	p.lastBlock = time.Now()
+	if p.Snubbed {
+		p.Snubbed = false
+		p.Log(ActivityOK, "block received, no longer snubbed.")
+	}
 
-		if m.ID == 7 && m.Payload != nil {
+	// Nothing collects blocks once the torrent stops.
+	select {
+	case p.dataQ <- &torrent.BlockData{
+		Index: b.Index,
+		Begin: b.Begin,
+		Data:  m.Block,
+		Peer:  p.IP.String(),
+	}:
+	case <-p.ctx.Done():
+	}
+}
 
-			msgIdx := int(binary.BigEndian.Uint32(m.Payload[0:4]))
-			msgBegin := int(binary.BigEndian.Uint32(m.Payload[4:8]))
-			msgData := m.Payload[8:]
+// Puts all outstanding requests back up for picking.
+func (p *Peer) returnRequests() {
+	if p.picker != nil {
+		p.picker.ReturnAll(p.IP.String())
+	}
+	p.requests = make(map[picker.Block]time.Time)
+	p.cancelled = make(map[picker.Block]bool)
+}
 
-			// Check piece is the correct index.
-			if msgIdx != piece.Index {
-				return fmt.Errorf(
-					"piece index mismatch, expected: %d, got: %d",
-					piece.Index, msgIdx,
-				)
-			}
-			// Check begin is less than length of data.
-			if msgBegin >= piece.Length {
-				return fmt.Errorf(
-					"piece begin index too large, expected: %d, got: %d",
-					piece.Length, msgBegin,
-				)
-			}
-			// Check if begin plus length is greater than length of data.
-			if msgBegin+len(msgData) > piece.Length {
-				return fmt.Errorf(
-					"piece length too large, expected: %d, got: %d",
-					piece.Length, msgBegin+len(msgData),
-				)
-			}
+// Cancel asks the peer to drop an outstanding request,
+// used in endgame once another peer has delivered the block.
+func (p *Peer) Cancel(b picker.Block) {
+	select {
+	case p.cancelQ <- b:
+	default: // Queue full, the block will arrive as a duplicate.
+	}
+}
 
-			// Copy data to data buffer.
-			n := copy(data[downloaded:], msgData)
-			downloaded += n
+// Sends a cancel for a request queued by Cancel.
+func (p *Peer) cancel(b picker.Block) {
+	if _, ok := p.requests[b]; !ok {
+		return
+	}
+	delete(p.requests, b)
+	p.cancelled[b] = true
+	if err := p.send(msg.Cancel(b)); err != nil {
+		p.Log(ActivityError, "failed to send cancel: %v.", err)
+	}
+}
 
-		} else {
-			p.handle(m)
+// Handles a block request from the peer.
+func (p *Peer) handleRequest(m msg.Request) {
+	b := picker.Block(m)
+	if b.Length <= 0 || b.Length > maxRequestLength {
+		return
+	}
+	// Pieces still hidden by super-seeding can't be requested.
+	hidden := p.SuperSeeder != nil && !p.revealed[b.Index]
+	// If the peer is allowed, add to the request queue.
+	// More requests than the reqq we sent are refused.
+	if (!p.Choked || p.allowedOut[b.Index]) && !hidden && p.serving < cap(p.blockOut) {
+		p.pendingUp[b] = true
+		p.serving++
+		select {
+		case p.requestQ <- Request{p, b.Index, b.Begin, b.Length, p.blockOut}:
+		case <-p.ctx.Done():
 		}
+	} else if p.fast { // Fast peers are told explicitly.
+		p.send(msg.RejectRequest(m))
 	}
+}
 
-	// verify piece hash.
-	h := sha1.New()
-	h.Write(data)
-	hash := h.Sum(nil)
+// Sends a block read for the peer, unless the request was cancelled.
+func (p *Peer) upload(r Reply) {
+	p.serving--
+	if !p.pendingUp[r.Block] {
+		return
+	}
+	delete(p.pendingUp, r.Block)
+	if r.Data == nil {
+		if p.fast {
+			p.send(msg.RejectRequest(r.Block))
+		}
+		return
+	}
+	block := msg.Piece{Index: r.Block.Index, Begin: r.Block.Begin, Block: r.Data}
+	if err := p.send(block); err != nil {
+		p.Log(ActivityError, "failed to send block: %v.", err)
+		return
+	}
+	p.Rates.Uploaded += len(r.Data)
+}
 
-	var pieceHash [20]byte
-	copy(pieceHash[:], hash)
-	if pieceHash != piece.Hash {
-		return errors.New("piece hash mismatch")
+// SetChoked chokes or unchokes the peer, as decided by the choker.
+func (p *Peer) SetChoked(choked bool) {
+	// Only the latest decision matters.
+	select {
+	case <-p.chokeQ:
+	default:
 	}
+	select {
+	case p.chokeQ <- choked:
+	default:
+	}
+}
 
-	// send piece to dataQ.
-	dataQ <- &torrent.PieceData{Index: piece.Index, Data: data}
-	p.Activity.Write([]byte(fmt.Sprintf("[blue]downloaded piece %d.[-]\n\n", piece.Index)))
-	p.Rates.Downloaded += piece.Length
+// Disconnect asks the peer to close its connection.
+func (p *Peer) Disconnect() {
+	select {
+	case p.quit <- struct{}{}:
+	default:
+	}
+}
 
-	return nil
+// Have queues an announcement that we now have a piece.
+func (p *Peer) Have(idx int) {
+	p.haveMu.Lock()
+	p.haves = append(p.haves, idx)
+	p.haveMu.Unlock()
+	select {
+	case p.haveQ <- struct{}{}:
+	default: // Already signalled.
+	}
+}
+
+// Tells the peer we have a piece.
+func (p *Peer) announce(idx int) {
+	// Sent even if the peer has the piece, super-seeders rely
+	// on it. Hidden while we are super-seeding.
+	if p.SuperSeeder == nil {
+		p.revealed[idx] = true
+		p.send(msg.Have{Index: idx})
+	}
+	// The peer may have had nothing else we want.
+	if p.Interested && p.BitField.HasPiece(idx) {
+		p.updateInterest()
+	}
 }
@@ -0,0 +1,109 @@
+package p2p
+
+import (
+	"fmt"
+
+	msg "github.com/0xNathanW/bittorrent-go/p2p/message"
+	"github.com/0xNathanW/bittorrent-go/p2p/peerid"
+)
+
+// Client name and version sent in the extended handshake.
+const Version = "BitTorrent-Go 0.1"
+
+// Returns the peer's address, implements msg.ExtensionPeer.
+func (p *Peer) Addr() string {
+	return p.IP.String()
+}
+
+// Sends an extension message under the peer's negotiated ID for the extension.
+func (p *Peer) SendExtended(name string, payload []byte) error {
+	id, ok := p.extIDs.ID(name)
+	if !ok {
+		return fmt.Errorf("peer does not support extension %s", name)
+	}
+	return p.send(msg.Extended{ExtID: id, Payload: payload})
+}
+
+// SetUploadOnly tells the peer we want nothing more from it, by sending
+// the extended handshake again with upload_only set.
+func (p *Peer) SetUploadOnly() {
+	select {
+	case p.uploadOnlyQ <- struct{}{}:
+	default: // Already pending.
+	}
+}
+
+// Reports whether the peer negotiated support for an extension.
+func (p *Peer) SupportsExtension(name string) bool {
+	_, ok := p.extIDs.ID(name)
+	return ok
+}
+
+func (p *Peer) sendExtendedHandshake() error {
+	h := msg.ExtendedHandshake{
+		M:    map[string]int{},
+		V:    Version,
+		Reqq: p.MaxRequests,
+		P:    p.Port, // Lets the peer connect back to us.
+	}
+	if p.UploadOnly {
+		h.UploadOnly = 1
+	}
+	if p.Extensions != nil {
+		h.M = p.Extensions.M()
+	}
+	// Compact form, 4 bytes for IPv4 and 16 for IPv6.
+	if ip := p.IP.IP.To4(); ip != nil {
+		h.YourIP = string(ip)
+	} else if ip := p.IP.IP.To16(); ip != nil {
+		h.YourIP = string(ip)
+	}
+	m, err := h.Message()
+	if err != nil {
+		return err
+	}
+	return p.send(m)
+}
+
+// Handles an extended message, either the peer's extended handshake
+// or a message for one of our registered extensions.
+func (p *Peer) handleExtended(m msg.Extended) error {
+	id, payload := m.ExtID, m.Payload
+
+	if id == msg.ExtendedHandshakeID {
+		h, err := msg.ParseExtendedHandshake(payload)
+		if err != nil {
+			return err
+		}
+		p.extIDs = msg.NewExtensionIDs(h)
+		if h.V != "" {
+			p.ClientVersion = h.V
+			p.Client = peerid.Identify(p.PeerID, h.V)
+		}
+		if h.Reqq > 0 {
+			p.Reqq = h.Reqq
+			// Don't queue more requests than the peer will hold.
+			if p.Reqq < p.maxRequests {
+				p.maxRequests = p.Reqq
+			}
+		}
+		if h.P > 0 {
+			p.ListenPort = h.P
+		}
+		// The handshake may be sent again to update this.
+		p.IsUploadOnly = h.UploadOnly != 0
+		return nil
+	}
+
+	if p.Extensions == nil {
+		return fmt.Errorf("unknown extended message ID: %d", id)
+	}
+	name, handler, ok := p.Extensions.Handler(id)
+	if !ok {
+		return fmt.Errorf("unknown extended message ID: %d", id)
+	}
+	if err := handler(p, payload); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package p2p
+
+import (
+	"fmt"
+
+	msg "github.com/0xNathanW/bittorrent-go/p2p/message"
+	"github.com/0xNathanW/bittorrent-go/picker"
+)
+
+// Number of pieces a choked peer is allowed to request from us.
+const allowedFastCount = 10
+
+// Suggested and allowed fast pieces kept from a peer, more are ignored.
+const maxFastPieces = 64
+
+// Tells the peer which pieces we have, using Have All or Have None in
+// place of the bitfield where the peer supports the Fast Extension.
+func (p *Peer) sendPieces(infoHash [20]byte) error {
+
+	// Super-seeding peers start with nothing and are offered pieces.
+	if p.SuperSeeder != nil {
+		if p.fast {
+			if err := p.send(msg.HaveNone{}); err != nil {
+				return err
+			}
+		}
+		p.offer()
+		return nil
+	}
+
+	have := p.picker.Bitfield()
+	numHave := p.picker.NumDone()
+	// Still served should super-seeding be turned on later.
+	for idx := 0; idx < p.numPieces; idx++ {
+		if have.HasPiece(idx) {
+			p.revealed[idx] = true
+		}
+	}
+
+	switch {
+	case p.fast && numHave == p.numPieces:
+		return p.send(msg.HaveAll{})
+	case p.fast && numHave == 0:
+		if err := p.send(msg.HaveNone{}); err != nil {
+			return err
+		}
+	case numHave > 0:
+		if err := p.send(have); err != nil {
+			return err
+		}
+	}
+
+	if !p.fast || numHave == 0 {
+		return nil
+	}
+	// Let the peer get started on a few pieces while we choke them.
+	for _, idx := range msg.AllowedFastSet(allowedFastCount, p.numPieces, infoHash, p.IP.IP) {
+		p.allowedOut[idx] = true
+		if err := p.send(msg.AllowedFast{Index: idx}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handles messages from the Fast Extension.
+func (p *Peer) handleFast(m msg.Msg) {
+	switch m := m.(type) {
+	case msg.SuggestPiece:
+		if p.validFastIndex(m.Index) && len(p.suggested) < maxFastPieces {
+			p.suggested[m.Index] = true
+		}
+
+	case msg.HaveAll:
+		bf := make(msg.Bitfield, len(p.BitField))
+		for i := 0; i < p.numPieces; i++ {
+			bf.SetPiece(i)
+		}
+		p.setBitfield(bf)
+		p.updateInterest()
+
+	case msg.HaveNone:
+		p.setBitfield(make(msg.Bitfield, len(p.BitField)))
+		p.updateInterest()
+
+	case msg.RejectRequest:
+		b := picker.Block{Index: m.Index, Begin: m.Begin, Length: m.Length}
+		if _, ok := p.requests[b]; ok {
+			delete(p.requests, b)
+			p.picker.Return(p.IP.String(), b)
+		}
+
+	case msg.AllowedFast:
+		if p.validFastIndex(m.Index) && len(p.allowedFast) < maxFastPieces {
+			p.allowedFast[m.Index] = true
+		}
+	}
+}
+
+// Reports whether a suggested or allowed fast piece exists, striking
+// the peer if not.
+func (p *Peer) validFastIndex(idx int) bool {
+	if idx >= 0 && idx < p.numPieces {
+		return true
+	}
+	if p.strike(fmt.Errorf("invalid piece index %d", idx)) {
+		p.Disconnect()
+	}
+	return false
+}
+
+// Returns the pieces of the peer's bitfield that are in the set.
+func (p *Peer) restrict(set map[int]bool) msg.Bitfield {
+	bf := make(msg.Bitfield, len(p.BitField))
+	for idx := range set {
+		if p.BitField.HasPiece(idx) {
+			bf.SetPiece(idx)
+		}
+	}
+	return bf
+}
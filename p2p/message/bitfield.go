@@ -23,3 +23,18 @@ func (b Bitfield) SetPiece(idx int) {
 	}
 	b[idx/8] |= 1 << uint(7-idx%8)
 }
+
+// The bitfield is itself the bitfield message.
+func (Bitfield) ID() byte                             { return 5 }
+func (b Bitfield) MarshalBinary() ([]byte, error)     { return marshal(b) }
+func (b *Bitfield) UnmarshalBinary(data []byte) error { return unmarshal(data, b) }
+func (b *Bitfield) msg() Msg                          { return *b }
+
+func (b Bitfield) appendPayload(buf []byte) []byte {
+	return append(buf, b...)
+}
+
+func (b *Bitfield) parsePayload(p []byte) error {
+	*b = p
+	return nil
+}
@@ -0,0 +1,169 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jackpal/bencode-go"
+)
+
+/* The extension protocol (BEP 10) multiplexes extensions over message ID 20.
+ * The first byte of the payload is the extended message ID, 0 is the
+ * extended handshake, other IDs are negotiated per peer in the handshake's
+ * "m" dictionary.
+ * extended: <len=0002+X><id=20><extended id><payload>
+ */
+
+// Extended message ID of the extended handshake.
+const ExtendedHandshakeID = 0
+
+// Sent by both sides after the handshake when both support the extension protocol.
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`                       // Extension name to extended message ID.
+	V            string         `bencode:"v,omitempty"`             // Client name and version.
+	P            int            `bencode:"p,omitempty"`             // Local TCP listen port.
+	YourIP       string         `bencode:"yourip,omitempty"`        // Compact IP the peer sees us as.
+	Reqq         int            `bencode:"reqq,omitempty"`          // Number of outstanding requests supported.
+	MetadataSize int            `bencode:"metadata_size,omitempty"` // Size of the info dictionary.
+	UploadOnly   int            `bencode:"upload_only,omitempty"`   // 1 for seeds and partial seeds (BEP 21).
+}
+
+// Extended is a message of the extension protocol.
+type Extended struct {
+	ExtID   byte // Extended message ID.
+	Payload []byte
+}
+
+func (Extended) ID() byte                             { return 20 }
+func (m Extended) MarshalBinary() ([]byte, error)     { return marshal(m) }
+func (m *Extended) UnmarshalBinary(data []byte) error { return unmarshal(data, m) }
+func (m *Extended) msg() Msg                          { return *m }
+
+func (m Extended) appendPayload(buf []byte) []byte {
+	buf = append(buf, m.ExtID)
+	return append(buf, m.Payload...)
+}
+
+func (m *Extended) parsePayload(p []byte) error {
+	if len(p) < 1 {
+		return fmt.Errorf("payload length 0, expected at least 1")
+	}
+	m.ExtID, m.Payload = p[0], p[1:]
+	return nil
+}
+
+// Encodes the extended handshake as an extended message.
+func (h ExtendedHandshake) Message() (Extended, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, h); err != nil {
+		return Extended{}, err
+	}
+	return Extended{ExtID: ExtendedHandshakeID, Payload: buf.Bytes()}, nil
+}
+
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	h := new(ExtendedHandshake)
+	if err := bencode.Unmarshal(bytes.NewReader(payload), h); err != nil {
+		return nil, fmt.Errorf("invalid extended handshake: %w", err)
+	}
+	return h, nil
+}
+
+// ----------------------------- Registry -----------------------------//
+
+// ExtensionPeer is the peer an extension message came from.
+type ExtensionPeer interface {
+	Addr() string
+	// Sends payload to the peer under the extension's negotiated ID.
+	SendExtended(name string, payload []byte) error
+}
+
+// ExtensionHandler handles the payload of an extension message.
+type ExtensionHandler func(peer ExtensionPeer, payload []byte) error
+
+// Registry holds the extensions we support, each is given
+// the local extended message ID that peers use to reach it.
+type Registry struct {
+	mu       sync.RWMutex
+	ids      map[string]byte
+	handlers map[byte]ExtensionHandler
+	names    map[byte]string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		ids:      make(map[string]byte),
+		handlers: make(map[byte]ExtensionHandler),
+		names:    make(map[byte]string),
+	}
+}
+
+// Register adds an extension, eg. "ut_pex", returning its local ID.
+func (r *Registry) Register(name string, h ExtensionHandler) byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id, ok := r.ids[name]; ok {
+		r.handlers[id] = h
+		return id
+	}
+	id := byte(len(r.ids) + 1)
+	r.ids[name] = id
+	r.handlers[id] = h
+	r.names[id] = name
+	return id
+}
+
+// Returns the handler and name of the extension with local ID id.
+func (r *Registry) Handler(id byte) (string, ExtensionHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.handlers[id]
+	return r.names[id], h, ok
+}
+
+// Returns the registered extension names, sorted.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.ids))
+	for name := range r.ids {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the "m" dictionary advertising our extensions.
+func (r *Registry) M() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m := make(map[string]int, len(r.ids))
+	for name, id := range r.ids {
+		m[name] = int(id)
+	}
+	return m
+}
+
+// ExtensionIDs are the extended message IDs a peer negotiated,
+// messages for an extension are sent to the peer under its ID.
+type ExtensionIDs map[string]byte
+
+// Builds the peer's IDs from its extended handshake,
+// an ID of 0 means the extension is disabled.
+func NewExtensionIDs(h *ExtendedHandshake) ExtensionIDs {
+	ids := make(ExtensionIDs, len(h.M))
+	for name, id := range h.M {
+		if id > 0 && id < 256 {
+			ids[name] = byte(id)
+		}
+	}
+	return ids
+}
+
+// Returns the peer's ID for an extension, false if unsupported.
+func (e ExtensionIDs) ID(name string) (byte, bool) {
+	id, ok := e[name]
+	return id, ok
+}
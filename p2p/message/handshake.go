@@ -2,6 +2,7 @@ package message
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 )
 
@@ -11,6 +12,39 @@ The length prefix is a four byte big-endian value.
 The message ID is a single decimal byte.
 The payload is message dependent.*/
 
+// Reserved are the eight reserved bytes of the handshake,
+// each set bit advertises support for a protocol extension.
+type Reserved [8]byte
+
+// Capability is a bit in the reserved bytes, counting from the
+// right of the big-endian 64 bit value.
+type Capability uint64
+
+const (
+	DHT       Capability = 0x01     // reserved[7] & 0x01 (BEP 5).
+	Fast      Capability = 0x04     // reserved[7] & 0x04 (BEP 6).
+	Extension Capability = 0x100000 // reserved[5] & 0x10 (BEP 10).
+)
+
+// Capabilities we advertise in our handshake.
+var Supported = NewReserved(Fast, Extension)
+
+func NewReserved(caps ...Capability) Reserved {
+	var r Reserved
+	for _, c := range caps {
+		r.Set(c)
+	}
+	return r
+}
+
+func (r Reserved) Has(c Capability) bool {
+	return binary.BigEndian.Uint64(r[:])&uint64(c) != 0
+}
+
+func (r *Reserved) Set(c Capability) {
+	binary.BigEndian.PutUint64(r[:], binary.BigEndian.Uint64(r[:])|uint64(c))
+}
+
 // The handshake is a required message and must be the first message transmitted by the client.
 // It is (49+len(pstr)) bytes long.
 // handshake: <pstrlen><pstr><reserved><info_hash><peer_id>
@@ -20,23 +54,26 @@ func Handshake(ID, infoHash [20]byte) []byte {
 	buf[0] = byte(len(pstr))
 	n := 1
 	n += copy(buf[n:], []byte(pstr))
-	n += copy(buf[n:], make([]byte, 8))
+	n += copy(buf[n:], Supported[:])
 	n += copy(buf[n:], infoHash[:])
 	n += copy(buf[n:], ID[:])
 	return buf
 }
 
-func VerifyHandshake(handshake []byte, infoHash [20]byte) ([20]byte, error) {
+// Checks the handshake is valid, returning the peer's ID and reserved bytes.
+func VerifyHandshake(handshake []byte, infoHash [20]byte) ([20]byte, Reserved, error) {
 	if len(handshake) != 68 {
-		return [20]byte{}, fmt.Errorf("handshake length error")
+		return [20]byte{}, Reserved{}, fmt.Errorf("handshake length error")
 	}
 	if string(handshake[1:20]) != "BitTorrent protocol" {
-		return [20]byte{}, fmt.Errorf("handshake error, wrong protocol")
+		return [20]byte{}, Reserved{}, fmt.Errorf("handshake error, wrong protocol")
 	}
 	if !bytes.Equal(handshake[28:48], infoHash[:]) {
-		return [20]byte{}, fmt.Errorf("handshake error, wrong info hash")
+		return [20]byte{}, Reserved{}, fmt.Errorf("handshake error, wrong info hash")
 	}
 	var ID [20]byte
 	copy(ID[:], handshake[48:])
-	return ID, nil
+	var reserved Reserved
+	copy(reserved[:], handshake[20:28])
+	return ID, reserved, nil
 }
@@ -1,16 +1,13 @@
 package message
 
 import (
+	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"net"
 )
 
-type Message struct {
-	Length  []byte
-	ID      byte
-	Payload []byte
-}
-
 var MsgIDmap = map[byte]string{
 	0:    "Choke",
 	1:    "Unchoke",
@@ -21,105 +18,415 @@ var MsgIDmap = map[byte]string{
 	6:    "Request",
 	7:    "Piece",
 	8:    "Cancel",
+	9:    "Port",
+	0x0D: "Suggest Piece",
+	0x0E: "Have All",
+	0x0F: "Have None",
+	0x10: "Reject Request",
+	0x11: "Allowed Fast",
+	20:   "Extended",
 	0x54: "Handshake",
 }
 
-// Serialize message to byte array.
-func (m Message) SerialiseMsg() []byte {
-	buf := make([]byte, len(m.Length)+len(m.Payload)+1)
-	var n int
-	n += copy(buf[n:], m.Length[:])
-	n += copy(buf[n:], []byte{m.ID})
-	n += copy(buf[n:], m.Payload)
+// Msg is a message of the peer wire protocol.
+// MarshalBinary returns the whole frame, length prefix included,
+// and UnmarshalBinary on the pointer type parses one.
+type Msg interface {
+	ID() byte
+	MarshalBinary() ([]byte, error)
+	appendPayload(buf []byte) []byte
+}
+
+// Implemented by the pointer of every message.
+type payloadParser interface {
+	ID() byte
+	parsePayload(payload []byte) error
+}
+
+var (
+	ErrFrameTooLarge = errors.New("message exceeds maximum frame size")
+	ErrShortFrame    = errors.New("message frame too short")
+)
+
+// Appends the frame for m to buf: <length prefix><message ID><payload>.
+func appendFrame(buf []byte, m Msg) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0, m.ID())
+	buf = m.appendPayload(buf)
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(buf)-start-4))
 	return buf
 }
 
-// Pads to the left to 4 byte array
-func numToBuffer(num int) []byte {
-	buf := make([]byte, 4)
-	for i := len(buf) - 1; num != 0; i-- {
-		buf[i] = byte(num & 0xff)
-		num >>= 8
+func marshal(m Msg) ([]byte, error) {
+	return appendFrame(nil, m), nil
+}
+
+func unmarshal(data []byte, m payloadParser) error {
+	if len(data) < 5 {
+		return ErrShortFrame
 	}
-	return buf
+	if int(binary.BigEndian.Uint32(data[0:4])) != len(data)-4 {
+		return fmt.Errorf("length prefix %d does not match frame", binary.BigEndian.Uint32(data[0:4]))
+	}
+	if data[4] != m.ID() {
+		return fmt.Errorf("expected message ID %d, got %d", m.ID(), data[4])
+	}
+	return m.parsePayload(data[5:])
+}
+
+// Parse decodes a message from its ID and payload.
+// Variable length payloads alias payload rather than being copied.
+func Parse(id byte, payload []byte) (Msg, error) {
+	var m interface {
+		payloadParser
+		msg() Msg
+	}
+	switch id {
+	case 0:
+		m = new(Choke)
+	case 1:
+		m = new(Unchoke)
+	case 2:
+		m = new(Interested)
+	case 3:
+		m = new(NotInterested)
+	case 4:
+		m = new(Have)
+	case 5:
+		m = new(Bitfield)
+	case 6:
+		m = new(Request)
+	case 7:
+		m = new(Piece)
+	case 8:
+		m = new(Cancel)
+	case 9:
+		m = new(Port)
+	case 0x0D:
+		m = new(SuggestPiece)
+	case 0x0E:
+		m = new(HaveAll)
+	case 0x0F:
+		m = new(HaveNone)
+	case 0x10:
+		m = new(RejectRequest)
+	case 0x11:
+		m = new(AllowedFast)
+	case 20:
+		m = new(Extended)
+	default:
+		m = &Unknown{MsgID: id}
+	}
+	if err := m.parsePayload(payload); err != nil {
+		return nil, fmt.Errorf("invalid %s message: %w", MsgIDmap[id], err)
+	}
+	return m.msg(), nil
+}
+
+// Size returns the length of m's frame on the wire.
+func Size(m Msg) int {
+	return 5 + len(m.appendPayload(nil))
 }
 
-func (m Message) PrintInfo() {
-	fmt.Print("\n-- Message --\n")
-	fmt.Printf("Length: %d\n", binary.BigEndian.Uint32(m.Length[:]))
-	fmt.Printf("Type: %v", MsgIDmap[m.ID])
+// Copy returns m with any payload it aliases copied,
+// so that it outlives the buffer it was read into.
+func Copy(m Msg) Msg {
+	switch m := m.(type) {
+	case Bitfield:
+		return append(Bitfield(nil), m...)
+	case Piece:
+		m.Block = append([]byte(nil), m.Block...)
+		return m
+	case Extended:
+		m.Payload = append([]byte(nil), m.Payload...)
+		return m
+	case Unknown:
+		m.Payload = append([]byte(nil), m.Payload...)
+		return m
+	}
+	return m
+}
+
+// Checks a fixed size payload is exactly n bytes.
+func expectLength(payload []byte, n int) error {
+	if len(payload) != n {
+		return fmt.Errorf("payload length %d, expected %d", len(payload), n)
+	}
+	return nil
+}
+
+func appendUint32(buf []byte, v int) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func readUint32(b []byte) int {
+	return int(binary.BigEndian.Uint32(b))
+}
+
+// Keep-alives are a zero length prefix with no ID.
+func KeepAlive() []byte {
+	return []byte{0, 0, 0, 0}
 }
 
 // -------------------- Messages --------------------//
 
-func Choke() []byte {
-	msg := Message{Length: []byte{0, 0, 0, 1}, ID: 0}
-	return msg.SerialiseMsg()
+// Messages with no payload.
+type (
+	Choke         struct{}
+	Unchoke       struct{}
+	Interested    struct{}
+	NotInterested struct{}
+	HaveAll       struct{} // Fast Extension.
+	HaveNone      struct{} // Fast Extension.
+)
+
+func (Choke) ID() byte         { return 0 }
+func (Unchoke) ID() byte       { return 1 }
+func (Interested) ID() byte    { return 2 }
+func (NotInterested) ID() byte { return 3 }
+func (HaveAll) ID() byte       { return 0x0E }
+func (HaveNone) ID() byte      { return 0x0F }
+
+func (m Choke) MarshalBinary() ([]byte, error)         { return marshal(m) }
+func (m Unchoke) MarshalBinary() ([]byte, error)       { return marshal(m) }
+func (m Interested) MarshalBinary() ([]byte, error)    { return marshal(m) }
+func (m NotInterested) MarshalBinary() ([]byte, error) { return marshal(m) }
+func (m HaveAll) MarshalBinary() ([]byte, error)       { return marshal(m) }
+func (m HaveNone) MarshalBinary() ([]byte, error)      { return marshal(m) }
+
+func (m *Choke) UnmarshalBinary(data []byte) error         { return unmarshal(data, m) }
+func (m *Unchoke) UnmarshalBinary(data []byte) error       { return unmarshal(data, m) }
+func (m *Interested) UnmarshalBinary(data []byte) error    { return unmarshal(data, m) }
+func (m *NotInterested) UnmarshalBinary(data []byte) error { return unmarshal(data, m) }
+func (m *HaveAll) UnmarshalBinary(data []byte) error       { return unmarshal(data, m) }
+func (m *HaveNone) UnmarshalBinary(data []byte) error      { return unmarshal(data, m) }
+
+func (Choke) appendPayload(buf []byte) []byte         { return buf }
+func (Unchoke) appendPayload(buf []byte) []byte       { return buf }
+func (Interested) appendPayload(buf []byte) []byte    { return buf }
+func (NotInterested) appendPayload(buf []byte) []byte { return buf }
+func (HaveAll) appendPayload(buf []byte) []byte       { return buf }
+func (HaveNone) appendPayload(buf []byte) []byte      { return buf }
+
+func (*Choke) parsePayload(p []byte) error         { return expectLength(p, 0) }
+func (*Unchoke) parsePayload(p []byte) error       { return expectLength(p, 0) }
+func (*Interested) parsePayload(p []byte) error    { return expectLength(p, 0) }
+func (*NotInterested) parsePayload(p []byte) error { return expectLength(p, 0) }
+func (*HaveAll) parsePayload(p []byte) error       { return expectLength(p, 0) }
+func (*HaveNone) parsePayload(p []byte) error      { return expectLength(p, 0) }
+
+func (m *Choke) msg() Msg         { return *m }
+func (m *Unchoke) msg() Msg       { return *m }
+func (m *Interested) msg() Msg    { return *m }
+func (m *NotInterested) msg() Msg { return *m }
+func (m *HaveAll) msg() Msg       { return *m }
+func (m *HaveNone) msg() Msg      { return *m }
+
+// Messages carrying a single piece index.
+type (
+	Have         struct{ Index int }
+	SuggestPiece struct{ Index int } // Fast Extension.
+	AllowedFast  struct{ Index int } // Fast Extension.
+)
+
+func (Have) ID() byte         { return 4 }
+func (SuggestPiece) ID() byte { return 0x0D }
+func (AllowedFast) ID() byte  { return 0x11 }
+
+func (m Have) MarshalBinary() ([]byte, error)         { return marshal(m) }
+func (m SuggestPiece) MarshalBinary() ([]byte, error) { return marshal(m) }
+func (m AllowedFast) MarshalBinary() ([]byte, error)  { return marshal(m) }
+
+func (m *Have) UnmarshalBinary(data []byte) error         { return unmarshal(data, m) }
+func (m *SuggestPiece) UnmarshalBinary(data []byte) error { return unmarshal(data, m) }
+func (m *AllowedFast) UnmarshalBinary(data []byte) error  { return unmarshal(data, m) }
+
+func (m Have) appendPayload(buf []byte) []byte         { return appendUint32(buf, m.Index) }
+func (m SuggestPiece) appendPayload(buf []byte) []byte { return appendUint32(buf, m.Index) }
+func (m AllowedFast) appendPayload(buf []byte) []byte  { return appendUint32(buf, m.Index) }
+
+func (m *Have) parsePayload(p []byte) error         { return parseIndex(p, &m.Index) }
+func (m *SuggestPiece) parsePayload(p []byte) error { return parseIndex(p, &m.Index) }
+func (m *AllowedFast) parsePayload(p []byte) error  { return parseIndex(p, &m.Index) }
+
+func (m *Have) msg() Msg         { return *m }
+func (m *SuggestPiece) msg() Msg { return *m }
+func (m *AllowedFast) msg() Msg  { return *m }
+
+func parseIndex(p []byte, idx *int) error {
+	if err := expectLength(p, 4); err != nil {
+		return err
+	}
+	*idx = readUint32(p)
+	return nil
+}
+
+// Messages identifying a block: <index><begin><length>.
+type (
+	Request       struct{ Index, Begin, Length int }
+	Cancel        struct{ Index, Begin, Length int }
+	RejectRequest struct{ Index, Begin, Length int } // Fast Extension.
+)
+
+func (Request) ID() byte       { return 6 }
+func (Cancel) ID() byte        { return 8 }
+func (RejectRequest) ID() byte { return 0x10 }
+
+func (m Request) MarshalBinary() ([]byte, error)       { return marshal(m) }
+func (m Cancel) MarshalBinary() ([]byte, error)        { return marshal(m) }
+func (m RejectRequest) MarshalBinary() ([]byte, error) { return marshal(m) }
+
+func (m *Request) UnmarshalBinary(data []byte) error       { return unmarshal(data, m) }
+func (m *Cancel) UnmarshalBinary(data []byte) error        { return unmarshal(data, m) }
+func (m *RejectRequest) UnmarshalBinary(data []byte) error { return unmarshal(data, m) }
+
+func (m Request) appendPayload(buf []byte) []byte {
+	return appendBlock(buf, m.Index, m.Begin, m.Length)
+}
+func (m Cancel) appendPayload(buf []byte) []byte {
+	return appendBlock(buf, m.Index, m.Begin, m.Length)
+}
+func (m RejectRequest) appendPayload(buf []byte) []byte {
+	return appendBlock(buf, m.Index, m.Begin, m.Length)
+}
+
+func (m *Request) parsePayload(p []byte) error {
+	return parseBlock(p, &m.Index, &m.Begin, &m.Length)
+}
+func (m *Cancel) parsePayload(p []byte) error {
+	return parseBlock(p, &m.Index, &m.Begin, &m.Length)
+}
+func (m *RejectRequest) parsePayload(p []byte) error {
+	return parseBlock(p, &m.Index, &m.Begin, &m.Length)
+}
+
+func (m *Request) msg() Msg       { return *m }
+func (m *Cancel) msg() Msg        { return *m }
+func (m *RejectRequest) msg() Msg { return *m }
+
+func appendBlock(buf []byte, idx, begin, length int) []byte {
+	buf = appendUint32(buf, idx)
+	buf = appendUint32(buf, begin)
+	return appendUint32(buf, length)
 }
 
-func Unchoke() []byte {
-	msg := Message{Length: []byte{0, 0, 0, 1}, ID: 1}
-	return msg.SerialiseMsg()
+func parseBlock(p []byte, idx, begin, length *int) error {
+	if err := expectLength(p, 12); err != nil {
+		return err
+	}
+	*idx, *begin, *length = readUint32(p[0:4]), readUint32(p[4:8]), readUint32(p[8:12])
+	return nil
 }
 
-func Interested() []byte {
-	msg := Message{Length: []byte{0, 0, 0, 1}, ID: 2}
-	return msg.SerialiseMsg()
+// Piece carries a block of data: <index><begin><block>.
+type Piece struct {
+	Index int
+	Begin int
+	Block []byte
 }
 
-func NotInterested() []byte {
-	msg := Message{Length: []byte{0, 0, 0, 1}, ID: 3}
-	return msg.SerialiseMsg()
+func (Piece) ID() byte                             { return 7 }
+func (m Piece) MarshalBinary() ([]byte, error)     { return marshal(m) }
+func (m *Piece) UnmarshalBinary(data []byte) error { return unmarshal(data, m) }
+func (m *Piece) msg() Msg                          { return *m }
+
+func (m Piece) appendPayload(buf []byte) []byte {
+	buf = appendUint32(buf, m.Index)
+	buf = appendUint32(buf, m.Begin)
+	return append(buf, m.Block...)
 }
 
-func Have(idx int) []byte {
-	msg := Message{
-		Length:  []byte{0, 0, 0, 5},
-		ID:      4,
-		Payload: numToBuffer(idx),
+func (m *Piece) parsePayload(p []byte) error {
+	if len(p) < 8 {
+		return fmt.Errorf("payload length %d, expected at least 8", len(p))
 	}
-	return msg.SerialiseMsg()
+	m.Index, m.Begin, m.Block = readUint32(p[0:4]), readUint32(p[4:8]), p[8:]
+	return nil
+}
+
+// Unknown is a message with an ID we don't support, peers may send
+// them for extensions they believe we have, so they are skipped.
+type Unknown struct {
+	MsgID   byte
+	Payload []byte
 }
 
-func Request(idx, begin, length int) []byte {
-	payloadBuf := make([]byte, 12)
-	var n int
-	n += copy(payloadBuf[n:], numToBuffer(idx))
-	n += copy(payloadBuf[n:], numToBuffer(begin))
-	n += copy(payloadBuf[n:], numToBuffer(length))
-	msg := Message{
-		Length:  []byte{0, 0, 0, 13},
-		ID:      6,
-		Payload: payloadBuf,
+func (m Unknown) ID() byte                       { return m.MsgID }
+func (m Unknown) MarshalBinary() ([]byte, error) { return marshal(m) }
+func (m *Unknown) msg() Msg                      { return *m }
+
+func (m *Unknown) UnmarshalBinary(data []byte) error {
+	if len(data) >= 5 {
+		m.MsgID = data[4]
 	}
-	return msg.SerialiseMsg()
+	return unmarshal(data, m)
+}
+
+func (m Unknown) appendPayload(buf []byte) []byte {
+	return append(buf, m.Payload...)
+}
+
+func (m *Unknown) parsePayload(p []byte) error {
+	m.Payload = p
+	return nil
 }
 
-func Block(idx int, offset int, block []byte) []byte {
-	payloadBuf := make([]byte, len(block)+9)
-	var n int
-	n += copy(payloadBuf[n:], numToBuffer(idx))
-	n += copy(payloadBuf[n:], numToBuffer(offset))
-	n += copy(payloadBuf[n:], block)
-	msg := Message{
-		Length:  []byte{0, 0, 0, byte(len(payloadBuf))},
-		ID:      7,
-		Payload: payloadBuf,
+// Port is the peer's DHT listen port (BEP 5).
+type Port struct {
+	Port uint16
+}
+
+func (Port) ID() byte                             { return 9 }
+func (m Port) MarshalBinary() ([]byte, error)     { return marshal(m) }
+func (m *Port) UnmarshalBinary(data []byte) error { return unmarshal(data, m) }
+func (m *Port) msg() Msg                          { return *m }
+
+func (m Port) appendPayload(buf []byte) []byte {
+	return append(buf, byte(m.Port>>8), byte(m.Port))
+}
+
+func (m *Port) parsePayload(p []byte) error {
+	if err := expectLength(p, 2); err != nil {
+		return err
 	}
-	return msg.SerialiseMsg()
+	m.Port = binary.BigEndian.Uint16(p)
+	return nil
 }
 
-func Cancel(idx, begin, length int) []byte {
-	payloadBuf := make([]byte, 12)
-	var n int
-	n += copy(payloadBuf[n:], numToBuffer(idx))
-	n += copy(payloadBuf[n:], numToBuffer(begin))
-	n += copy(payloadBuf[n:], numToBuffer(length))
+// AllowedFastSet generates the k pieces a peer at ip may request
+// while choked, using the canonical algorithm from BEP 6.
+func AllowedFastSet(k, numPieces int, infoHash [20]byte, ip net.IP) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+	// Only the /24 of the address is used.
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	set := make([]int, 0, k)
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			idx := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !contains(set, idx) {
+				set = append(set, idx)
+			}
+		}
+	}
+	return set
+}
 
-	msg := Message{
-		Length:  []byte{0, 0, 0, 13},
-		ID:      8,
-		Payload: payloadBuf,
+func contains(set []int, idx int) bool {
+	for _, i := range set {
+		if i == idx {
+			return true
+		}
 	}
-	return msg.SerialiseMsg()
+	return false
 }
@@ -0,0 +1,149 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// A message of every ID, with the pointer it unmarshals into.
+var roundTrips = []struct {
+	msg Msg
+	ptr interface{ UnmarshalBinary([]byte) error }
+}{
+	{Choke{}, new(Choke)},
+	{Unchoke{}, new(Unchoke)},
+	{Interested{}, new(Interested)},
+	{NotInterested{}, new(NotInterested)},
+	{Have{Index: 7}, new(Have)},
+	{Bitfield{0xA5, 0x80}, new(Bitfield)},
+	{Request{Index: 1, Begin: 16384, Length: 16384}, new(Request)},
+	{Piece{Index: 2, Begin: 32768, Block: []byte("block data")}, new(Piece)},
+	{Cancel{Index: 3, Begin: 0, Length: 1024}, new(Cancel)},
+	{Port{Port: 6881}, new(Port)},
+	{SuggestPiece{Index: 4}, new(SuggestPiece)},
+	{HaveAll{}, new(HaveAll)},
+	{HaveNone{}, new(HaveNone)},
+	{RejectRequest{Index: 5, Begin: 16384, Length: 512}, new(RejectRequest)},
+	{AllowedFast{Index: 1 << 20}, new(AllowedFast)},
+	{Extended{ExtID: 3, Payload: []byte("d1:ai1ee")}, new(Extended)},
+	{Unknown{MsgID: 0x42, Payload: []byte{1, 2, 3}}, new(Unknown)},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tt := range roundTrips {
+		name := MsgIDmap[tt.msg.ID()]
+		data, err := tt.msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: marshal: %v", name, err)
+		}
+		if len(data) != Size(tt.msg) {
+			t.Errorf("%s: frame is %d bytes, Size says %d", name, len(data), Size(tt.msg))
+		}
+		if err := tt.ptr.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%s: unmarshal: %v", name, err)
+		}
+		got := reflect.ValueOf(tt.ptr).Elem().Interface()
+		if !reflect.DeepEqual(got, tt.msg) {
+			t.Errorf("%s: got %#v, want %#v", name, got, tt.msg)
+		}
+
+		// The same frame through a Reader, and through Parse.
+		m, err := NewReader(bytes.NewReader(data), DefaultMaxFrame).ReadMsg()
+		if err != nil {
+			t.Fatalf("%s: read: %v", name, err)
+		}
+		if !reflect.DeepEqual(m, tt.msg) {
+			t.Errorf("%s: read %#v, want %#v", name, m, tt.msg)
+		}
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	have, _ := Have{Index: 1}.MarshalBinary()
+	for _, tt := range []struct {
+		name string
+		data []byte
+		ptr  interface{ UnmarshalBinary([]byte) error }
+	}{
+		{"short frame", []byte{0, 0, 0}, new(Have)},
+		{"wrong ID", have, new(SuggestPiece)},
+		{"bad length prefix", append(append([]byte(nil), have...), 0), new(Have)},
+		{"short payload", []byte{0, 0, 0, 3, 4, 0, 0}, new(Have)},
+		{"short block", []byte{0, 0, 0, 5, 6, 0, 0, 0, 1}, new(Request)},
+		{"short port", []byte{0, 0, 0, 2, 9, 1}, new(Port)},
+		{"empty extended", []byte{0, 0, 0, 1, 20}, new(Extended)},
+	} {
+		if err := tt.ptr.UnmarshalBinary(tt.data); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestReaderKeepAlive(t *testing.T) {
+	m, err := NewReader(bytes.NewReader(KeepAlive()), DefaultMaxFrame).ReadMsg()
+	if m != nil || err != nil {
+		t.Errorf("got %v, %v, want a keep-alive", m, err)
+	}
+}
+
+func TestReaderMaxFrame(t *testing.T) {
+	frame := make([]byte, 4)
+	binary.BigEndian.PutUint32(frame, 101)
+	_, err := NewReader(bytes.NewReader(frame), 100).ReadMsg()
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrFrameTooLarge)
+	}
+}
+
+// The reader must never panic, and rejects frames over its maximum
+// before reading them.
+func FuzzReader(f *testing.F) {
+	for _, tt := range roundTrips {
+		data, _ := tt.msg.MarshalBinary()
+		f.Add(data)
+	}
+	f.Add(KeepAlive())
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 7})
+	const max = 1 << 10
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewReader(bytes.NewReader(data), max)
+		for {
+			var length uint32
+			if len(data) >= 4 {
+				length = binary.BigEndian.Uint32(data)
+			}
+			m, err := r.ReadMsg()
+			if length > max && !errors.Is(err, ErrFrameTooLarge) {
+				t.Fatalf("frame of %d bytes read, max is %d", length, max)
+			}
+			if err != nil {
+				return
+			}
+			// Whatever was read must survive a round trip.
+			if m != nil {
+				frame, _ := m.MarshalBinary()
+				if int(length)+4 != len(frame) {
+					t.Fatalf("%#v: frame of %d bytes, read from %d", m, len(frame), length+4)
+				}
+			}
+			data = data[4+length:]
+		}
+	})
+}
+
+// Unmarshalling arbitrary frames must never panic.
+func FuzzUnmarshal(f *testing.F) {
+	for _, tt := range roundTrips {
+		data, _ := tt.msg.MarshalBinary()
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, tt := range roundTrips {
+			ptr := reflect.New(reflect.TypeOf(tt.ptr).Elem()).Interface().(interface{ UnmarshalBinary([]byte) error })
+			ptr.UnmarshalBinary(data)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package message
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Largest frame accepted by default, a 128 KiB block plus its header.
+// Peers should not send blocks over 16 KiB, but some do.
+const DefaultMaxFrame = 1<<17 + 9
+
+// Reader decodes messages from a connection, reusing its buffer
+// between frames.
+type Reader struct {
+	r      io.Reader
+	max    int
+	length [4]byte
+	buf    []byte
+}
+
+// NewReader creates a reader that rejects frames over max bytes.
+func NewReader(r io.Reader, max int) *Reader {
+	return &Reader{r: r, max: max}
+}
+
+// ReadMsg reads the next message, nil for a keep-alive.
+// Variable length payloads alias the reader's buffer,
+// so are only valid until the next call.
+func (r *Reader) ReadMsg() (Msg, error) {
+	if _, err := io.ReadFull(r.r, r.length[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(r.length[:])
+	if length == 0 { // Keep-alive message.
+		return nil, nil
+	}
+	if length > uint32(r.max) {
+		return nil, ErrFrameTooLarge
+	}
+
+	if cap(r.buf) < int(length) {
+		r.buf = make([]byte, length)
+	}
+	buf := r.buf[:length]
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	return Parse(buf[0], buf[1:])
+}
+
+// Writer encodes messages to a connection, reusing its buffer
+// between frames.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteMsg writes a message as a single frame.
+func (w *Writer) WriteMsg(m Msg) error {
+	w.buf = appendFrame(w.buf[:0], m)
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+func (w *Writer) WriteKeepAlive() error {
+	_, err := w.w.Write(KeepAlive())
+	return err
+}
@@ -0,0 +1,387 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+)
+
+/* Message Stream Encryption obfuscates the BitTorrent handshake and
+ * (optionally) the whole stream so it can't be identified by throttling ISPs.
+ *
+ * A is the side that connects, B the side that accepts.
+ * 1 A->B: Diffie Hellman Ya, PadA
+ * 2 B->A: Diffie Hellman Yb, PadB
+ * 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+ *         ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+ * 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+ * 5 A->B: ENCRYPT2(Payload Stream)
+ *
+ * S is the shared secret, SKEY the info hash of the torrent.
+ */
+
+// Policy decides whether connections are encrypted.
+type Policy int
+
+const (
+	Disabled Policy = iota // Plaintext connections only.
+	Prefer                 // Encrypt where possible, fall back to plaintext.
+	Require                // Encrypted connections only.
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "disabled"
+	case Prefer:
+		return "prefer"
+	case Require:
+		return "require"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// Crypto methods, used as a bitfield in crypto_provide and crypto_select.
+const (
+	CryptoPlain uint32 = 0x01 // Only the handshake is obfuscated.
+	CryptoRC4   uint32 = 0x02 // The whole stream is encrypted.
+)
+
+// Returns the crypto methods allowed under the policy.
+func (p Policy) Methods() uint32 {
+	switch p {
+	case Prefer:
+		return CryptoPlain | CryptoRC4
+	case Require:
+		return CryptoRC4
+	}
+	return 0
+}
+
+const (
+	keyLen = 96  // Length of Diffie Hellman public keys.
+	maxPad = 512 // Maximum length of random padding.
+)
+
+var (
+	// 768 bit safe prime from the specification.
+	prime, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	vc = make([]byte, 8) // Verification constant, 8 zero bytes.
+)
+
+var ErrNoSKey = errors.New("mse: no matching info hash")
+
+// Conn is a connection that has completed the MSE handshake.
+// Reads and writes pass through RC4 when it was selected.
+type Conn struct {
+	net.Conn
+	r      io.Reader // Buffered reader over the connection.
+	prefix []byte    // Decrypted initial payload, returned by Read first.
+	enc    *rc4.Cipher
+	dec    *rc4.Cipher
+	method uint32
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// Returns the negotiated crypto method.
+func (c *Conn) Method() uint32 {
+	return c.method
+}
+
+// Initiate performs the handshake as the connecting side,
+// offering the methods in provide for the torrent skey.
+func Initiate(conn net.Conn, skey [20]byte, provide uint32) (*Conn, error) {
+
+	r := bufio.NewReader(conn)
+
+	priv, pub, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+	// Step 1, send Ya and PadA.
+	if _, err := conn.Write(append(pub, randomPad()...)); err != nil {
+		return nil, err
+	}
+
+	// Step 2, receive Yb.
+	yb := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, yb); err != nil {
+		return nil, fmt.Errorf("mse: failed to read public key: %w", err)
+	}
+	s := secret(priv, yb)
+
+	enc := newCipher(hash([]byte("keyA"), s, skey[:]))
+	dec := newCipher(hash([]byte("keyB"), s, skey[:]))
+
+	// Step 3.
+	var buf bytes.Buffer
+	buf.Write(hash([]byte("req1"), s))
+	buf.Write(xor(hash([]byte("req2"), skey[:]), hash([]byte("req3"), s)))
+
+	// VC, crypto_provide, len(PadC) = 0, len(IA) = 0.
+	payload := make([]byte, 16)
+	copy(payload, vc)
+	binary.BigEndian.PutUint32(payload[8:12], provide)
+	enc.XORKeyStream(payload, payload)
+	buf.Write(payload)
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// Step 4, PadB is skipped by searching for the encrypted VC.
+	encVC := make([]byte, len(vc))
+	peek := *dec
+	peek.XORKeyStream(encVC, vc)
+	if err := sync(r, encVC, maxPad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(encVC, encVC) // Advance past VC.
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	method := binary.BigEndian.Uint32(header[0:4])
+	padLen := int(binary.BigEndian.Uint16(header[4:6]))
+	if padLen > maxPad {
+		return nil, fmt.Errorf("mse: padding too long: %d", padLen)
+	}
+	pad := make([]byte, padLen)
+	if _, err := io.ReadFull(r, pad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(pad, pad)
+
+	if method&provide == 0 || (method != CryptoPlain && method != CryptoRC4) {
+		return nil, fmt.Errorf("mse: peer selected unsupported method: %d", method)
+	}
+	c := &Conn{Conn: conn, r: r, method: method}
+	if method == CryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c, nil
+}
+
+// Accept performs the handshake as the accepting side.
+// skeys are the info hashes we are serving, allowed the methods we accept.
+// The info hash the peer connected for is returned with the connection.
+func Accept(conn net.Conn, skeys [][20]byte, allowed uint32) (*Conn, [20]byte, error) {
+
+	r := bufio.NewReader(conn)
+
+	// Step 1, receive Ya.
+	ya := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, ya); err != nil {
+		return nil, [20]byte{}, fmt.Errorf("mse: failed to read public key: %w", err)
+	}
+
+	// Step 2, send Yb and PadB.
+	priv, pub, err := newKeys()
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	if _, err := conn.Write(append(pub, randomPad()...)); err != nil {
+		return nil, [20]byte{}, err
+	}
+	s := secret(priv, ya)
+
+	// Step 3, PadA is skipped by searching for HASH('req1', S).
+	if err := sync(r, hash([]byte("req1"), s), maxPad); err != nil {
+		return nil, [20]byte{}, err
+	}
+	obfuscated := make([]byte, 20)
+	if _, err := io.ReadFull(r, obfuscated); err != nil {
+		return nil, [20]byte{}, err
+	}
+	req2 := xor(obfuscated, hash([]byte("req3"), s))
+
+	var skey [20]byte
+	found := false
+	for _, key := range skeys {
+		if bytes.Equal(hash([]byte("req2"), key[:]), req2) {
+			skey, found = key, true
+			break
+		}
+	}
+	if !found {
+		return nil, [20]byte{}, ErrNoSKey
+	}
+
+	dec := newCipher(hash([]byte("keyA"), s, skey[:]))
+	enc := newCipher(hash([]byte("keyB"), s, skey[:]))
+
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, [20]byte{}, err
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[0:8], vc) {
+		return nil, [20]byte{}, fmt.Errorf("mse: invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLen := int(binary.BigEndian.Uint16(header[12:14]))
+	if padLen > maxPad {
+		return nil, [20]byte{}, fmt.Errorf("mse: padding too long: %d", padLen)
+	}
+	// PadC followed by len(IA).
+	rest := make([]byte, padLen+2)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, [20]byte{}, err
+	}
+	dec.XORKeyStream(rest, rest)
+	ia := make([]byte, binary.BigEndian.Uint16(rest[padLen:]))
+	if _, err := io.ReadFull(r, ia); err != nil {
+		return nil, [20]byte{}, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	// Prefer RC4 when both sides allow it.
+	var method uint32
+	switch {
+	case provide&allowed&CryptoRC4 != 0:
+		method = CryptoRC4
+	case provide&allowed&CryptoPlain != 0:
+		method = CryptoPlain
+	default:
+		return nil, [20]byte{}, fmt.Errorf("mse: no common crypto method, provided: %d", provide)
+	}
+
+	// Step 4.
+	// VC, crypto_select, len(padD) = 0.
+	reply := make([]byte, 14)
+	copy(reply, vc)
+	binary.BigEndian.PutUint32(reply[8:12], method)
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, [20]byte{}, err
+	}
+
+	c := &Conn{Conn: conn, r: r, prefix: ia, method: method}
+	if method == CryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c, skey, nil
+}
+
+// Detect reads the start of an incoming connection to tell a plaintext
+// BitTorrent handshake from an MSE one. The returned connection replays
+// the bytes read.
+func Detect(conn net.Conn) (net.Conn, bool, error) {
+	pstr := "\x13BitTorrent protocol"
+	buf := make([]byte, len(pstr))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, false, err
+	}
+	replay := &Conn{Conn: conn, r: conn, prefix: buf}
+	return replay, string(buf) != pstr, nil
+}
+
+// ------------------------------ Helpers ------------------------------//
+
+// Generates a Diffie Hellman key pair.
+func newKeys() (*big.Int, []byte, error) {
+	x := make([]byte, 20) // 160 bit private key.
+	if _, err := rand.Read(x); err != nil {
+		return nil, nil, err
+	}
+	priv := new(big.Int).SetBytes(x)
+	pub := new(big.Int).Exp(generator, priv, prime)
+	return priv, pad(pub.Bytes()), nil
+}
+
+// Computes the shared secret from our private key and their public key.
+func secret(priv *big.Int, pub []byte) []byte {
+	y := new(big.Int).SetBytes(pub)
+	return pad(new(big.Int).Exp(y, priv, prime).Bytes())
+}
+
+// Left pads to keyLen bytes.
+func pad(b []byte) []byte {
+	buf := make([]byte, keyLen)
+	copy(buf[keyLen-len(b):], b)
+	return buf
+}
+
+func randomPad() []byte {
+	var n [2]byte
+	rand.Read(n[:])
+	buf := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPad+1))
+	rand.Read(buf)
+	return buf
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	buf := make([]byte, len(a))
+	for i := range a {
+		buf[i] = a[i] ^ b[i]
+	}
+	return buf
+}
+
+// RC4 with the first 1024 bytes of keystream discarded.
+func newCipher(key []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(key)
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// Reads until pattern has been consumed, allowing up to max bytes before it.
+func sync(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, max+len(pattern))
+	for len(window) < max+len(pattern) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("mse: failed to sync: %w", err)
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("mse: failed to sync, pattern not found")
+}
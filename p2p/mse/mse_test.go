@@ -0,0 +1,268 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	infoHash  = [20]byte{1, 2, 3, 4, 5}
+	otherHash = [20]byte{9, 9, 9}
+)
+
+// Records what is written to a connection, a write is recorded before
+// the other side can read it.
+type recorder struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.written.Write(b)
+	return r.Conn.Write(b)
+}
+
+type accepted struct {
+	conn *Conn
+	skey [20]byte
+	err  error
+}
+
+// Runs both sides of the handshake over a pipe, A's writes are recorded.
+func handshake(t *testing.T, provide uint32, skeys [][20]byte, allowed uint32) (*Conn, *recorder, accepted, error) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	deadline := time.Now().Add(10 * time.Second)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+
+	done := make(chan accepted, 1)
+	go func() {
+		c, skey, err := Accept(b, skeys, allowed)
+		if err != nil {
+			b.Close() // As the listener does.
+		}
+		done <- accepted{c, skey, err}
+	}()
+	rec := &recorder{Conn: a}
+	c, err := Initiate(rec, infoHash, provide)
+	return c, rec, <-done, err
+}
+
+func TestHandshake(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		provide, allowed uint32
+		want             uint32
+	}{
+		{"both offered", CryptoPlain | CryptoRC4, CryptoPlain | CryptoRC4, CryptoRC4},
+		{"rc4 only", CryptoRC4, CryptoPlain | CryptoRC4, CryptoRC4},
+		{"rc4 required", CryptoPlain | CryptoRC4, CryptoRC4, CryptoRC4},
+		{"plaintext offered", CryptoPlain, CryptoPlain | CryptoRC4, CryptoPlain},
+		{"plaintext allowed", CryptoPlain | CryptoRC4, CryptoPlain, CryptoPlain},
+	} {
+		ca, rec, b, err := handshake(t, tt.provide, [][20]byte{otherHash, infoHash}, tt.allowed)
+		if err != nil || b.err != nil {
+			t.Fatalf("%s: initiate: %v, accept: %v", tt.name, err, b.err)
+		}
+		if ca.Method() != tt.want || b.conn.Method() != tt.want {
+			t.Errorf("%s: methods %d and %d, want %d", tt.name, ca.Method(), b.conn.Method(), tt.want)
+		}
+		if b.skey != infoHash {
+			t.Errorf("%s: accepted for %x, want %x", tt.name, b.skey, infoHash)
+		}
+
+		// The stream after the handshake, both ways.
+		rec.written.Reset()
+		msg := []byte("\x13BitTorrent protocol, then some messages")
+		go ca.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(b.conn, got); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%s: B read %q, %v", tt.name, got, err)
+		}
+		go b.conn.Write(msg)
+		if _, err := io.ReadFull(ca, got); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%s: A read %q, %v", tt.name, got, err)
+		}
+		plain := bytes.Equal(rec.written.Bytes(), msg)
+		if plain != (tt.want == CryptoPlain) {
+			t.Errorf("%s: stream sent in plaintext: %v", tt.name, plain)
+		}
+	}
+}
+
+func TestRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		skeys            [][20]byte
+		provide, allowed uint32
+		noSKey           bool
+	}{
+		{"wrong info hash", [][20]byte{otherHash}, CryptoPlain | CryptoRC4, CryptoPlain | CryptoRC4, true},
+		{"no info hashes", nil, CryptoPlain | CryptoRC4, CryptoPlain | CryptoRC4, true},
+		{"no common method", [][20]byte{infoHash}, CryptoPlain, CryptoRC4, false},
+	} {
+		_, _, b, err := handshake(t, tt.provide, tt.skeys, tt.allowed)
+		if b.err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+		if err == nil {
+			t.Errorf("%s: initiated", tt.name)
+		}
+		if errors.Is(b.err, ErrNoSKey) != tt.noSKey {
+			t.Errorf("%s: got %v", tt.name, b.err)
+		}
+	}
+}
+
+// Sends step 3 with the given PadC length, as a misbehaving A.
+func acceptPadC(t *testing.T, padLen int) error {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	a.SetDeadline(time.Now().Add(10 * time.Second))
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := Accept(b, [][20]byte{infoHash}, CryptoRC4)
+		b.Close()
+		done <- err
+	}()
+
+	priv, pub, err := newKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Write(pub); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(a)
+	yb := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, yb); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, r) // PadB and anything after.
+	s := secret(priv, yb)
+
+	var buf bytes.Buffer
+	buf.Write(hash([]byte("req1"), s))
+	buf.Write(xor(hash([]byte("req2"), infoHash[:]), hash([]byte("req3"), s)))
+	payload := make([]byte, 14+padLen+2)
+	binary.BigEndian.PutUint32(payload[8:12], CryptoRC4)
+	binary.BigEndian.PutUint16(payload[12:14], uint16(padLen))
+	newCipher(hash([]byte("keyA"), s, infoHash[:])).XORKeyStream(payload, payload)
+	buf.Write(payload)
+	go a.Write(buf.Bytes())
+	return <-done
+}
+
+func TestPadCBounds(t *testing.T) {
+	if err := acceptPadC(t, maxPad); err != nil {
+		t.Errorf("padding of %d: %v", maxPad, err)
+	}
+	if err := acceptPadC(t, maxPad+1); err == nil || !strings.Contains(err.Error(), "padding too long") {
+		t.Errorf("padding of %d: got %v", maxPad+1, err)
+	}
+}
+
+func TestRandomPad(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		if n := len(randomPad()); n > maxPad {
+			t.Fatalf("padding of %d bytes", n)
+		}
+	}
+}
+
+func TestSecret(t *testing.T) {
+	privA, pubA, err := newKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privB, pubB, err := newKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pubA) != keyLen || len(pubB) != keyLen {
+		t.Errorf("public keys of %d and %d bytes, want %d", len(pubA), len(pubB), keyLen)
+	}
+	if !bytes.Equal(secret(privA, pubB), secret(privB, pubA)) {
+		t.Error("secrets differ")
+	}
+}
+
+// The first 1024 bytes of keystream are discarded.
+func TestCipherDiscard(t *testing.T) {
+	key := []byte("key")
+	raw, _ := rc4.NewCipher(key)
+	stream := make([]byte, 1024+16)
+	raw.XORKeyStream(stream, stream)
+
+	got := make([]byte, 16)
+	newCipher(key).XORKeyStream(got, got)
+	if !bytes.Equal(got, stream[1024:]) {
+		t.Errorf("keystream %x, want %x", got, stream[1024:])
+	}
+}
+
+func TestSync(t *testing.T) {
+	pattern := []byte("pattern")
+	for _, tt := range []struct {
+		before int
+		ok     bool
+	}{
+		{0, true},
+		{maxPad, true},
+		{maxPad + 1, false},
+	} {
+		data := append(bytes.Repeat([]byte{'x'}, tt.before), pattern...)
+		r := bufio.NewReader(bytes.NewReader(append(data, "rest"...)))
+		err := sync(r, pattern, maxPad)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d bytes before: got %v", tt.before, err)
+			continue
+		}
+		if rest, _ := io.ReadAll(r); tt.ok && string(rest) != "rest" {
+			t.Errorf("%d bytes before: left %q", tt.before, rest)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	for _, tt := range []struct {
+		data      string
+		encrypted bool
+	}{
+		{"\x13BitTorrent protocol and the rest", false},
+		{strings.Repeat("\x8f", 40), true},
+	} {
+		a, b := net.Pipe()
+		go func() {
+			a.Write([]byte(tt.data))
+			a.Close()
+		}()
+		conn, encrypted, err := Detect(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted != tt.encrypted {
+			t.Errorf("%q: encrypted %v, want %v", tt.data, encrypted, tt.encrypted)
+		}
+		// What was read to decide is replayed.
+		if got, _ := io.ReadAll(conn); string(got) != tt.data {
+			t.Errorf("read %q, want %q", got, tt.data)
+		}
+		b.Close()
+	}
+}
@@ -1,52 +1,229 @@
 package p2p
 
 import (
-	"encoding/binary"
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/0xNathanW/bittorrent-go/ipfilter"
+	"github.com/0xNathanW/bittorrent-go/logging"
 	msg "github.com/0xNathanW/bittorrent-go/p2p/message"
-	"github.com/rivo/tview"
+	"github.com/0xNathanW/bittorrent-go/p2p/mse"
+	"github.com/0xNathanW/bittorrent-go/p2p/peerid"
+	"github.com/0xNathanW/bittorrent-go/picker"
+	"github.com/0xNathanW/bittorrent-go/ratelimit"
+	"github.com/0xNathanW/bittorrent-go/torrent"
+	"github.com/0xNathanW/bittorrent-go/utp"
 )
 
 type Peer struct {
 	PeerID   [20]byte
 	IP       *net.TCPAddr
-	Conn     *net.TCPConn
+	Conn     net.Conn
+	reader   *msg.Reader
+	writer   *msg.Writer
 	BitField msg.Bitfield
 	Start    time.Time
 
-	Active  bool
-	strikes int
+	Encryption mse.Policy       // Whether to encrypt the connection.
+	Inbound    bool             // Peer connected to us.
+	UTP        *utp.Socket      // Shared socket to dial uTP from, nil for TCP only.
+	PreferUTP  bool             // Try uTP before TCP when dialling.
+	Filter     *ipfilter.Filter // Blocked ranges, checked before dialling.
+
+	Active    bool
+	OnConnect func() // Called once the connection is established.
+	strikes   int
 
 	Rates *Rates
 
-	Downloading bool        // Should upload to best 4 peers.
-	BlockOut    chan []byte // Channel for sending blocks.
+	// Bandwidth limits, transfers count against the peer's own limiter
+	// and every shared one, eg. global and torrent.
+	UpLimit       *ratelimit.Limiter
+	DownLimit     *ratelimit.Limiter
+	UpLimits      ratelimit.Group
+	DownLimits    ratelimit.Group
+	CountOverhead bool // Count protocol overhead as well as block data.
+
+	Downloading bool                  // Unchoked by the choker, we upload to the peer.
+	blockOut    chan Reply            // Answers to the connection's requests, see Request.
+	serving     int                   // Requests passed on and not yet answered.
+	pendingUp   map[picker.Block]bool // Requests from the peer not yet served.
+	haveQ       chan struct{}         // Signalled when haves is added to.
+	haveMu      sync.Mutex            // Guards haves.
+	haves       []int                 // Pieces to announce, see Have.
+	chokeQ      chan bool             // Choke decisions, see SetChoked.
+	quit        chan struct{}         // Signals the peer to disconnect.
+
+	// Super-seeding, nil SuperSeeder when our pieces aren't hidden.
+	SuperSeeder SuperSeeder
+	revealed    map[int]bool     // Pieces announced to the peer.
+	offerQ      chan struct{}    // See OfferPiece.
+	superSeedQ  chan SuperSeeder // See SetSuperSeeder.
+
+	// Connection goroutines, see startIO.
+	stopLoops  context.CancelFunc
+	readQ      chan msg.Msg
+	readErr    chan error
+	outQ       chan msg.Msg
+	writerDone chan struct{}
+	writeErr   error           // Set by the writer before closing writerDone.
+	ctx        context.Context // Cancelled when the torrent stops, see Run.
+	dataQ      chan<- *torrent.BlockData
+	requestQ   chan<- Request
+	lastPiece  time.Time // When a requested block last arrived.
+	// Snub detection, see checkSnub.
+	Snubbed      bool      // Unchoked us but stopped sending blocks.
+	lastBlock    time.Time // When any block last arrived, or we were unchoked.
+	lastInterest time.Time // When either side was last interested.
+	MaxStrikes   int       // Strikes allowed before disconnecting.
+	Timeouts     Timeouts
+
+	// Request pipelining.
+	QueueTime   time.Duration              // Seconds of data to keep requested.
+	MaxRequests int                        // Cap on outstanding block requests.
+	maxRequests int                        // MaxRequests, lowered to this connection's reqq.
+	picker      *picker.Picker             // Shared piece picker.
+	requests    map[picker.Block]time.Time // Outstanding requests, by time sent.
+	cancelled   map[picker.Block]bool      // Requests cancelled in endgame.
+	cancelQ     chan picker.Block          // Requests to cancel, see Cancel.
+
+	// Fast Extension.
+	fast        bool         // Peer supports the Fast Extension.
+	numPieces   int          // Number of pieces in the torrent.
+	allowedFast map[int]bool // Pieces we may request while choked.
+	allowedOut  map[int]bool // Pieces the peer may request while choked.
+	suggested   map[int]bool // Pieces the peer suggested we download.
+
+	// Extension protocol.
+	Reserved      msg.Reserved     // Capabilities from the peer's handshake.
+	Extensions    *msg.Registry    // Extensions we support.
+	Port          int              // Port we listen on, 0 if not known.
+	ClientVersion string           // Client name and version, if sent.
+	Client        string           // Client identified from the above or the peer ID.
+	Reqq          int              // Outstanding requests the peer supports.
+	ListenPort    int              // Port the peer listens on, if sent.
+	UploadOnly    bool             // We want nothing more, sent as upload_only (BEP 21).
+	IsUploadOnly  bool             // The peer is a seed or partial seed.
+	uploadOnlyQ   chan struct{}    // See SetUploadOnly.
+	DHTPort       int              // Port of the peer's DHT node, if sent.
+	extIDs        msg.ExtensionIDs // The peer's extended message IDs.
 
 	Choked       bool
 	Interested   bool
 	IsChoking    bool
 	IsInterested bool
-	// UI elements.
-	Activity *tview.TextView
+	// Called with the peer's activity, see Log.
+	OnActivity func(Activity)
+	Logger     *logging.Logger
+
+	snapMu sync.Mutex
+	snap   Snapshot
+}
+
+// Snapshot is the peer's state as of its last event. The peer's fields
+// are only safe to read from its own goroutine, other goroutines, eg.
+// the choker, read a snapshot instead.
+type Snapshot struct {
+	Active       bool
+	Start        time.Time
+	Client       string
+	Downloaded   int // Bytes of block data, over every connection.
+	Uploaded     int
+	Downloading  bool
+	Choked       bool
+	IsChoking    bool
+	IsInterested bool
+	IsUploadOnly bool
+	Snubbed      bool
 }
 
+// Snapshot returns the peer's state, safe to call from any goroutine.
+func (p *Peer) Snapshot() Snapshot {
+	p.snapMu.Lock()
+	defer p.snapMu.Unlock()
+	return p.snap
+}
+
+// Publishes the peer's state for Snapshot, called from the peer's goroutine.
+func (p *Peer) publish() {
+	p.snapMu.Lock()
+	defer p.snapMu.Unlock()
+	p.snap = Snapshot{
+		Active:       p.Active,
+		Start:        p.Start,
+		Client:       p.Client,
+		Downloaded:   p.Rates.Downloaded,
+		Uploaded:     p.Rates.Uploaded,
+		Downloading:  p.Downloading,
+		Choked:       p.Choked,
+		IsChoking:    p.IsChoking,
+		IsInterested: p.IsInterested,
+		IsUploadOnly: p.IsUploadOnly,
+		Snubbed:      p.Snubbed,
+	}
+}
+
+// Request is a block requested by the peer, to be answered with
+// exactly one of Serve or Reject.
 type Request struct {
 	Peer   *Peer
 	Idx    int
 	Offset int
 	Length int
+	out    chan<- Reply // The connection's blockOut.
+}
+
+// NewRequest returns a request answered on out, peers make their own
+// and this is for serving blocks elsewhere, eg. in tests.
+func NewRequest(b picker.Block, out chan<- Reply) Request {
+	return Request{Idx: b.Index, Offset: b.Begin, Length: b.Length, out: out}
+}
+
+// Reply is a block read for a request, nil data if it was rejected.
+type Reply struct {
+	Block picker.Block
+	Data  []byte
+}
+
+// Serve sends the requested block to the peer.
+func (r Request) Serve(data []byte) {
+	// Never blocks, the peer passes on no more requests than fit.
+	r.out <- Reply{picker.Block{Index: r.Idx, Begin: r.Offset, Length: r.Length}, data}
+}
+
+// Reject tells the peer the block won't be sent, eg. we don't have it.
+func (r Request) Reject() {
+	r.out <- Reply{Block: picker.Block{Index: r.Idx, Begin: r.Offset, Length: r.Length}}
 }
 
 type Rates struct {
 	Downloaded int
 	Uploaded   int
 
-	LastDownloaded int
-	LastUploaded   int
+	DownRate   float64 // Smoothed download rate in bytes per second.
+	sampled    time.Time
+	sampleDown int
+}
+
+// Updates the smoothed download rate, at most once a second.
+func (r *Rates) sample() {
+	now := time.Now()
+	if r.sampled.IsZero() {
+		r.sampled = now
+		return
+	}
+	elapsed := now.Sub(r.sampled).Seconds()
+	if elapsed < 1 {
+		return
+	}
+	rate := float64(r.Downloaded-r.sampleDown) / elapsed
+	r.DownRate = 0.7*r.DownRate + 0.3*rate
+	r.sampleDown = r.Downloaded
+	r.sampled = now
 }
 
 func NewPeer(address *net.TCPAddr, bitfieldLength int) *Peer {
@@ -64,123 +241,171 @@ func NewPeer(address *net.TCPAddr, bitfieldLength int) *Peer {
 
 		Rates: &Rates{},
 
-		Activity: tview.NewTextView().
-			SetScrollable(true).
-			ScrollToEnd().
-			SetDynamicColors(true).
-			SetMaxLines(20),
+		UpLimit:   ratelimit.NewLimiter(ratelimit.Unlimited),
+		DownLimit: ratelimit.NewLimiter(ratelimit.Unlimited),
+
+		pendingUp: make(map[picker.Block]bool),
+		haveQ:     make(chan struct{}, 1),
+		chokeQ:    make(chan bool, 1),
+		quit:      make(chan struct{}, 1),
+		revealed:  make(map[int]bool),
+		offerQ:    make(chan struct{}, 1),
+
+		uploadOnlyQ: make(chan struct{}, 1),
+		superSeedQ:  make(chan SuperSeeder, 1),
+
+		QueueTime:   DefaultQueueTime,
+		MaxRequests: DefaultMaxRequests,
+		MaxStrikes:  DefaultMaxStrikes,
+		Timeouts:    DefaultTimeouts,
+		requests:    make(map[picker.Block]time.Time),
+		cancelled:   make(map[picker.Block]bool),
+		cancelQ:     make(chan picker.Block, 64),
+
+		allowedFast: make(map[int]bool),
+		allowedOut:  make(map[int]bool),
+		suggested:   make(map[int]bool),
 	}
-
-	p.Activity.
-		SetBorder(true).
-		SetTitle("Activity").
-		SetTitleAlign(tview.AlignLeft).
-		SetBorderPadding(1, 1, 2, 2)
-
 	return p
 }
 
-// Serialised message is written to peer connection.
-func (p *Peer) send(data []byte) error {
-	p.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-	_, err := p.Conn.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to send msg: %w", err)
-	}
-	// Update activity, blocks will clog feed.
-	if data[4] != 6 {
-		p.Activity.Write([]byte(fmt.Sprintf("==> %s\n\n", msg.MsgIDmap[data[4]])))
-	}
-	return nil
+// Creates a peer for a connection accepted by our listener.
+func NewInboundPeer(conn net.Conn, bitfieldLength int) *Peer {
+	p := NewPeer(tcpAddr(conn.RemoteAddr()), bitfieldLength)
+	p.Conn = conn
+	p.Inbound = true
+	return p
 }
 
-// Reads single message from peer connection.
-func (p *Peer) read() (*msg.Message, error) {
-	p.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	message := new(msg.Message)
-
-	buf := make([]byte, 4) // Length buffer.
-	if _, err := io.ReadFull(p.Conn, buf); err != nil {
-		return nil, err
-	}
-	message.Length = buf
-
-	length := binary.BigEndian.Uint32(message.Length)
-	if length == 0 { // Keep-alive message.
-		p.Activity.Write([]byte("<== keep-Alive\n\n"))
-		return nil, nil
+// Records that the peer has a piece, updating availability for the picker.
+func (p *Peer) setHave(idx int) {
+	if p.BitField.HasPiece(idx) {
+		return
 	}
+	p.BitField.SetPiece(idx)
+	p.picker.AddHave(idx)
+}
 
-	messageBuf := make([]byte, length)
-	if _, err := io.ReadFull(p.Conn, messageBuf); err != nil {
-		return nil, fmt.Errorf("failed to read message: %v", err)
-	}
+// Replaces the peer's bitfield, updating availability for the picker.
+func (p *Peer) setBitfield(bf msg.Bitfield) {
+	p.picker.RemoveBitfield(p.BitField)
+	p.BitField = make(msg.Bitfield, len(p.BitField))
+	copy(p.BitField, bf)
+	p.picker.AddBitfield(p.BitField)
+}
 
-	message.ID = messageBuf[0]
-	if message.ID > 7 {
-		return nil, fmt.Errorf("unknown message ID: %v", message.ID)
-	}
-	if length > 1 {
-		message.Payload = messageBuf[1:]
+// Tells the peer whether we are interested, ie. whether it has any
+// piece we still want.
+func (p *Peer) updateInterest() {
+	interested := p.picker.Wants(p.BitField)
+	if interested == p.Interested {
+		return
 	}
-	if message.ID != 7 { // Update activity, as long as not block, as they will clog feed.
-		p.Activity.Write([]byte(fmt.Sprintf("<== %s\n\n", msg.MsgIDmap[message.ID])))
+	p.Interested = interested
+	if interested {
+		p.send(msg.Interested{})
+	} else {
+		p.send(msg.NotInterested{})
 	}
-
-	return message, nil
 }
 
-// We read consecutive have msgs, stopping once we retrieve a non-have msg.
-func (p *Peer) handleHave(m *msg.Message) {
-	p.BitField.SetPiece(int(binary.BigEndian.Uint32(m.Payload[0:4])))
-	for {
-		m, err := p.read()
-		if err != nil {
-			return
-		}
-		if m.ID != 4 { // Not have.
-			p.handle(m)
-			return
-		}
-		p.BitField.SetPiece(int(binary.BigEndian.Uint32(m.Payload[0:4])))
-	}
+// Returns a bitfield of the same length with only idx set.
+func haveOnly(bf msg.Bitfield, idx int) msg.Bitfield {
+	only := make(msg.Bitfield, len(bf))
+	only.SetPiece(idx)
+	return only
 }
 
-// Generic message handler.
-func (p *Peer) handle(m *msg.Message) {
-	switch m.ID {
-	case 0: // Choke
+// Handles a message from the peer, this is the peer's state machine,
+// any message may arrive at any time once the handshake is done.
+func (p *Peer) handle(m msg.Msg) {
+	switch m := m.(type) {
+	case msg.Choke:
 		p.IsChoking = true
+		// Outstanding requests are discarded by a choking peer,
+		// unless it supports the Fast Extension, then they are rejected.
+		if !p.fast {
+			p.returnRequests()
+		}
 
-	case 1: // Unchoke
+	case msg.Unchoke:
+		// Blocks can't be expected before the peer unchokes us.
+		if p.IsChoking {
+			p.lastBlock = time.Now()
+		}
 		p.IsChoking = false
 
-	case 2: // Interested
-		if p.Downloading {
-			p.IsInterested = true
-			p.send(msg.Unchoke())
-		} else {
-			p.send(msg.Choke())
-		}
+	case msg.Interested:
+		p.IsInterested = true
+		p.updateChoke()
 
-	case 3: // Not interested
+	case msg.NotInterested:
 		p.IsInterested = false
 
-	case 4: // Have
-		p.handleHave(m)
+	case msg.Have:
+		p.setHave(m.Index)
+		if !p.Interested && p.picker.Wants(haveOnly(p.BitField, m.Index)) {
+			p.updateInterest()
+		}
+		if p.SuperSeeder != nil {
+			p.SuperSeeder.Seen(p.IP.String(), m.Index)
+		}
 
-	case 5: // Bitfield
-		p.BitField = msg.Bitfield(m.Payload)
+	case msg.Bitfield:
+		p.setBitfield(m)
+		p.updateInterest()
+
+	case msg.Request:
+		p.handleRequest(m)
+
+	case msg.Piece:
+		p.handlePiece(m)
+
+	case msg.Cancel:
+		delete(p.pendingUp, picker.Block(m))
+
+	case msg.Port:
+		p.DHTPort = int(m.Port)
+
+	case msg.SuggestPiece, msg.HaveAll, msg.HaveNone, msg.RejectRequest, msg.AllowedFast:
+		p.handleFast(m)
+
+	case msg.Extended:
+		if err := p.handleExtended(m); err != nil {
+			p.Log(ActivityError, "%v", err)
+		}
 
 	default:
 		return
 	}
 }
 
+// Chokes or unchokes the peer to match whether we upload to it.
+func (p *Peer) updateChoke() {
+	switch {
+	case p.Downloading && p.Choked:
+		p.Choked = false
+		p.send(msg.Unchoke{})
+
+	case !p.Downloading && !p.Choked:
+		p.Choked = true
+		p.send(msg.Choke{})
+		// Pending requests are discarded, fast peers are told.
+		for b := range p.pendingUp {
+			if p.allowedOut[b.Index] {
+				continue
+			}
+			delete(p.pendingUp, b)
+			if p.fast {
+				p.send(msg.RejectRequest(b))
+			}
+		}
+	}
+}
+
 func (p *Peer) exchangeHandshake(ID, infoHash [20]byte) error {
 
-	p.Conn.SetDeadline(time.Now().Add(20 * time.Second))
+	p.Conn.SetDeadline(time.Now().Add(p.Timeouts.Handshake))
 
 	// send handshake message.
 	_, err := p.Conn.Write(msg.Handshake(ID, infoHash))
@@ -190,96 +415,170 @@ func (p *Peer) exchangeHandshake(ID, infoHash [20]byte) error {
 
 	// Receive handshake message.
 	buf := make([]byte, 68)
-	if _, err = p.Conn.Read(buf); err != nil {
+	if _, err = io.ReadFull(p.Conn, buf); err != nil {
 		return fmt.Errorf("error receiving handshake: %w", err)
 	}
 
 	// Check if handshake is valid, if so return the peer's ID.
-	peerID, err := msg.VerifyHandshake(buf, infoHash)
+	peerID, reserved, err := msg.VerifyHandshake(buf, infoHash)
 	if err != nil {
 		return err
 	}
 
-	p.Activity.Write([]byte("[green]handshake successful.[-]\n\n"))
+	p.Log(ActivityOK, "handshake successful.")
 	p.PeerID = peerID
+	p.Client = peerid.Identify(peerID, "")
+	p.Reserved = reserved
+	p.fast = reserved.Has(msg.Fast) && msg.Supported.Has(msg.Fast)
 	return nil
 }
 
-// Establish peer ensures a verified connection to a peer
-// and that we have information about what pieces the peer has.
-func (p *Peer) establishPeer(ID, infoHash [20]byte) error {
+// Dials the peer, negotiating encryption according to the peer's policy.
+// When encryption is preferred, a plaintext connection is tried if it fails.
+func (p *Peer) connect(infoHash [20]byte) (net.Conn, error) {
 
-	// Connect to peer.
-	conn, err := net.DialTimeout("tcp", p.IP.String(), 10*time.Second)
-	if err != nil {
-		return err
+	transports := []string{"tcp"}
+	if p.UTP != nil {
+		if p.PreferUTP {
+			transports = []string{"utp", "tcp"}
+		} else {
+			transports = []string{"tcp", "utp"}
+		}
 	}
 
-	tcpConn := conn.(*net.TCPConn)
-	if err := tcpConn.SetKeepAlive(true); err != nil {
-		return err
+	var err error
+	for _, transport := range transports {
+		var conn net.Conn
+		conn, err = p.connectOver(transport, infoHash)
+		if err == nil {
+			return conn, nil
+		}
+		p.Log(ActivityError, "%s: %v.", transport, err)
 	}
-	p.Conn = tcpConn
+	return nil, err
+}
 
-	if err := p.exchangeHandshake(ID, infoHash); err != nil {
-		return err
+// Connects over a single transport, negotiating encryption if enabled.
+func (p *Peer) connectOver(transport string, infoHash [20]byte) (net.Conn, error) {
+
+	dial := func() (net.Conn, error) {
+		if transport == "utp" {
+			return p.UTP.Dial(p.IP.String(), 5*time.Second)
+		}
+		d := net.Dialer{Timeout: p.Timeouts.Dial}
+		conn, err := d.DialContext(p.ctx, "tcp", p.IP.String())
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.(*net.TCPConn).SetKeepAlive(true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
 	}
-	// Peers will then send messages about what pieces they have.
-	// This can come in many forms, eg bitfield or have msgs.
-	// This is where we will parse the message and set the peer's bitfield.
-	if err := p.buildBitfield(); err != nil {
-		return err
+
+	conn, err := dial()
+	if err != nil || p.Encryption == mse.Disabled {
+		return conn, err
 	}
-	// send intent to download from peer.
-	p.send(msg.Interested())
 
-	// TODO: Maybe add condition for if unchoke already received.
-	// Wait for unchoke from peer.
-	message, err := p.read()
-	if err != nil {
-		return err
+	conn.SetDeadline(time.Now().Add(p.Timeouts.Handshake))
+	stop := closeOnCancel(p.ctx, conn)
+	encrypted, err := mse.Initiate(conn, infoHash, p.Encryption.Methods())
+	stop()
+	if err == nil {
+		p.Log(ActivityOK, "connection encrypted.")
+		return encrypted, nil
+	}
+	conn.Close()
+	if p.Encryption == mse.Require {
+		return nil, err
 	}
-	// Sometimes peers will annoyingly send have messages after bitfields.
-	// However we should be expecting an unchoke message.
-	p.handle(message)
 
-	p.Activity.Write([]byte("[green]peer established.[-]\n\n"))
-	return nil
+	p.Log(ActivityError, "%v, retrying in plaintext.", err)
+	return dial()
+}
+
+// Peers are keyed by TCP address, uTP peers listen on the same port over UDP.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a
+	case *net.UDPAddr:
+		return &net.TCPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	}
+	return &net.TCPAddr{}
 }
 
-// buildBitfield parses the message and sets the peer's bitfield.
-func (p *Peer) buildBitfield() error {
+// Establish peer ensures a verified connection to a peer
+// and tells it what pieces we have.
+func (p *Peer) establishPeer(ID, infoHash [20]byte) error {
 
-	message, err := p.read()
-	if err != nil {
+	// Connect to peer, inbound peers are already connected.
+	if !p.Inbound {
+		if p.Filter.Blocked(p.IP.IP) {
+			return errFiltered
+		}
+		conn, err := p.connect(infoHash)
+		if err != nil {
+			return err
+		}
+		if err := p.ctx.Err(); err != nil { // uTP dials can't be cancelled.
+			conn.Close()
+			return err
+		}
+		p.Conn = conn
+	}
+	defer closeOnCancel(p.ctx, p.Conn)()
+	// Large torrents have bitfields over the default frame size.
+	maxFrame := msg.DefaultMaxFrame
+	if len(p.BitField)+1 > maxFrame {
+		maxFrame = len(p.BitField) + 1
+	}
+	p.reader = msg.NewReader(p.Conn, maxFrame)
+	p.writer = msg.NewWriter(p.Conn)
+
+	if err := p.exchangeHandshake(ID, infoHash); err != nil {
 		return err
 	}
-	// Case of have or bitfield.
-	if message.ID == 4 || message.ID == 5 {
-		p.handle(message)
+	// From here on messages are exchanged by the connection's goroutines.
+	p.startIO()
 
-	} else if message.ID == 1 { // If peer is unchoking, try again.
-		p.handle(message)
-		if err := p.buildBitfield(); err != nil {
+	if p.Reserved.Has(msg.Extension) {
+		if err := p.sendExtendedHandshake(); err != nil {
 			return err
 		}
-
-	} else {
-		p.handle(message)
-		return fmt.Errorf("expected user piece info, got: %v", msg.MsgIDmap[message.ID])
 	}
+	if err := p.sendPieces(infoHash); err != nil {
+		return err
+	}
+	// Interest is declared once the peer's pieces arrive in the main loop.
+
+	p.Log(ActivityOK, "peer established.")
 	return nil
 }
 
 func (p *Peer) disconnect() {
-	p.Conn.Close()
+	p.stopIO()
+	p.Inbound = false
+	p.returnRequests()
+	p.pendingUp = make(map[picker.Block]bool)
+	// Peer's pieces are no longer available.
+	p.picker.RemoveBitfield(p.BitField)
+	p.BitField = make(msg.Bitfield, len(p.BitField))
 	// Reset defaults.
 	p.Active = false
+	p.Downloading = false
 	p.Choked = true
 	p.IsChoking = true
 	p.strikes = 0
 	p.Interested = false
 	p.Start = time.Now()
+	p.allowedFast = make(map[int]bool)
+	p.allowedOut = make(map[int]bool)
+	p.suggested = make(map[int]bool)
+	p.extIDs = nil
+	p.publish()
 
-	p.Activity.Write([]byte("[red]peer disconnected.[-]\n\n"))
+	p.Log(ActivityError, "peer disconnected.")
 }
@@ -0,0 +1,246 @@
+package peerid
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+/* Peer IDs are 20 bytes, most clients start theirs with a tag naming
+ * the client and its version. Two conventions are common:
+ *
+ * Azureus style: '-', two letter client code, four version characters, '-'.
+ *                eg. -qB4250- is qBittorrent 4.2.5.
+ * Shad0w style:  one letter client code, up to five version characters
+ *                padded with dashes, then "---". eg. T03I------ is BitTornado 0.3.18.
+ *
+ * Mainline uses its own: M4-3-6-- is BitTorrent 4.3.6.
+ */
+
+// Prefix identifies this client, version 0.1.0.
+const Prefix = "-GT0100-"
+
+// Characters used for the random part of the ID, some trackers
+// reject IDs that aren't printable.
+const idChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Longest client name taken from a peer's "v" field, in characters.
+const maxNameLength = 64
+
+// Client codes of Azureus style IDs.
+var azureus = map[string]string{
+	"7T": "aTorrent",
+	"AG": "Ares",
+	"AR": "Arctic",
+	"AT": "Artemis",
+	"AX": "BitPump",
+	"AZ": "Azureus",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BE": "BitTorrent SDK",
+	"BF": "Bitflu",
+	"BI": "BiglyBT",
+	"BL": "BitCometLite",
+	"BR": "BitRocket",
+	"BT": "BitTorrent",
+	"BW": "BitWombat",
+	"CD": "Enhanced CTorrent",
+	"CT": "CTorrent",
+	"DE": "Deluge",
+	"DP": "Propagate Data Client",
+	"EB": "EBit",
+	"ES": "Electric Sheep",
+	"FD": "Free Download Manager",
+	"FT": "FoxTorrent",
+	"GS": "GSTorrent",
+	"GT": "BitTorrent-Go",
+	"HL": "Halite",
+	"HN": "Hydranode",
+	"KG": "KGet",
+	"KT": "KTorrent",
+	"LH": "LH-ABC",
+	"LP": "Lphant",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"LW": "LimeWire",
+	"MO": "MonoTorrent",
+	"MP": "MooPolice",
+	"MR": "Miro",
+	"MT": "MoonlightTorrent",
+	"NX": "Net Transport",
+	"PD": "Pando",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"QD": "QQDownload",
+	"QT": "Qt 4 Torrent",
+	"RT": "Retriever",
+	"SB": "Swiftbit",
+	"SD": "Thunder",
+	"SS": "SwarmScope",
+	"ST": "SymTorrent",
+	"st": "sharktorrent",
+	"SZ": "Shareaza",
+	"TL": "Tribler",
+	"TN": "TorrentDotNET",
+	"TR": "Transmission",
+	"TS": "Torrentstorm",
+	"TT": "TuoTu",
+	"UL": "uLeecher!",
+	"UM": "µTorrent for Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"VG": "Vagaa",
+	"WD": "WebTorrent Desktop",
+	"WT": "BitLet",
+	"WW": "WebTorrent",
+	"WY": "FireTorrent",
+	"XL": "Xunlei",
+	"XT": "XanTorrent",
+	"XX": "Xtorrent",
+	"ZT": "ZipTorrent",
+}
+
+// Client codes of Shad0w style IDs.
+var shadow = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shad0w",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// New returns a peer ID made of Prefix and random characters.
+func New() ([20]byte, error) {
+	var id [20]byte
+	n := copy(id[:], Prefix)
+	if _, err := rand.Read(id[n:]); err != nil {
+		return id, fmt.Errorf("failed to generate peer id: %w", err)
+	}
+	for i := n; i < len(id); i++ {
+		id[i] = idChars[int(id[i])%len(idChars)]
+	}
+	return id, nil
+}
+
+// Identify names the client behind a peer, from the "v" field of its
+// extended handshake if sent, otherwise from its peer ID.
+// Unknown clients are "unknown".
+func Identify(id [20]byte, v string) string {
+	if v = clean(v); v != "" {
+		return v
+	}
+	if name, ok := parseAzureus(id); ok {
+		return name
+	}
+	if name, ok := parseMainline(id); ok {
+		return name
+	}
+	if name, ok := parseShadow(id); ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Drops unprintable characters from a name sent by a peer, cutting it
+// to maxNameLength.
+func clean(v string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range strings.TrimSpace(v) {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			continue
+		}
+		if n == maxNameLength {
+			break
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// Parses -XXabcd-, versions are usually one digit per part, though
+// some clients use letters for parts over nine.
+func parseAzureus(id [20]byte) (string, bool) {
+	if id[0] != '-' || id[7] != '-' {
+		return "", false
+	}
+	code := string(id[1:3])
+	name, ok := azureus[code]
+	if !ok {
+		return "", false
+	}
+	v := id[3:7]
+	switch code {
+	// Transmission uses 3 digits for the minor version, then a flag.
+	case "TR":
+		minor := strings.TrimLeft(part(v[1])+part(v[2]), "0")
+		if minor == "" {
+			minor = "0"
+		}
+		return fmt.Sprintf("%s %s.%s", name, part(v[0]), minor), true
+	// µTorrent and BitTorrent end with a release type, eg. B for beta.
+	case "UT", "UM", "UW", "BT":
+		return fmt.Sprintf("%s %s.%s.%s", name, part(v[0]), part(v[1]), part(v[2])), true
+	}
+	parts := []string{part(v[0]), part(v[1]), part(v[2])}
+	if v[3] != '0' {
+		parts = append(parts, part(v[3]))
+	}
+	return name + " " + strings.Join(parts, "."), true
+}
+
+// Parses Mainline IDs, eg. M4-3-6-- or M10-0-0-.
+func parseMainline(id [20]byte) (string, bool) {
+	if id[0] != 'M' {
+		return "", false
+	}
+	parts := strings.SplitN(string(id[1:8]), "-", 4)
+	if len(parts) < 3 {
+		return "", false
+	}
+	for _, p := range parts[:3] {
+		if p == "" || strings.Trim(p, "0123456789") != "" {
+			return "", false
+		}
+	}
+	return "Mainline " + strings.Join(parts[:3], "."), true
+}
+
+// Parses Shad0w style IDs, eg. T03I------.
+func parseShadow(id [20]byte) (string, bool) {
+	name, ok := shadow[id[0]]
+	if !ok || string(id[6:9]) != "---" {
+		return "", false
+	}
+	var parts []string
+	for _, c := range id[1:6] {
+		if c == '-' {
+			break
+		}
+		if strings.IndexByte(idChars, c) < 0 {
+			return "", false
+		}
+		parts = append(parts, part(c))
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	return name + " " + strings.Join(parts, "."), true
+}
+
+// Decodes a version character, 0-9 then A-Z and a-z for 10 onwards.
+func part(c byte) string {
+	switch {
+	case c >= '0' && c <= '9':
+		return string(c)
+	case c >= 'A' && c <= 'Z':
+		return fmt.Sprint(int(c-'A') + 10)
+	case c >= 'a' && c <= 'z':
+		return fmt.Sprint(int(c-'a') + 36)
+	}
+	return "?"
+}
@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	msg "github.com/0xNathanW/bittorrent-go/p2p/message"
+)
+
+// ---------------------------- Super-seeding ---------------------------//
+
+/* While super-seeding (BEP 16) our bitfield is hidden and pieces are
+ * revealed one at a time with Have messages. A peer is only offered
+ * another piece once the last one it was offered turns up at a different
+ * peer, so upload goes to peers that pass pieces on.
+ */
+
+// SuperSeeder chooses the pieces revealed to peers while super-seeding.
+type SuperSeeder interface {
+	// Offer returns the next piece to reveal to the peer, or -1.
+	Offer(peer string, has msg.Bitfield) int
+	// Seen is called when the peer announces having a piece.
+	Seen(peer string, idx int)
+}
+
+// OfferPiece asks the peer to reveal its next piece, once the piece
+// it was last offered has propagated.
+func (p *Peer) OfferPiece() {
+	select {
+	case p.offerQ <- struct{}{}:
+	default: // Already pending.
+	}
+}
+
+// SetSuperSeeder starts super-seeding to a connected peer with s,
+// or with nil ends it, announcing every piece we have that it doesn't.
+func (p *Peer) SetSuperSeeder(s SuperSeeder) {
+	// Only the latest setting matters.
+	select {
+	case <-p.superSeedQ:
+	default:
+	}
+	select {
+	case p.superSeedQ <- s:
+	default:
+	}
+}
+
+// Applies a change made by SetSuperSeeder.
+func (p *Peer) setSuperSeeder(s SuperSeeder) {
+	switch {
+	case s == nil:
+		p.revealAll()
+	case p.SuperSeeder == nil:
+		// Pieces already announced can still be requested,
+		// the rest are offered from now on.
+		p.SuperSeeder = s
+		p.offer()
+	default:
+		p.SuperSeeder = s
+	}
+}
+
+// Reveals the piece chosen by the super-seeder.
+func (p *Peer) offer() {
+	if p.SuperSeeder == nil {
+		return
+	}
+	idx := p.SuperSeeder.Offer(p.IP.String(), p.BitField)
+	if idx < 0 || p.revealed[idx] {
+		return
+	}
+	p.revealed[idx] = true
+	if err := p.send(msg.Have{Index: idx}); err == nil {
+		p.Log(ActivityInfo, "offered piece %d.", idx)
+	}
+}
+
+// Announces the pieces hidden by super-seeding.
+func (p *Peer) revealAll() {
+	if p.SuperSeeder == nil {
+		return
+	}
+	p.SuperSeeder = nil
+	have := p.picker.Bitfield()
+	for idx := 0; idx < p.numPieces; idx++ {
+		if have.HasPiece(idx) && !p.BitField.HasPiece(idx) && !p.revealed[idx] {
+			p.revealed[idx] = true
+			if err := p.send(msg.Have{Index: idx}); err != nil {
+				return
+			}
+		}
+	}
+}
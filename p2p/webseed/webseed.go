@@ -0,0 +1,314 @@
+package webseed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	msg "github.com/0xNathanW/bittorrent-go/p2p/message"
+	"github.com/0xNathanW/bittorrent-go/picker"
+	"github.com/0xNathanW/bittorrent-go/ratelimit"
+	"github.com/0xNathanW/bittorrent-go/torrent"
+)
+
+/* Web seeds (BEP 19) are HTTP servers hosting the torrent's files,
+ * listed in the torrent's url-list. Blocks are picked like any peer's,
+ * then fetched with Range requests against the files they fall in.
+ *
+ * A URL ending in '/' is a directory, the torrent's name is appended,
+ * and for multi-file torrents each file's path after that.
+ */
+
+const (
+	// Blocks picked at once, contiguous blocks are fetched in one request.
+	queueLength = 16
+	// Time to wait when there is nothing left to pick.
+	idleWait = time.Second
+	// Backoff after failed requests, doubling up to the maximum.
+	minBackoff = 30 * time.Second
+	maxBackoff = 30 * time.Minute
+	// Time allowed for a single request.
+	requestTimeout = time.Minute
+)
+
+var errStopped = errors.New("web seed stopped")
+
+// WebSeed downloads pieces from an HTTP server as if it were a peer
+// with every piece.
+type WebSeed struct {
+	URL        string
+	Client     *http.Client
+	DownLimits ratelimit.Group // Bandwidth limits shared with peers.
+	Downloaded int             // Bytes of block data received.
+
+	t        *torrent.Torrent
+	picker   *picker.Picker
+	has      msg.Bitfield
+	failures int // Consecutive failed requests.
+	stop     chan struct{}
+}
+
+// A span of a single file covering part of a block run.
+type segment struct {
+	url    string
+	offset int // Within the file.
+	length int
+}
+
+// New returns a web seed for the torrent at rawURL, only http and https
+// URLs are supported.
+func New(rawURL string, t *torrent.Torrent, pk *picker.Picker) (*WebSeed, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid web seed url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported web seed scheme: %s", u.Scheme)
+	}
+
+	has := make(msg.Bitfield, (len(t.Pieces)+7)/8)
+	for i := range t.Pieces {
+		has.SetPiece(i)
+	}
+	return &WebSeed{
+		URL:    rawURL,
+		Client: &http.Client{Timeout: requestTimeout},
+		t:      t,
+		picker: pk,
+		has:    has,
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+// Run fetches picked blocks and passes them on to dataQ until the
+// download completes or the web seed is stopped.
+func (w *WebSeed) Run(dataQ chan<- *torrent.BlockData) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-w.stop
+		cancel()
+	}()
+	// Blocks still in flight are put back for peers to pick.
+	defer w.picker.ReturnAll(w.URL)
+
+	for !w.picker.Complete() {
+		blocks := w.picker.Pick(w.URL, w.has, queueLength)
+		if len(blocks) == 0 {
+			if !w.wait(idleWait) {
+				return
+			}
+			continue
+		}
+
+		err := w.fetch(ctx, blocks, dataQ)
+		if errors.Is(err, errStopped) {
+			return
+		}
+		if err != nil {
+			w.picker.ReturnAll(w.URL)
+			w.failures++
+			if !w.wait(w.backoff(err)) {
+				return
+			}
+			continue
+		}
+		w.failures = 0
+	}
+}
+
+// Stop ends Run, it must only be called once.
+func (w *WebSeed) Stop() {
+	close(w.stop)
+}
+
+// Sleeps for d, reporting false if stopped first.
+func (w *WebSeed) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.stop:
+		return false
+	}
+}
+
+// Time to wait after a failure, servers may say how long themselves.
+func (w *WebSeed) backoff(err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return statusErr.RetryAfter
+	}
+	d := minBackoff
+	for i := 1; i < w.failures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// Fetches blocks, grouped into runs of contiguous data.
+func (w *WebSeed) fetch(ctx context.Context, blocks []picker.Block, dataQ chan<- *torrent.BlockData) error {
+	sort.Slice(blocks, func(i, j int) bool {
+		return w.offset(blocks[i]) < w.offset(blocks[j])
+	})
+	for len(blocks) > 0 {
+		n := 1
+		for n < len(blocks) && w.offset(blocks[n]) == w.offset(blocks[n-1])+blocks[n-1].Length {
+			n++
+		}
+		if err := w.fetchRun(ctx, blocks[:n], dataQ); err != nil {
+			return err
+		}
+		blocks = blocks[n:]
+	}
+	return nil
+}
+
+// Fetches contiguous blocks, then passes each on to dataQ.
+func (w *WebSeed) fetchRun(ctx context.Context, run []picker.Block, dataQ chan<- *torrent.BlockData) error {
+	begin := w.offset(run[0])
+	last := run[len(run)-1]
+	length := w.offset(last) + last.Length - begin
+
+	data := make([]byte, 0, length)
+	for _, seg := range w.segments(begin, length) {
+		var err error
+		data, err = w.get(ctx, seg, data)
+		if err != nil {
+			return err
+		}
+	}
+	if w.DownLimits.Wait(ctx, len(data)) != nil {
+		return errStopped
+	}
+
+	for _, b := range run {
+		block := &torrent.BlockData{
+			Index: b.Index,
+			Begin: b.Begin,
+			Data:  data[:b.Length:b.Length],
+			Peer:  w.URL,
+		}
+		data = data[b.Length:]
+		select {
+		case dataQ <- block:
+			w.Downloaded += b.Length
+		case <-w.stop:
+			return errStopped
+		}
+	}
+	return nil
+}
+
+// Appends a segment of a file to buf.
+func (w *WebSeed) get(ctx context.Context, seg segment, buf []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, seg.url, nil)
+	if err != nil {
+		return buf, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.offset, seg.offset+seg.length-1))
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return buf, errStopped
+		}
+		return buf, fmt.Errorf("web seed request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	// Servers that ignore Range send the whole file, which is
+	// only usable if that's what was asked for.
+	case resp.StatusCode == http.StatusOK && seg.offset == 0 && resp.ContentLength == int64(seg.length):
+	default:
+		return buf, newStatusError(resp)
+	}
+
+	n := len(buf)
+	buf = buf[:n+seg.length]
+	if _, err := io.ReadFull(resp.Body, buf[n:]); err != nil {
+		if ctx.Err() != nil {
+			return buf[:n], errStopped
+		}
+		return buf[:n], fmt.Errorf("web seed response cut short: %w", err)
+	}
+	return buf, nil
+}
+
+// Position of a block within the torrent's data.
+func (w *WebSeed) offset(b picker.Block) int {
+	return b.Index*w.t.PieceLength + b.Begin
+}
+
+// Maps a span of the torrent's data onto the files it covers.
+func (w *WebSeed) segments(begin, length int) []segment {
+	if len(w.t.Files) == 0 {
+		return []segment{{url: w.fileURL(nil), offset: begin, length: length}}
+	}
+	var segs []segment
+	start := 0 // Of the current file, within the torrent.
+	for _, f := range w.t.Files {
+		end := start + f.Length
+		// Empty files hold no data, there's nothing to request.
+		if f.Length > 0 && begin < end && begin+length > start {
+			lo, hi := begin, begin+length
+			if lo < start {
+				lo = start
+			}
+			if hi > end {
+				hi = end
+			}
+			segs = append(segs, segment{url: w.fileURL(f.Parts), offset: lo - start, length: hi - lo})
+		}
+		start = end
+	}
+	return segs
+}
+
+// URL of a file, parts is nil for single file torrents.
+func (w *WebSeed) fileURL(parts []string) string {
+	if len(parts) == 0 && !strings.HasSuffix(w.URL, "/") {
+		return w.URL
+	}
+	escaped := []string{url.PathEscape(w.t.Name)}
+	for _, p := range parts {
+		escaped = append(escaped, url.PathEscape(p))
+	}
+	base := w.URL
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + path.Join(escaped...)
+}
+
+// StatusError is an HTTP response other than the data requested.
+type StatusError struct {
+	Status     string
+	RetryAfter time.Duration // Set if the server asked us to wait.
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	err := &StatusError{Status: resp.Status}
+	if secs, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil && secs > 0 {
+		err.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return err
+}
+
+func (e *StatusError) Error() string {
+	return "web seed responded " + e.Status
+}
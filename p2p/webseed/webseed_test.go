@@ -0,0 +1,324 @@
+package webseed
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/0xNathanW/bittorrent-go/picker"
+	"github.com/0xNathanW/bittorrent-go/torrent"
+)
+
+const (
+	testPieceLength = 32 * 1024
+	testBlockSize   = 8 * 1024
+)
+
+// Serves files by path, honouring Range requests.
+type server struct {
+	*httptest.Server
+	files map[string][]byte
+	// Lets a test change a response, returning true if it was written.
+	handle   func(w http.ResponseWriter, r *http.Request) bool
+	mu       sync.Mutex
+	requests []string
+}
+
+func newServer(t *testing.T, files map[string][]byte, handle func(w http.ResponseWriter, r *http.Request) bool) *server {
+	s := &server{files: files, handle: handle}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.URL.Path)
+		s.mu.Unlock()
+		if s.handle != nil && s.handle(w, r) {
+			return
+		}
+		data, ok := s.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *server) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Builds a torrent of files with the given lengths, or a single file
+// if lengths has one entry, returning it and its data.
+func newTorrent(name string, paths []string, lengths []int) (*torrent.Torrent, []byte) {
+	rng := rand.New(rand.NewSource(1))
+	t := &torrent.Torrent{Name: name, PieceLength: testPieceLength}
+	for i, n := range lengths {
+		t.Size += n
+		if paths != nil {
+			parts := strings.Split(paths[i], "/")
+			t.Files = append(t.Files, torrent.File{Path: parts[0], Parts: parts, Length: n})
+		}
+	}
+	data := make([]byte, t.Size)
+	rng.Read(data)
+	for start := 0; start < len(data); start += testPieceLength {
+		end := start + testPieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		t.Pieces = append(t.Pieces, sha1.Sum(data[start:end]))
+	}
+	return t, data
+}
+
+func newPicker(t *torrent.Torrent) *picker.Picker {
+	pk := picker.New(t)
+	pk.SetBlockSize(testBlockSize)
+	return pk
+}
+
+// Runs a web seed until every piece is verified, as the client does,
+// returning the data and the number of pieces that failed verification.
+func download(t *testing.T, rawURL string, tor *torrent.Torrent, pk *picker.Picker) ([]byte, int) {
+	t.Helper()
+	w, err := New(rawURL, tor, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataQ := make(chan *torrent.BlockData)
+	done := make(chan struct{})
+	go func() {
+		w.Run(dataQ)
+		close(done)
+	}()
+	defer func() {
+		w.Stop()
+		<-done
+	}()
+
+	buf := make([]byte, tor.Size)
+	failed := 0
+	timeout := time.After(10 * time.Second)
+	for !pk.Complete() {
+		var block *torrent.BlockData
+		select {
+		case block = <-dataQ:
+		case <-timeout:
+			t.Fatalf("download timed out, %d of %d pieces", pk.NumDone(), len(tor.Pieces))
+		}
+		b := picker.Block{Index: block.Index, Begin: block.Begin, Length: len(block.Data)}
+		_, complete, ok := pk.Received(block.Peer, b)
+		if !ok {
+			continue
+		}
+		start, end, err := tor.PiecePosition(block.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(buf[start+block.Begin:end], block.Data)
+		if !complete {
+			continue
+		}
+		if sha1.Sum(buf[start:end]) != tor.Pieces[block.Index] {
+			pk.PieceFailed(block.Index)
+			failed++
+			continue
+		}
+		pk.PieceDone(block.Index)
+	}
+	return buf, failed
+}
+
+func TestSingleFile(t *testing.T) {
+	tor, data := newTorrent("file name.bin", nil, []int{3*testPieceLength + 1234})
+	srv := newServer(t, map[string][]byte{"/file name.bin": data}, nil)
+
+	for _, rawURL := range []string{
+		srv.URL + "/file%20name.bin", // The file itself.
+		srv.URL + "/",                // A directory, the name is appended.
+	} {
+		got, failed := download(t, rawURL, tor, newPicker(tor))
+		if failed != 0 || !bytes.Equal(got, data) {
+			t.Errorf("%s: data differs, %d pieces failed", rawURL, failed)
+		}
+	}
+	for _, path := range srv.requested() {
+		if path != "/file name.bin" {
+			t.Errorf("requested %q", path)
+		}
+	}
+}
+
+func TestMultiFile(t *testing.T) {
+	paths := []string{"a.txt", "dir/b c.txt", "dir/sub/d.txt", "e.txt"}
+	lengths := []int{1000, testPieceLength, 0, 2*testPieceLength + 77}
+	tor, data := newTorrent("multi", paths, lengths)
+
+	files := make(map[string][]byte)
+	start := 0
+	for i, p := range paths {
+		files["/multi/"+p] = data[start : start+lengths[i]]
+		start += lengths[i]
+	}
+	srv := newServer(t, files, nil)
+
+	for _, rawURL := range []string{srv.URL + "/", srv.URL} {
+		got, failed := download(t, rawURL, tor, newPicker(tor))
+		if failed != 0 || !bytes.Equal(got, data) {
+			t.Errorf("%s: data differs, %d pieces failed", rawURL, failed)
+		}
+	}
+	for _, path := range srv.requested() {
+		if _, ok := files[path]; !ok || path == "/multi/dir/sub/d.txt" {
+			t.Errorf("requested %q", path)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	paths := []string{"a", "b/c", "d"}
+	tor, _ := newTorrent("multi", paths, []int{100, 0, 50})
+	w, err := New("http://example.com/seed/", tor, newPicker(tor))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A span crossing from the first file, past the empty one, into the last.
+	got := w.segments(90, 20)
+	want := []segment{
+		{url: "http://example.com/seed/multi/a", offset: 90, length: 10},
+		{url: "http://example.com/seed/multi/d", offset: 0, length: 10},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d segments, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("segment %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// Servers ignoring Range answer 200 with the whole file.
+func TestRangeIgnored(t *testing.T) {
+	tor, data := newTorrent("file", nil, []int{testPieceLength + 10})
+	srv := newServer(t, nil, func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+		return true
+	})
+	w, err := New(srv.URL+"/file", tor, newPicker(tor))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := w.get(context.Background(), segment{url: w.URL, offset: 0, length: len(data)}, make([]byte, 0, len(data)))
+	if err != nil {
+		t.Fatalf("whole file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("whole file: data differs")
+	}
+
+	var statusErr *StatusError
+	_, err = w.get(context.Background(), segment{url: w.URL, offset: 10, length: 100}, make([]byte, 0, 100))
+	if !errors.As(err, &statusErr) {
+		t.Errorf("part of file: got %v, want a StatusError", err)
+	}
+}
+
+// Responds 503, with Retry-After if retryAfter is set.
+func unavailable(t *testing.T, tor *torrent.Torrent, retryAfter string) error {
+	srv := newServer(t, nil, func(w http.ResponseWriter, r *http.Request) bool {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	})
+	pk := newPicker(tor)
+	w, err := New(srv.URL+"/file", tor, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.fetch(context.Background(), pk.Pick(w.URL, w.has, queueLength), nil)
+}
+
+func TestRetryAfter(t *testing.T) {
+	tor, _ := newTorrent("file", nil, []int{testPieceLength})
+	w, err := New("http://example.com/file", tor, newPicker(tor))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = unavailable(t, tor, "120")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.RetryAfter != 2*time.Minute {
+		t.Fatalf("got %v, want a StatusError to retry after 2m", err)
+	}
+	w.failures = 5
+	if d := w.backoff(err); d != 2*time.Minute {
+		t.Errorf("backoff %v, want the server's 2m", d)
+	}
+
+	err = unavailable(t, tor, "")
+	if !errors.As(err, &statusErr) || statusErr.RetryAfter != 0 {
+		t.Fatalf("got %v, want a StatusError without retry after", err)
+	}
+	for failures, want := range map[int]time.Duration{
+		1:  minBackoff,
+		2:  2 * minBackoff,
+		3:  4 * minBackoff,
+		20: maxBackoff,
+	} {
+		w.failures = failures
+		if d := w.backoff(err); d != want {
+			t.Errorf("%d failures: backoff %v, want %v", failures, d, want)
+		}
+	}
+}
+
+// A corrupt response fails verification, the piece is fetched again.
+func TestHashFailure(t *testing.T) {
+	tor, data := newTorrent("file", nil, []int{2 * testPieceLength})
+	var corrupted sync.Once
+	srv := newServer(t, map[string][]byte{"/file": data}, func(w http.ResponseWriter, r *http.Request) bool {
+		written := false
+		corrupted.Do(func() {
+			bad := append([]byte(nil), data...)
+			for i := range bad {
+				bad[i] ^= 0xff
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(bad))
+			written = true
+		})
+		return written
+	})
+
+	got, failed := download(t, srv.URL+"/file", tor, newPicker(tor))
+	if failed == 0 {
+		t.Error("no piece failed verification")
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data differs")
+	}
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	tor, _ := newTorrent("file", nil, []int{10})
+	if _, err := New("ftp://example.com/file", tor, newPicker(tor)); err == nil {
+		t.Error("ftp web seed accepted")
+	}
+}
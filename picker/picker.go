@@ -0,0 +1,471 @@
+package picker
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/0xNathanW/bittorrent-go/logging"
+	msg "github.com/0xNathanW/bittorrent-go/p2p/message"
+	"github.com/0xNathanW/bittorrent-go/torrent"
+)
+
+// Number of pieces picked at random before switching to rarest-first,
+// so we have something to trade as soon as possible.
+const RandomFirst = 4
+
+/* Blocks are 16384 bytes (16Kb) long unless changed with SetBlockSize,
+ * the last block of a piece will likely be smaller.
+ */
+const DefaultBlockSize = 16384
+
+// Pieces with a higher priority are always picked before those with
+// a lower one, regardless of availability.
+type Priority int
+
+const (
+	Skip   Priority = iota // Piece is not downloaded.
+	Normal                 // Default priority.
+	High
+	Highest
+)
+
+// Block identifies a single block request.
+type Block struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// Picker decides which blocks to request from each peer.
+// It tracks how many peers have each piece and which blocks
+// are in flight to which peer.
+type Picker struct {
+	mu sync.Mutex
+
+	t            *torrent.Torrent
+	availability []int      // Number of connected peers with each piece.
+	priority     []Priority // Download priority of each piece.
+	done         []bool     // Pieces downloaded and verified.
+	numDone      int
+	partial      map[int]*partial // Pieces with blocks requested or received.
+	blockSize    int
+	inEndgame    bool
+
+	Logger *logging.Logger
+}
+
+// A piece that has been started.
+type partial struct {
+	blocks   []block
+	received int
+}
+
+type block struct {
+	received bool
+	peers    []string // Peers the block is currently requested from.
+}
+
+func New(t *torrent.Torrent) *Picker {
+	pk := &Picker{
+		t:            t,
+		availability: make([]int, len(t.Pieces)),
+		priority:     make([]Priority, len(t.Pieces)),
+		done:         make([]bool, len(t.Pieces)),
+		partial:      make(map[int]*partial),
+		blockSize:    DefaultBlockSize,
+	}
+	for i := range pk.priority {
+		pk.priority[i] = Normal
+	}
+	return pk
+}
+
+// SetBlockSize changes the size of the blocks requested from peers,
+// call before any blocks are picked.
+func (pk *Picker) SetBlockSize(size int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	pk.blockSize = size
+}
+
+// BlockSize returns the size of the blocks requested from peers.
+func (pk *Picker) BlockSize() int {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	return pk.blockSize
+}
+
+// ---------------------------- Availability ----------------------------//
+
+// Adds a peer's bitfield to the availability counts.
+func (pk *Picker) AddBitfield(bf msg.Bitfield) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for i := range pk.availability {
+		if bf.HasPiece(i) {
+			pk.availability[i]++
+		}
+	}
+}
+
+// Removes a peer's bitfield from the availability counts,
+// used when the peer disconnects or replaces its bitfield.
+func (pk *Picker) RemoveBitfield(bf msg.Bitfield) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for i := range pk.availability {
+		if bf.HasPiece(i) && pk.availability[i] > 0 {
+			pk.availability[i]--
+		}
+	}
+}
+
+// Records a have message for a piece.
+func (pk *Picker) AddHave(idx int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	if idx >= 0 && idx < len(pk.availability) {
+		pk.availability[idx]++
+	}
+}
+
+// Returns the number of connected peers that have a piece.
+func (pk *Picker) Availability(idx int) int {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	if idx < 0 || idx >= len(pk.availability) {
+		return 0
+	}
+	return pk.availability[idx]
+}
+
+// ------------------------------ Priority ------------------------------//
+
+func (pk *Picker) SetPriority(idx int, p Priority) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	if idx >= 0 && idx < len(pk.priority) {
+		pk.priority[idx] = p
+	}
+}
+
+func (pk *Picker) Priority(idx int) Priority {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	if idx < 0 || idx >= len(pk.priority) {
+		return Skip
+	}
+	return pk.priority[idx]
+}
+
+// ------------------------------- Picking ------------------------------//
+
+// Pick returns up to n blocks to request from a peer with the given bitfield,
+// marking them as in flight to that peer.
+// Higher priority pieces come first, then started pieces so they complete
+// sooner, then the rarest pieces. The first few pieces are chosen at random.
+// In endgame, blocks already in flight to other peers are also handed out.
+func (pk *Picker) Pick(peer string, has msg.Bitfield, n int) []Block {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	var blocks []Block
+	for len(blocks) < n {
+		idx := pk.best(has)
+		if idx < 0 {
+			break
+		}
+		pp, ok := pk.partial[idx]
+		if !ok {
+			pp = pk.newPartial(idx)
+			pk.partial[idx] = pp
+		}
+		for b := range pp.blocks {
+			if len(blocks) == n {
+				break
+			}
+			if pp.blocks[b].received || len(pp.blocks[b].peers) > 0 {
+				continue
+			}
+			pp.blocks[b].peers = append(pp.blocks[b].peers, peer)
+			blocks = append(blocks, pk.block(idx, b))
+		}
+	}
+
+	if len(blocks) < n && pk.endgame() {
+		if !pk.inEndgame {
+			pk.inEndgame = true
+			pk.Logger.Info("endgame started", "remaining", len(pk.done)-pk.numDone)
+		}
+		blocks = append(blocks, pk.pickEndgame(peer, has, n-len(blocks))...)
+	}
+	return blocks
+}
+
+// Endgame starts once every remaining block has been requested.
+func (pk *Picker) endgame() bool {
+	for idx, d := range pk.done {
+		if d || pk.priority[idx] == Skip {
+			continue
+		}
+		pp, ok := pk.partial[idx]
+		if !ok || pp.hasFree() {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns blocks in flight to other peers that this peer could
+// also send, so the last pieces aren't held up by a slow peer.
+func (pk *Picker) pickEndgame(peer string, has msg.Bitfield, n int) []Block {
+	var blocks []Block
+	for idx, pp := range pk.partial {
+		if !has.HasPiece(idx) {
+			continue
+		}
+		for b := range pp.blocks {
+			if len(blocks) == n {
+				return blocks
+			}
+			bl := &pp.blocks[b]
+			if bl.received || hasPeer(bl.peers, peer) {
+				continue
+			}
+			bl.peers = append(bl.peers, peer)
+			blocks = append(blocks, pk.block(idx, b))
+		}
+	}
+	return blocks
+}
+
+// Returns the index of the best piece to request blocks from, or -1.
+func (pk *Picker) best(has msg.Bitfield) int {
+	best := -1
+	numPieces := len(pk.done)
+	if numPieces == 0 {
+		return best
+	}
+	random := pk.numDone < RandomFirst
+	// Start from a random offset so ties are broken randomly.
+	start := rand.Intn(numPieces)
+	for i := 0; i < numPieces; i++ {
+		idx := (start + i) % numPieces
+		if pk.done[idx] || pk.priority[idx] == Skip || !has.HasPiece(idx) {
+			continue
+		}
+		if pp, ok := pk.partial[idx]; ok && !pp.hasFree() {
+			continue
+		}
+		if best < 0 || pk.better(idx, best, random) {
+			best = idx
+		}
+	}
+	return best
+}
+
+// Reports whether piece a should be picked before piece b.
+func (pk *Picker) better(a, b int, random bool) bool {
+	if pk.priority[a] != pk.priority[b] {
+		return pk.priority[a] > pk.priority[b]
+	}
+	_, aPartial := pk.partial[a]
+	_, bPartial := pk.partial[b]
+	if aPartial != bPartial {
+		return aPartial
+	}
+	if random {
+		return false
+	}
+	return pk.availability[a] < pk.availability[b]
+}
+
+func (pk *Picker) newPartial(idx int) *partial {
+	length := pk.t.PieceSize(idx)
+	return &partial{
+		blocks: make([]block, (length+pk.blockSize-1)/pk.blockSize),
+	}
+}
+
+// Returns the request for the b-th block of a piece.
+func (pk *Picker) block(idx, b int) Block {
+	length := pk.t.PieceSize(idx)
+	begin := b * pk.blockSize
+	size := pk.blockSize
+	if begin+size > length {
+		size = length - begin
+	}
+	return Block{Index: idx, Begin: begin, Length: size}
+}
+
+// Reports whether any block is neither received nor requested.
+func (pp *partial) hasFree() bool {
+	for _, b := range pp.blocks {
+		if !b.received && len(b.peers) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------- Book keeping ----------------------------//
+
+// Received marks a block as received from a peer.
+// ok is false if the block was not expected, eg. already received.
+// complete is true once every block of the piece has been received,
+// the piece should then be verified and passed to PieceDone or PieceFailed.
+// others lists the peers the block is still requested from, which
+// should be sent a cancel.
+func (pk *Picker) Received(peer string, b Block) (others []string, complete, ok bool) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pp, exists := pk.partial[b.Index]
+	if !exists || b.Begin%pk.blockSize != 0 || b.Begin/pk.blockSize >= len(pp.blocks) {
+		return nil, false, false
+	}
+	if pk.block(b.Index, b.Begin/pk.blockSize) != b {
+		return nil, false, false
+	}
+	bl := &pp.blocks[b.Begin/pk.blockSize]
+	if bl.received {
+		return nil, false, false
+	}
+	others = removePeer(bl.peers, peer)
+	bl.received = true
+	bl.peers = nil
+	pp.received++
+	return others, pp.received == len(pp.blocks), true
+}
+
+// Return puts a block requested from a peer back up for picking,
+// eg. when the peer chokes us.
+func (pk *Picker) Return(peer string, b Block) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	pp, ok := pk.partial[b.Index]
+	if !ok || b.Begin%pk.blockSize != 0 || b.Begin/pk.blockSize >= len(pp.blocks) {
+		return
+	}
+	bl := &pp.blocks[b.Begin/pk.blockSize]
+	bl.peers = removePeer(bl.peers, peer)
+	pk.prune(b.Index)
+}
+
+// ReturnAll puts every block requested from a peer back up for picking.
+func (pk *Picker) ReturnAll(peer string) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for idx, pp := range pk.partial {
+		for b := range pp.blocks {
+			pp.blocks[b].peers = removePeer(pp.blocks[b].peers, peer)
+		}
+		pk.prune(idx)
+	}
+}
+
+// Drops a partial piece with nothing requested or received,
+// so it is no longer favoured over other pieces.
+func (pk *Picker) prune(idx int) {
+	pp := pk.partial[idx]
+	if pp.received > 0 {
+		return
+	}
+	for _, b := range pp.blocks {
+		if len(b.peers) > 0 {
+			return
+		}
+	}
+	delete(pk.partial, idx)
+}
+
+func hasPeer(peers []string, peer string) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+func removePeer(peers []string, peer string) []string {
+	for i, p := range peers {
+		if p == peer {
+			return append(peers[:i], peers[i+1:]...)
+		}
+	}
+	return peers
+}
+
+// PieceDone marks a piece as downloaded and verified.
+func (pk *Picker) PieceDone(idx int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	if idx < 0 || idx >= len(pk.done) || pk.done[idx] {
+		return
+	}
+	delete(pk.partial, idx)
+	pk.done[idx] = true
+	pk.numDone++
+}
+
+// PieceFailed discards a piece that failed verification,
+// so it is downloaded again.
+func (pk *Picker) PieceFailed(idx int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	pk.Logger.Warn("piece failed verification", "index", idx)
+	delete(pk.partial, idx)
+}
+
+// Reports whether a piece has been downloaded and verified.
+func (pk *Picker) HasPiece(idx int) bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	return idx >= 0 && idx < len(pk.done) && pk.done[idx]
+}
+
+// Returns a bitfield of the pieces downloaded.
+func (pk *Picker) Bitfield() msg.Bitfield {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	bf := make(msg.Bitfield, (len(pk.done)+7)/8)
+	for i, d := range pk.done {
+		if d {
+			bf.SetPiece(i)
+		}
+	}
+	return bf
+}
+
+// Wants reports whether a peer with the given bitfield has any piece
+// we still want, ie. whether we are interested in it.
+func (pk *Picker) Wants(has msg.Bitfield) bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for i, d := range pk.done {
+		if !d && pk.priority[i] != Skip && has.HasPiece(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Complete reports whether every piece we want has been downloaded.
+func (pk *Picker) Complete() bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for i, d := range pk.done {
+		if !d && pk.priority[i] != Skip {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the number of pieces downloaded.
+func (pk *Picker) NumDone() int {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	return pk.numDone
+}
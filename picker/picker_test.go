@@ -0,0 +1,395 @@
+package picker
+
+import (
+	"reflect"
+	"testing"
+
+	msg "github.com/0xNathanW/bittorrent-go/p2p/message"
+	"github.com/0xNathanW/bittorrent-go/torrent"
+)
+
+const testPieceLength = 4 * DefaultBlockSize
+
+// Returns a picker for numPieces full pieces, then one of lastLength
+// bytes if it isn't 0.
+func newPicker(numPieces, lastLength int) *Picker {
+	t := &torrent.Torrent{
+		PieceLength: testPieceLength,
+		Size:        numPieces*testPieceLength + lastLength,
+		Pieces:      make([][20]byte, numPieces),
+	}
+	if lastLength > 0 {
+		t.Pieces = append(t.Pieces, [20]byte{})
+	}
+	return New(t)
+}
+
+// Returns a bitfield of the given pieces.
+func bitfield(numPieces int, pieces ...int) msg.Bitfield {
+	bf := make(msg.Bitfield, (numPieces+7)/8)
+	for _, idx := range pieces {
+		bf.SetPiece(idx)
+	}
+	return bf
+}
+
+// Returns a bitfield of every piece.
+func all(numPieces int) msg.Bitfield {
+	bf := bitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
+// Marks the first RandomFirst pieces done, so picking is rarest-first.
+func skipRandom(pk *Picker) {
+	for i := 0; i < RandomFirst; i++ {
+		pk.PieceDone(i)
+	}
+}
+
+// Downloads every block of a piece picked by peer, returning the piece.
+func download(t *testing.T, pk *Picker, peer string, has msg.Bitfield) int {
+	t.Helper()
+	blocks := pk.Pick(peer, has, testPieceLength/DefaultBlockSize)
+	if len(blocks) == 0 {
+		t.Fatal("nothing picked")
+	}
+	complete := false
+	for _, b := range blocks {
+		if b.Index != blocks[0].Index {
+			t.Fatalf("picked blocks of pieces %d and %d", blocks[0].Index, b.Index)
+		}
+		var ok bool
+		if _, complete, ok = pk.Received(peer, b); !ok {
+			t.Fatalf("block %+v not expected", b)
+		}
+	}
+	if !complete {
+		t.Fatalf("piece %d not complete", blocks[0].Index)
+	}
+	pk.PieceDone(blocks[0].Index)
+	return blocks[0].Index
+}
+
+func TestBlocks(t *testing.T) {
+	pk := newPicker(1, DefaultBlockSize+100)
+	pk.PieceDone(0)
+	got := pk.Pick("a", all(2), 10)
+	want := []Block{
+		{Index: 1, Begin: 0, Length: DefaultBlockSize},
+		{Index: 1, Begin: DefaultBlockSize, Length: 100},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRarestFirst(t *testing.T) {
+	const numPieces = RandomFirst + 5
+	pk := newPicker(numPieces, 0)
+	skipRandom(pk)
+
+	// Piece RandomFirst+i is held by i+1 peers, except the last,
+	// which no peer but the downloading one has.
+	for i := 0; i < 4; i++ {
+		for n := 0; n <= i; n++ {
+			pk.AddHave(RandomFirst + 3 - i)
+		}
+	}
+	has := bitfield(numPieces)
+	for i := RandomFirst; i < numPieces-1; i++ {
+		has.SetPiece(i)
+	}
+	var order []int
+	for i := 0; i < 4; i++ {
+		order = append(order, download(t, pk, "a", has))
+	}
+	want := []int{RandomFirst + 3, RandomFirst + 2, RandomFirst + 1, RandomFirst}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("picked %v, want %v", order, want)
+	}
+	if blocks := pk.Pick("a", has, 1); len(blocks) != 0 {
+		t.Errorf("picked %+v the peer doesn't have", blocks)
+	}
+}
+
+func TestRandomFirst(t *testing.T) {
+	pk := newPicker(20, 0)
+	has := bitfield(20, 3, 7, 11)
+	for i := 0; i < 3; i++ {
+		if idx := download(t, pk, "a", has); !has.HasPiece(idx) {
+			t.Fatalf("picked piece %d the peer doesn't have", idx)
+		}
+	}
+	if pk.NumDone() != 3 {
+		t.Errorf("%d pieces done, want 3", pk.NumDone())
+	}
+}
+
+func TestPriority(t *testing.T) {
+	pk := newPicker(RandomFirst+3, 0)
+	skipRandom(pk)
+	common, rare, skipped := RandomFirst, RandomFirst+1, RandomFirst+2
+	pk.AddBitfield(bitfield(RandomFirst+3, common))
+	pk.AddBitfield(bitfield(RandomFirst+3, common))
+	pk.SetPriority(common, High)
+	pk.SetPriority(skipped, Skip)
+
+	has := all(RandomFirst + 3)
+	if idx := download(t, pk, "a", has); idx != common {
+		t.Errorf("picked %d, want the high priority piece %d", idx, common)
+	}
+	if idx := download(t, pk, "a", has); idx != rare {
+		t.Errorf("picked %d, want %d", idx, rare)
+	}
+	if blocks := pk.Pick("a", has, 1); len(blocks) != 0 {
+		t.Errorf("picked %+v of a skipped piece", blocks)
+	}
+	if !pk.Complete() {
+		t.Error("not complete with only a skipped piece left")
+	}
+}
+
+// Started pieces are finished before rarer ones are begun.
+func TestPartialFirst(t *testing.T) {
+	const numPieces = RandomFirst + 2
+	pk := newPicker(numPieces, 0)
+	skipRandom(pk)
+	common, rare := RandomFirst, RandomFirst+1
+	pk.AddBitfield(bitfield(numPieces, common))
+	pk.AddBitfield(bitfield(numPieces, common, rare))
+
+	// Only a has the common piece to begin with.
+	started := pk.Pick("a", bitfield(numPieces, common), 1)
+	if len(started) != 1 || started[0].Index != common {
+		t.Fatalf("picked %+v, want a block of %d", started, common)
+	}
+	blocks := pk.Pick("b", all(numPieces), 3)
+	if len(blocks) != 3 {
+		t.Fatalf("picked %d blocks, want 3", len(blocks))
+	}
+	for _, b := range blocks {
+		if b.Index != common || b == started[0] {
+			t.Errorf("picked %+v, want another block of %d", b, common)
+		}
+	}
+}
+
+func TestReceived(t *testing.T) {
+	pk := newPicker(1, 0)
+	b := pk.Pick("a", all(1), 1)[0]
+
+	for _, tt := range []struct {
+		name string
+		b    Block
+	}{
+		{"misaligned", Block{Index: 0, Begin: 1, Length: DefaultBlockSize}},
+		{"wrong length", Block{Index: 0, Begin: 0, Length: 1}},
+		{"out of range", Block{Index: 0, Begin: testPieceLength, Length: DefaultBlockSize}},
+		{"unknown piece", Block{Index: 5, Begin: 0, Length: DefaultBlockSize}},
+	} {
+		if _, _, ok := pk.Received("a", tt.b); ok {
+			t.Errorf("%s: block accepted", tt.name)
+		}
+	}
+	if _, complete, ok := pk.Received("a", b); !ok || complete {
+		t.Errorf("got ok %v complete %v, want ok and not complete", ok, complete)
+	}
+	if _, _, ok := pk.Received("a", b); ok {
+		t.Error("duplicate block accepted")
+	}
+}
+
+// Blocks from a peer that chokes us are picked again.
+func TestReturn(t *testing.T) {
+	pk := newPicker(1, 0)
+	has := all(1)
+	blocks := pk.Pick("a", has, 2)
+	if len(blocks) != 2 {
+		t.Fatalf("picked %d blocks, want 2", len(blocks))
+	}
+
+	pk.Return("a", blocks[1])
+	got := pk.Pick("b", has, 3)
+	if len(got) != 3 || got[0] != blocks[1] {
+		t.Errorf("after Return, picked %+v, want %+v first", got, blocks[1])
+	}
+
+	pk.ReturnAll("a")
+	pk.ReturnAll("b")
+	if got := pk.Pick("c", has, 10); len(got) != 4 {
+		t.Errorf("after ReturnAll, picked %d blocks, want all 4", len(got))
+	}
+}
+
+// A returned piece with nothing received is no longer favoured.
+func TestReturnPrunes(t *testing.T) {
+	const numPieces = RandomFirst + 2
+	pk := newPicker(numPieces, 0)
+	skipRandom(pk)
+	common, rare := RandomFirst, RandomFirst+1
+	pk.AddBitfield(bitfield(numPieces, common, rare))
+	pk.AddBitfield(bitfield(numPieces, common))
+
+	pk.Pick("a", bitfield(numPieces, common), 1)
+	pk.ReturnAll("a")
+	if blocks := pk.Pick("b", all(numPieces), 1); len(blocks) != 1 || blocks[0].Index != rare {
+		t.Errorf("picked %+v, want a block of the rarest piece %d", blocks, rare)
+	}
+}
+
+// A piece that fails verification is downloaded again.
+func TestPieceFailed(t *testing.T) {
+	pk := newPicker(1, 0)
+	has := all(1)
+	blocks := pk.Pick("a", has, 10)
+	var complete bool
+	for _, b := range blocks {
+		_, complete, _ = pk.Received("a", b)
+	}
+	if !complete {
+		t.Fatal("piece not complete")
+	}
+	pk.PieceFailed(0)
+	if pk.HasPiece(0) || pk.Complete() {
+		t.Error("failed piece counted as done")
+	}
+	if !pk.Wants(has) {
+		t.Error("failed piece not wanted")
+	}
+	again := pk.Pick("b", has, 10)
+	if !reflect.DeepEqual(again, blocks) {
+		t.Errorf("picked %+v, want every block again %+v", again, blocks)
+	}
+	for _, b := range again {
+		if _, _, ok := pk.Received("b", b); !ok {
+			t.Errorf("block %+v not expected", b)
+		}
+	}
+
+	pk.PieceDone(0)
+	if !pk.HasPiece(0) || !pk.Complete() || pk.NumDone() != 1 {
+		t.Error("piece not done")
+	}
+	if !reflect.DeepEqual(pk.Bitfield(), has) || pk.Wants(has) {
+		t.Errorf("bitfield %v, want %v", pk.Bitfield(), has)
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	pk := newPicker(3, 0)
+	bf := bitfield(3, 0, 2)
+	pk.AddBitfield(bf)
+	pk.AddBitfield(bf)
+	pk.AddHave(1)
+	pk.RemoveBitfield(bf)
+	pk.AddHave(-1)
+	pk.AddHave(3)
+	for idx, want := range []int{1, 1, 1} {
+		if got := pk.Availability(idx); got != want {
+			t.Errorf("piece %d: availability %d, want %d", idx, got, want)
+		}
+	}
+}
+
+// ------------------------------- Endgame ------------------------------//
+
+// Endgame waits until every remaining block is in flight.
+func TestEndgameStart(t *testing.T) {
+	pk := newPicker(2, 0)
+	has := all(2)
+	if blocks := pk.Pick("a", bitfield(2, 0), 10); len(blocks) != 4 {
+		t.Fatalf("picked %d blocks, want 4", len(blocks))
+	}
+	// Piece 1 is still free, so nothing is picked twice.
+	for _, b := range pk.Pick("b", has, 4) {
+		if b.Index != 1 {
+			t.Errorf("picked %+v before endgame", b)
+		}
+	}
+	// Now every block is in flight.
+	if blocks := pk.Pick("c", has, 1); len(blocks) != 1 {
+		t.Errorf("picked %d blocks in endgame, want 1", len(blocks))
+	}
+}
+
+// Blocks are picked once per peer in endgame, and the other peers
+// are cancelled once one arrives.
+func TestEndgameDuplicates(t *testing.T) {
+	pk := newPicker(1, 0)
+	has := all(1)
+	blocks := pk.Pick("a", has, 10)
+	if len(blocks) != 4 {
+		t.Fatalf("picked %d blocks, want 4", len(blocks))
+	}
+	if again := pk.Pick("a", has, 10); len(again) != 0 {
+		t.Errorf("picked %+v twice for the same peer", again)
+	}
+	dup := pk.Pick("b", has, 2)
+	if len(dup) != 2 {
+		t.Fatalf("picked %d blocks in endgame, want 2", len(dup))
+	}
+	pk.Pick("c", has, 1)
+
+	others, _, ok := pk.Received("a", dup[0])
+	if !ok {
+		t.Fatal("block not expected")
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(others, want) {
+		t.Errorf("cancel %v, want %v", others, want)
+	}
+	// The duplicate that arrives anyway isn't counted.
+	if _, _, ok := pk.Received("b", dup[0]); ok {
+		t.Error("duplicate block accepted")
+	}
+	// A block only a has is cancelled at no one.
+	others, _, ok = pk.Received("a", blocks[3])
+	if !ok || len(others) != 0 {
+		t.Errorf("got %v %v, want no peers to cancel", others, ok)
+	}
+	// A received block isn't handed out again.
+	for _, b := range pk.Pick("d", has, 10) {
+		if b == dup[0] || b == blocks[3] {
+			t.Errorf("picked received block %+v", b)
+		}
+	}
+}
+
+// A peer choking us in endgame leaves its blocks with the others.
+func TestEndgameReturn(t *testing.T) {
+	pk := newPicker(1, 0)
+	has := all(1)
+	blocks := pk.Pick("a", has, 10)
+	pk.Pick("b", has, 10)
+	pk.ReturnAll("b")
+
+	others, complete, ok := pk.Received("a", blocks[0])
+	if !ok || complete || len(others) != 0 {
+		t.Errorf("got %v %v %v, want ok with no peers to cancel", others, complete, ok)
+	}
+	// b may pick them up again.
+	if got := pk.Pick("b", has, 10); len(got) != 3 {
+		t.Errorf("picked %d blocks, want the 3 not received", len(got))
+	}
+}
+
+// A piece failing in endgame is picked again, first by anyone.
+func TestEndgameFailed(t *testing.T) {
+	pk := newPicker(1, 0)
+	has := all(1)
+	blocks := pk.Pick("a", has, 10)
+	pk.Pick("b", has, 10)
+	for _, b := range blocks {
+		pk.Received("a", b)
+	}
+	pk.PieceFailed(0)
+	if got := pk.Pick("b", has, 10); !reflect.DeepEqual(got, blocks) {
+		t.Errorf("picked %+v, want every block again %+v", got, blocks)
+	}
+	// Back in endgame once they are all in flight.
+	if got := pk.Pick("a", has, 10); len(got) != 4 {
+		t.Errorf("picked %d blocks, want all 4 again", len(got))
+	}
+}
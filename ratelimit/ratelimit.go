@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Unlimited is the rate of a limiter that never waits.
+const Unlimited = 0
+
+// Limiter is a token bucket, tokens are bytes and refill at the rate.
+// The bucket holds up to a second's worth of tokens.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int     // Bytes per second, Unlimited for no limit.
+	tokens float64 // May go negative, the debt is waited off.
+	last   time.Time
+}
+
+func NewLimiter(rate int) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// Rate returns the limit in bytes per second.
+func (l *Limiter) Rate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the limit, it takes effect for waits that follow.
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+// Takes n tokens, returning how long until the bucket is out of debt.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= Unlimited {
+		return 0
+	}
+	now := time.Now()
+	l.refill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Gives back n tokens taken by reserve for a transfer that didn't happen.
+func (l *Limiter) refund(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= Unlimited {
+		return
+	}
+	l.refill(time.Now())
+	l.tokens += float64(n)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+}
+
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+}
+
+// Group is a chain of limiters, eg. global, torrent and peer,
+// every transfer counts against all of them.
+type Group []*Limiter
+
+// Wait blocks until n bytes may be transferred under every limiter,
+// or ctx is done, returning its error. Tokens are taken up front and
+// the wait happens without any lock held, they are given back if ctx
+// is done first.
+func (g Group) Wait(ctx context.Context, n int) error {
+	var wait time.Duration
+	for _, l := range g {
+		if l == nil {
+			continue
+		}
+		if d := l.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		for _, l := range g {
+			if l != nil {
+				l.refund(n)
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// Global limits shared by every torrent.
+var (
+	GlobalUp   = NewLimiter(Unlimited)
+	GlobalDown = NewLimiter(Unlimited)
+)
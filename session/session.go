@@ -0,0 +1,395 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0xNathanW/bittorrent-go/client"
+	"github.com/0xNathanW/bittorrent-go/ipfilter"
+	"github.com/0xNathanW/bittorrent-go/logging"
+	"github.com/0xNathanW/bittorrent-go/p2p"
+	"github.com/0xNathanW/bittorrent-go/p2p/mse"
+	"github.com/0xNathanW/bittorrent-go/p2p/peerid"
+	"github.com/0xNathanW/bittorrent-go/torrent"
+	"github.com/0xNathanW/bittorrent-go/tracker"
+	"github.com/0xNathanW/bittorrent-go/utp"
+)
+
+/* A session runs many torrents side by side. They share one peer ID,
+ * one listening port for TCP and uTP, the ban list, and the global
+ * rate limits and connection caps. Each torrent has its own picker,
+ * storage and trackers.
+ *
+ * Incoming connections are routed to a torrent by the info hash in their
+ * handshake, or for encrypted connections the one used as the MSE key.
+ */
+
+// Session owns a set of torrents.
+type Session struct {
+	ID         [20]byte
+	Encryption mse.Policy
+	Bans       *client.BanList
+	Filter     *ipfilter.Filter // Checked before accepting a connection.
+	UTP        *utp.Socket      // Nil if uTP is unavailable.
+	Port       int
+	// Time allowed for an incoming connection to say which torrent it wants.
+	HandshakeTimeout time.Duration
+	// Incoming connections yet to say which torrent they want, more
+	// are closed at once.
+	MaxHandshakes int
+	ln            net.Listener
+	ctx           context.Context // Torrents stop when cancelled.
+	Logger        *logging.Logger // Given to each torrent.
+
+	mu         sync.Mutex
+	torrents   map[[20]byte]*client.Client
+	adding     map[[20]byte]bool // Torrents being set up, see AddTorrent.
+	handshakes int
+	closed     bool
+}
+
+// New starts a session listening for peers on port, or
+// tracker.ClientPort if 0. Cancelling ctx stops every torrent
+// without saving, use Close to shut down gracefully.
+func New(ctx context.Context, port int) (*Session, error) {
+	if port == 0 {
+		port = tracker.ClientPort
+	}
+	id, err := peerid.New()
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		ID:         id,
+		Encryption: mse.Prefer,
+		Filter:     ipfilter.Global,
+		Port:       port,
+		ctx:        ctx,
+
+		HandshakeTimeout: p2p.DefaultTimeouts.Handshake,
+		MaxHandshakes:    client.DefaultMaxHalfOpen,
+		torrents:         make(map[[20]byte]*client.Client),
+		adding:           make(map[[20]byte]bool),
+	}
+	// A ban list that fails to load is still used, bans are then saved over it.
+	s.Bans, _ = client.LoadBanList(client.DefaultBanListPath())
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for peers: %w", err)
+	}
+	s.ln = ln
+	go s.acceptLoop(ln)
+
+	// uTP is optional, without it peers are dialled over TCP only.
+	if sock, err := utp.Listen("udp", fmt.Sprintf(":%d", port)); err == nil {
+		s.UTP = sock
+		go s.acceptLoop(sock)
+	}
+	return s, nil
+}
+
+// Add loads the torrent file at path and starts it. If setup isn't nil
+// it is called to configure the torrent before it starts.
+func (s *Session) Add(path string, setup func(*client.Client) error) (*client.Client, error) {
+	t, err := torrent.NewTorrent(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.AddTorrent(t, setup)
+}
+
+// AddTorrent starts a parsed torrent, unless it is already in the session.
+// Setup, which may take a while, eg. to verify the data on disk,
+// doesn't hold up the rest of the session.
+func (s *Session) AddTorrent(t *torrent.Torrent, setup func(*client.Client) error) (*client.Client, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("session closed")
+	}
+	if _, ok := s.torrents[t.InfoHash]; ok || s.adding[t.InfoHash] {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("torrent %s already added", t.GetInfoHash())
+	}
+	s.adding[t.InfoHash] = true
+	s.mu.Unlock()
+
+	c, err := s.newClient(t, setup)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.adding, t.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	if s.closed {
+		return nil, fmt.Errorf("session closed")
+	}
+	// Started with the lock held, so Close stops it if it follows.
+	if err := c.Start(s.ctx); err != nil {
+		return nil, err
+	}
+	s.torrents[t.InfoHash] = c
+	return c, nil
+}
+
+// Returns a client for the torrent with the session's settings,
+// configured by setup.
+func (s *Session) newClient(t *torrent.Torrent, setup func(*client.Client) error) (*client.Client, error) {
+	c, err := client.New(t, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	c.Bans = s.Bans
+	c.Filter = s.Filter
+	c.Encryption = s.Encryption
+	c.UTP = s.UTP
+	c.Logger = s.Logger
+	c.Port = s.Port
+	c.Tracker.SetPort(s.Port)
+	if setup != nil {
+		if err := setup(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Remove stops a torrent and drops it from the session,
+// giving up on stopping it gracefully once ctx is done.
+func (s *Session) Remove(ctx context.Context, infoHash [20]byte) error {
+	s.mu.Lock()
+	c, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+	if !ok {
+		return errNotFound(infoHash)
+	}
+	return c.Stop(ctx)
+}
+
+// Pause disconnects a torrent's peers until it is resumed.
+func (s *Session) Pause(infoHash [20]byte) error {
+	c, ok := s.Torrent(infoHash)
+	if !ok {
+		return errNotFound(infoHash)
+	}
+	c.Pause()
+	return nil
+}
+
+// Resume reconnects a paused torrent.
+func (s *Session) Resume(infoHash [20]byte) error {
+	c, ok := s.Torrent(infoHash)
+	if !ok {
+		return errNotFound(infoHash)
+	}
+	c.Resume()
+	return nil
+}
+
+// Torrent returns the torrent with the given info hash.
+func (s *Session) Torrent(infoHash [20]byte) (*client.Client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.torrents[infoHash]
+	return c, ok
+}
+
+// Torrents returns every torrent in the session, sorted by name.
+func (s *Session) Torrents() []*client.Client {
+	s.mu.Lock()
+	list := make([]*client.Client, 0, len(s.torrents))
+	for _, c := range s.torrents {
+		list = append(list, c)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Torrent.Name < list[j].Torrent.Name
+	})
+	return list
+}
+
+// Close stops every torrent at once and the listeners, giving up
+// on stopping gracefully once ctx is done.
+func (s *Session) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	torrents := s.torrents
+	s.torrents = make(map[[20]byte]*client.Client)
+	s.mu.Unlock()
+
+	s.ln.Close()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []string
+	for _, c := range torrents {
+		wg.Add(1)
+		go func(c *client.Client) {
+			defer wg.Done()
+			if err := c.Stop(ctx); err != nil {
+				mu.Lock()
+				errs = append(errs, err.Error())
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	// Peers' uTP connections are closed by now.
+	if s.UTP != nil {
+		s.UTP.Close()
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("failed to stop torrents:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+func errNotFound(infoHash [20]byte) error {
+	return fmt.Errorf("no torrent %s in session", hex.EncodeToString(infoHash[:]))
+}
+
+// ------------------------------ Listening -----------------------------//
+
+// Connections from refused addresses, or over the handshake cap, are
+// closed before anything is read from them.
+func (s *Session) acceptLoop(ln net.Listener) {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if ip := remoteIP(conn); s.Bans.Banned(ip) || s.Filter.Blocked(ip) || !s.startHandshake() {
+			conn.Close()
+			continue
+		}
+		go func() {
+			c, replay := s.handshake(conn)
+			s.endHandshake()
+			if c != nil {
+				c.AcceptConn(replay)
+			}
+		}()
+	}
+}
+
+// Reserves a slot for an incoming handshake, false if none are free.
+func (s *Session) startHandshake() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handshakes >= s.MaxHandshakes {
+		return false
+	}
+	s.handshakes++
+	return true
+}
+
+func (s *Session) endHandshake() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handshakes--
+}
+
+// Negotiates encryption with an incoming connection, returning the
+// torrent it is for, or nil once the connection is closed.
+func (s *Session) handshake(conn net.Conn) (*client.Client, net.Conn) {
+	conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+
+	replay, encrypted, err := mse.Detect(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil
+	}
+
+	var infoHash [20]byte
+	switch {
+	case encrypted && s.Encryption == mse.Disabled:
+		conn.Close()
+		return nil, nil
+
+	case encrypted:
+		replay, infoHash, err = mse.Accept(replay, s.infoHashes(), s.Encryption.Methods())
+		if err != nil {
+			conn.Close()
+			return nil, nil
+		}
+
+	case s.Encryption == mse.Require: // Plaintext handshake.
+		conn.Close()
+		return nil, nil
+
+	default:
+		replay, infoHash, err = peekInfoHash(replay)
+		if err != nil {
+			conn.Close()
+			return nil, nil
+		}
+	}
+
+	c, ok := s.Torrent(infoHash)
+	if !ok {
+		conn.Close()
+		return nil, nil
+	}
+	// Deadlines from here on are the peer's.
+	conn.SetDeadline(time.Time{})
+	return c, replay
+}
+
+// Returns the IP of the remote end of a TCP or uTP connection.
+func remoteIP(conn net.Conn) net.IP {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Info hashes of every torrent, the keys MSE may be negotiated with.
+func (s *Session) infoHashes() [][20]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes := make([][20]byte, 0, len(s.torrents))
+	for infoHash := range s.torrents {
+		hashes = append(hashes, infoHash)
+	}
+	return hashes
+}
+
+// Reads the info hash from the start of a plaintext handshake,
+// returning a connection that replays what was read.
+// handshake: <pstrlen=19><pstr><reserved 8><info hash 20><peer id 20>
+func peekInfoHash(conn net.Conn) (net.Conn, [20]byte, error) {
+	var infoHash [20]byte
+	head := make([]byte, 1+19+8+20)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, infoHash, err
+	}
+	copy(infoHash[:], head[28:])
+	return &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(head), conn)}, infoHash, nil
+}
+
+// A connection whose reads start with bytes already read from it.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
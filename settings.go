@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/0xNathanW/bittorrent-go/config"
+)
+
+// Flags overriding the settings from config files and the environment.
+type settings struct {
+	path      string            // Config file given with -config.
+	overrides map[string]string // By setting key.
+}
+
+func (s *settings) register(fs *flag.FlagSet) {
+	s.overrides = make(map[string]string)
+	fs.StringVar(&s.path, "config", "", "config file read instead of those in the XDG config directories")
+	fs.Var(&setFlag{s.overrides}, "set", "change any setting, key=value, eg. block_size=8192 (repeatable)")
+}
+
+// Adds a flag for the setting with the given key.
+func (s *settings) setting(fs *flag.FlagSet, name, key, usage string) {
+	def := config.Default().Get(key)
+	if def == "0" || def == "false" { // Not shown in usage.
+		def = ""
+	}
+	_, isBool := config.Default().Value(key).(*bool)
+	fs.Var(&settingFlag{key: key, def: def, isBool: isBool, overrides: s.overrides}, name, usage)
+}
+
+// Loads the settings, with the flags given applied last.
+func (s *settings) load() (*config.Config, error) {
+	return config.Load(s.path, s.overrides)
+}
+
+// A flag overriding one setting.
+type settingFlag struct {
+	key       string
+	def       string // Shown in usage.
+	isBool    bool
+	overrides map[string]string
+}
+
+func (f *settingFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.def
+}
+
+func (f *settingFlag) Set(value string) error {
+	f.overrides[f.key] = value
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool { return f.isBool }
+
+// The -set flag, overriding any setting.
+type setFlag struct {
+	overrides map[string]string
+}
+
+func (f *setFlag) String() string { return "" }
+
+func (f *setFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("want key=value, eg. max_peers=80")
+	}
+	key := strings.TrimSpace(kv[0])
+	if config.Default().Value(key) == nil {
+		return fmt.Errorf("unknown setting %q, want one of %s", key, strings.Join(config.Keys(), ", "))
+	}
+	f.overrides[key] = kv[1]
+	return nil
+}
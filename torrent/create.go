@@ -0,0 +1,149 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Piece length used by Create when none is given.
+const DefaultPieceLength = 256 << 10
+
+// Create builds a torrent file for the file or directory at path,
+// returning it bencoded. Trackers are announced to in order, web seeds
+// may be empty.
+func Create(path string, trackers, webSeeds []string, pieceLength int) ([]byte, error) {
+	if pieceLength == 0 {
+		pieceLength = DefaultPieceLength
+	}
+	if pieceLength < 16<<10 || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %d is not a power of two of at least 16 KiB", pieceLength)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info := map[string]interface{}{
+		"name":         filepath.Base(path),
+		"piece length": pieceLength,
+	}
+	var paths []string // Files hashed, in order.
+	if stat.IsDir() {
+		var files []interface{}
+		err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, p)
+			files = append(files, map[string]interface{}{
+				"length": fi.Size(),
+				"path":   strings.Split(filepath.ToSlash(rel), "/"),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s has no files", path)
+		}
+		info["files"] = files
+	} else {
+		paths = []string{path}
+		info["length"] = stat.Size()
+	}
+
+	pieces, err := hashFiles(paths, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+	info["pieces"] = string(pieces)
+
+	meta := map[string]interface{}{"info": info}
+	if len(trackers) > 0 {
+		meta["announce"] = trackers[0]
+	}
+	if len(trackers) > 1 {
+		tiers := make([]interface{}, len(trackers))
+		for i, tr := range trackers {
+			tiers[i] = []string{tr}
+		}
+		meta["announce-list"] = tiers
+	}
+	if len(webSeeds) > 0 {
+		meta["url-list"] = webSeeds
+	}
+
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, meta); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Hashes the files as one stream, returning the concatenated piece hashes.
+func hashFiles(paths []string, pieceLength int) ([]byte, error) {
+	var pieces []byte
+	piece := make([]byte, 0, pieceLength)
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			n, err := io.ReadFull(f, piece[len(piece):pieceLength])
+			piece = piece[:len(piece)+n]
+			if len(piece) == pieceLength {
+				sum := sha1.Sum(piece)
+				pieces = append(pieces, sum[:]...)
+				piece = piece[:0]
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		f.Close()
+	}
+	if len(piece) > 0 {
+		sum := sha1.Sum(piece)
+		pieces = append(pieces, sum[:]...)
+	}
+	return pieces, nil
+}
+
+// Magnet returns a magnet link for the torrent (BEP 9).
+func (t *Torrent) Magnet() string {
+	params := url.Values{}
+	params.Set("dn", t.Name)
+	var trackers []string
+	if t.Announce != "" {
+		trackers = append(trackers, t.Announce)
+	}
+	for _, tr := range t.AnnounceList {
+		if tr != t.Announce {
+			trackers = append(trackers, tr)
+		}
+	}
+	params["tr"] = trackers
+	if len(t.URLList) > 0 {
+		params["ws"] = t.URLList
+	}
+	// The info hash goes first, url.Values would sort it.
+	return "magnet:?xt=urn:btih:" + t.GetInfoHash() + "&" + params.Encode()
+}
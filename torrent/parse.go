@@ -4,16 +4,18 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/jackpal/bencode-go"
 )
 
 // Frames enable the torrent file to be unmarshalled from bencoded form.
 type TorrentFrame struct {
-	Info         InfoFrame `bencode:"info"`
-	Announce     string    `bencode:"announce"`
-	AnnounceList []string  `bencode:"announce-list"`
+	Info     InfoFrame `bencode:"info"`
+	Announce string    `bencode:"announce"`
 }
 
 type InfoFrame struct {
@@ -52,38 +54,86 @@ func unpackFile(path string) (*TorrentFrame, error) {
 
 // Parses frame into a Torrent struct.
 func (f *TorrentFrame) parse(path string) (*Torrent, error) {
-	infoHash, err := getInfoHash(path)
+	raw, err := decodeRaw(path)
 	if err != nil {
 		return nil, err
 	}
+	infoHash, err := getInfoHash(raw)
+	if err != nil {
+		return nil, err
+	}
+	// Lengths size the buffer and lay out pieces, they must agree
+	// with the number of piece hashes.
+	if f.Info.PieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length: %d", f.Info.PieceLength)
+	}
+	if f.Info.Size < 0 {
+		return nil, fmt.Errorf("invalid length: %d", f.Info.Size)
+	}
 	//Sets size as sum of all file sizes if the torrent is multifile.
+	total := 0
+	for i, file := range f.Info.Files {
+		if file.Length < 0 || file.Length > math.MaxInt-total {
+			return nil, fmt.Errorf("invalid length of file %d: %d", i, file.Length)
+		}
+		total += file.Length
+	}
 	size := f.Info.Size
 	if size == 0 {
-		for _, file := range f.Info.Files {
-			size += file.Length
-		}
+		size = total
+	}
+	numPieces := size / f.Info.PieceLength
+	if size%f.Info.PieceLength != 0 {
+		numPieces++
+	}
+	if n := len(f.Info.PiecesString) / 20; n != numPieces {
+		return nil, fmt.Errorf("invalid pieces: %d hashes for %d pieces", n, numPieces)
+	}
+	// Names become paths on disk, a crafted torrent mustn't escape
+	// the output directory.
+	if err := checkPathPart(f.Info.Name); err != nil {
+		return nil, fmt.Errorf("invalid torrent name: %w", err)
 	}
 	// Parse file info.
 	files := make([]File, len(f.Info.Files))
 	for i, file := range f.Info.Files {
+		if len(file.Path) == 0 {
+			return nil, fmt.Errorf("invalid path of file %d: empty", i)
+		}
+		for _, part := range file.Path {
+			if err := checkPathPart(part); err != nil {
+				return nil, fmt.Errorf("invalid path of file %d: %w", i, err)
+			}
+		}
 		files[i] = File{
 			Length: file.Length,
 			Path:   file.Path[0],
+			Parts:  file.Path,
 		}
 	}
 	torrent := &Torrent{
 		Name:         f.Info.Name,
 		Announce:     f.Announce,
-		AnnounceList: f.AnnounceList,
+		AnnounceList: getAnnounceList(raw),
 		InfoHash:     infoHash,
 		Size:         size,
 		PieceLength:  f.Info.PieceLength,
 		Pieces:       f.Info.splitPieces(),
 		Files:        files,
+		URLList:      getURLList(raw),
 	}
 	return torrent, nil
 }
 
+// Checks a name or path component is a single, plain file name.
+func checkPathPart(part string) error {
+	if part == "" || part == "." || part == ".." || filepath.IsAbs(part) ||
+		strings.ContainsAny(part, `/\`+"\x00") {
+		return fmt.Errorf("%q is not a file name", part)
+	}
+	return nil
+}
+
 // Each piece is a 20 byte SHA1 hash.
 func (i *InfoFrame) splitPieces() [][20]byte {
 	buf := []byte(i.PiecesString)
@@ -94,23 +144,76 @@ func (i *InfoFrame) splitPieces() [][20]byte {
 	return pieces
 }
 
-// Calculates the SHA1 hash of the info dict.
-// This is used to verify the integrity of the torrent file.
-func getInfoHash(path string) ([20]byte, error) {
-	packed, _ := os.Open(path)
+// Decodes the torrent file without a frame, for fields that
+// can't be unmarshalled into one.
+func decodeRaw(path string) (map[string]interface{}, error) {
+	packed, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open torrent file: %w", err)
+	}
 	defer packed.Close()
 	raw, err := bencode.Decode(packed)
 	if err != nil {
-		return [20]byte{}, fmt.Errorf("could not decode torrent file: %s", err)
+		return nil, fmt.Errorf("could not decode torrent file: %s", err)
+	}
+	data, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("could not decode torrent file: not a dictionary")
+	}
+	return data, nil
+}
+
+// Calculates the SHA1 hash of the info dict.
+// This is used to verify the integrity of the torrent file.
+func getInfoHash(data map[string]interface{}) ([20]byte, error) {
+	buffer := bytes.Buffer{}
+	err := bencode.Marshal(&buffer, data["info"])
+	if err != nil {
+		return [20]byte{}, err
 	}
-	if data, ok := raw.(map[string]interface{}); ok {
-		buffer := bytes.Buffer{}
-		err := bencode.Marshal(&buffer, data["info"])
-		if err != nil {
-			return [20]byte{}, err
+	return sha1.Sum(buffer.Bytes()), nil
+}
+
+// Trackers from announce-list (BEP 12), a list of tiers
+// each listing trackers, flattened in order.
+func getAnnounceList(data map[string]interface{}) []string {
+	tiers, ok := data["announce-list"].([]interface{})
+	if !ok {
+		return nil
+	}
+	var list []string
+	for _, tier := range tiers {
+		switch tier := tier.(type) {
+		case []interface{}:
+			for _, tr := range tier {
+				if s, ok := tr.(string); ok && s != "" {
+					list = append(list, s)
+				}
+			}
+		case string: // Not a tier, but seen in the wild.
+			if tier != "" {
+				list = append(list, tier)
+			}
+		}
+	}
+	return list
+}
+
+// Web seed URLs (BEP 19), url-list is either a single URL or a list.
+func getURLList(data map[string]interface{}) []string {
+	switch urls := data["url-list"].(type) {
+	case string:
+		if urls != "" {
+			return []string{urls}
+		}
+	case []interface{}:
+		var list []string
+		for _, u := range urls {
+			if s, ok := u.(string); ok && s != "" {
+				list = append(list, s)
+			}
 		}
-		return sha1.Sum(buffer.Bytes()), nil
-	} else {
-		return [20]byte{}, fmt.Errorf("could not decode torrent file: %s", err)
+		return list
 	}
+	return nil
 }
@@ -0,0 +1,139 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Writes a torrent with the given info dict, returning its path.
+func writeTorrent(t *testing.T, info map[string]interface{}) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = bencode.Marshal(f, map[string]interface{}{
+		"announce": "http://127.0.0.1/announce",
+		"info":     info,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func hashes(n int) string {
+	return strings.Repeat("x", 20*n)
+}
+
+func file(length int, path ...string) map[string]interface{} {
+	return map[string]interface{}{"length": length, "path": path}
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		info   map[string]interface{}
+		size   int
+		pieces int
+	}{
+		{
+			"single file",
+			map[string]interface{}{"name": "a", "length": 100, "piece length": 32, "pieces": hashes(4)},
+			100, 4,
+		},
+		{
+			"exact pieces",
+			map[string]interface{}{"name": "a", "length": 64, "piece length": 32, "pieces": hashes(2)},
+			64, 2,
+		},
+		{
+			"multi file",
+			map[string]interface{}{
+				"name": "dir", "piece length": 32, "pieces": hashes(2),
+				"files": []interface{}{file(10, "a"), file(0, "sub", "b"), file(30, "c")},
+			},
+			40, 2,
+		},
+	} {
+		tor, err := NewTorrent(writeTorrent(t, tt.info))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tor.Size != tt.size || len(tor.Pieces) != tt.pieces {
+			t.Errorf("%s: size %d with %d pieces, want %d with %d", tt.name, tor.Size, len(tor.Pieces), tt.size, tt.pieces)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		info map[string]interface{}
+		want string
+	}{
+		{
+			"no piece length",
+			map[string]interface{}{"name": "a", "length": 100, "pieces": hashes(4)},
+			"invalid piece length: 0",
+		},
+		{
+			"negative piece length",
+			map[string]interface{}{"name": "a", "length": 100, "piece length": -32, "pieces": hashes(4)},
+			"invalid piece length: -32",
+		},
+		{
+			"negative length",
+			map[string]interface{}{"name": "a", "length": -100, "piece length": 32, "pieces": hashes(4)},
+			"invalid length: -100",
+		},
+		{
+			"negative file length",
+			map[string]interface{}{
+				"name": "dir", "piece length": 32, "pieces": hashes(1),
+				"files": []interface{}{file(40, "a"), file(-10, "b")},
+			},
+			"invalid length of file 1: -10",
+		},
+		{
+			"too few hashes",
+			map[string]interface{}{"name": "a", "length": 100, "piece length": 32, "pieces": hashes(3)},
+			"3 hashes for 4 pieces",
+		},
+		{
+			"too many hashes",
+			map[string]interface{}{"name": "a", "length": 64, "piece length": 32, "pieces": hashes(3)},
+			"3 hashes for 2 pieces",
+		},
+		{
+			"partial hash",
+			map[string]interface{}{"name": "a", "length": 100, "piece length": 32, "pieces": hashes(4) + "x"},
+			"invalid pieces length",
+		},
+		{
+			"name outside the output directory",
+			map[string]interface{}{"name": "..", "length": 100, "piece length": 32, "pieces": hashes(4)},
+			"invalid torrent name",
+		},
+		{
+			"path outside the torrent",
+			map[string]interface{}{
+				"name": "dir", "piece length": 32, "pieces": hashes(1),
+				"files": []interface{}{file(10, "..", "a")},
+			},
+			"invalid path of file 0",
+		},
+	} {
+		_, err := NewTorrent(writeTorrent(t, tt.info))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -2,26 +2,12 @@ package torrent
 
 import "fmt"
 
-type Piece struct {
-	Index  int
-	Length int
-	Hash   [20]byte
-}
-
-type PieceData struct {
+// A block of piece data received from a peer.
+type BlockData struct {
 	Index int
+	Begin int
 	Data  []byte
-}
-
-func (t *Torrent) NewWorkQueue() chan Piece {
-
-	workQ := make(chan Piece, len(t.Pieces))
-	// TODO: randomise order of pieces.
-	for idx, hash := range t.Pieces {
-		workQ <- Piece{idx, t.PieceSize(idx), hash}
-	}
-
-	return workQ
+	Peer  string // Address of the peer the block came from.
 }
 
 // Returns the begin and end index of a piece.
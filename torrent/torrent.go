@@ -14,10 +14,12 @@ type Torrent struct {
 	PieceLength  int
 	Pieces       [][20]byte
 	Files        []File
+	URLList      []string // Web seeds.
 }
 
 type File struct {
 	Path   string
+	Parts  []string // Every component of the path, Path is the first.
 	Length int
 }
 
@@ -1,28 +1,62 @@
 package tracker
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/0xNathanW/bittorrent-go/logging"
 	"github.com/jackpal/bencode-go"
 )
 
-const clientPort = 6881
+// Port we listen for peers on, unless changed with SetPort.
+const ClientPort = 6881
+
+// Time allowed for an announce, unless Client's timeout is changed.
+const DefaultTimeout = 10 * time.Second
+
+// Events sent with announces.
+const (
+	EventNone    = ""
+	EventPaused  = "paused"  // A partial seed, downloading nothing more (BEP 21).
+	EventStopped = "stopped" // Shutting down, see Stopped.
+)
 
 type Tracker struct {
 	Client         *http.Client
 	Announce       *url.URL
 	BackupAnnounce []*url.URL
+	mu             sync.Mutex // Guards Announce's query, announces run concurrently.
+	Logger         *logging.Logger
+
+	// From the last response, guarded by mu.
+	interval    time.Duration
+	minInterval time.Duration
+	noPaused    bool // The paused event was refused, it isn't sent again.
 }
 
+// Progress is the torrent's transfer totals, sent with every announce.
+type Progress struct {
+	Uploaded   int
+	Downloaded int
+	Left       int // Bytes we don't have yet.
+}
+
+// Returned when the tracker sends a failure reason.
+var errRefused = errors.New("tracker refused announce")
+
 type TrackerResponse struct {
-	PeersString string `bencode:"peers"`
-	Interval    int    `bencode:"interval"`
-	Complete    int    `bencode:"complete"`
-	Incomplete  int    `bencode:"incomplete"`
+	FailureReason string `bencode:"failure reason"`
+	PeersString   string `bencode:"peers"`
+	Interval      int    `bencode:"interval"`
+	MinInterval   int    `bencode:"min interval"`
+	Complete      int    `bencode:"complete"`
+	Incomplete    int    `bencode:"incomplete"`
 }
 
 // NewTracker creates a new tracker instance.
@@ -41,7 +75,7 @@ func NewTracker(announce string, backupAnnounce []string) (*Tracker, error) {
 	}
 	tracker := &Tracker{
 		Client: &http.Client{
-			Timeout: time.Second * 10,
+			Timeout: DefaultTimeout,
 		},
 		Announce:       announceURL,
 		BackupAnnounce: backupAnnounceURLs,
@@ -57,7 +91,7 @@ func (t *Tracker) InitParams(infoHash [20]byte, peerId [20]byte, size int) {
 	// String of length 20 which downloader uses as ID.
 	queryParams.Set("peer_id", string(peerId[:]))
 	// Port number peer is listening on.
-	queryParams.Set("port", strconv.Itoa(clientPort))
+	queryParams.Set("port", strconv.Itoa(ClientPort))
 	// Total amount uploaded so far, encoded in base 10 ascii.
 	queryParams.Set("uploaded", "0")
 	// Total amount downloaded so far, encoded in base 10 ascii.
@@ -66,23 +100,130 @@ func (t *Tracker) InitParams(infoHash [20]byte, peerId [20]byte, size int) {
 	queryParams.Set("left", strconv.Itoa(size))
 	// We want the compact string response.
 	queryParams.Set("compact", "0")
+	t.mu.Lock()
+	t.Announce.RawQuery = queryParams.Encode()
+	t.mu.Unlock()
+}
+
+// SetPort changes the port peers are told to connect to.
+func (t *Tracker) SetPort(port int) {
+	t.setParam("port", strconv.Itoa(port))
+}
+
+// SetEvent changes the event sent in announces that follow.
+func (t *Tracker) SetEvent(event string) {
+	t.setParam("event", event)
+}
+
+func (t *Tracker) setParam(key, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	queryParams := t.Announce.Query()
+	if value == "" {
+		queryParams.Del(key)
+	} else {
+		queryParams.Set(key, value)
+	}
 	t.Announce.RawQuery = queryParams.Encode()
 }
 
+// Returns the announce URL with the torrent's progress, and the event
+// it sends.
+func (t *Tracker) announceURL(pr Progress) (*url.URL, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := *t.Announce
+	query := u.Query()
+	query.Set("uploaded", strconv.Itoa(pr.Uploaded))
+	query.Set("downloaded", strconv.Itoa(pr.Downloaded))
+	query.Set("left", strconv.Itoa(pr.Left))
+	if query.Get("event") == EventPaused && t.noPaused {
+		query.Del("event")
+	}
+	u.RawQuery = query.Encode()
+	return &u, query.Get("event")
+}
+
 // Sends request to tracker, parses response returns string
 // version of a peer list.
-func (t *Tracker) RequestPeers() (string, error) {
-	resp, err := t.Client.Get(t.Announce.String())
+func (t *Tracker) RequestPeers(ctx context.Context, pr Progress) (string, error) {
+	u, event := t.announceURL(pr)
+	host := u.Host
+	resp, err := t.requestPeers(ctx, u.String())
+	// Paused (BEP 21) is newer than most trackers, those refusing it
+	// are told nothing, as while downloading.
+	if errors.Is(err, errRefused) && event == EventPaused {
+		t.Logger.Info("paused event refused", "tracker", host, "err", err)
+		t.mu.Lock()
+		t.noPaused = true
+		t.mu.Unlock()
+		u, _ = t.announceURL(pr)
+		resp, err = t.requestPeers(ctx, u.String())
+	}
 	if err != nil {
-		return "", fmt.Errorf("error making request to tracker: %s", err)
+		t.Logger.Warn("announce failed", "tracker", host, "err", err)
+		return "", err
+	}
+	interval := time.Duration(resp.Interval) * time.Second
+	t.mu.Lock()
+	t.interval = interval
+	t.minInterval = time.Duration(resp.MinInterval) * time.Second
+	t.mu.Unlock()
+	t.Logger.Debug("announced", "tracker", host, "peers", len(resp.PeersString)/6, "interval", interval)
+	return resp.PeersString, nil
+}
+
+// Interval returns how long the tracker asked us to wait between
+// announces, and the least it allows. Zero until it has said.
+func (t *Tracker) Interval() (interval, minInterval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.interval, t.minInterval
+}
+
+func (t *Tracker) requestPeers(ctx context.Context, announce string) (*TrackerResponse, error) {
+	resp, err := t.get(ctx, announce)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
-	trackerResponse := TrackerResponse{}
-	if err = bencode.Unmarshal(resp.Body, &trackerResponse); err != nil {
-		return "", fmt.Errorf("error decoding tracker response: %s", err)
+	trackerResponse := &TrackerResponse{}
+	if err = bencode.Unmarshal(resp.Body, trackerResponse); err != nil {
+		return nil, fmt.Errorf("error decoding tracker response: %s", err)
+	}
+	if trackerResponse.FailureReason != "" {
+		return nil, fmt.Errorf("%w: %s", errRefused, trackerResponse.FailureReason)
 	}
 	if len(trackerResponse.PeersString)%6 != 0 {
-		return "", fmt.Errorf("invalid peers string: %s", trackerResponse.PeersString)
+		return nil, fmt.Errorf("invalid peers string: %s", trackerResponse.PeersString)
+	}
+	return trackerResponse, nil
+}
+
+// Stopped tells the tracker we are shutting down, so it stops handing
+// out our address. The response is ignored.
+func (t *Tracker) Stopped(ctx context.Context, pr Progress) error {
+	u, _ := t.announceURL(pr)
+	query := u.Query()
+	query.Set("event", EventStopped)
+	u.RawQuery = query.Encode()
+	resp, err := t.get(ctx, u.String())
+	if err != nil {
+		t.Logger.Warn("stopped announce failed", "tracker", u.Host, "err", err)
+		return err
+	}
+	t.Logger.Debug("announced stopped", "tracker", u.Host)
+	return resp.Body.Close()
+}
+
+func (t *Tracker) get(ctx context.Context, announce string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, announce, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error making request to tracker: %s", err)
+	}
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request to tracker: %s", err)
 	}
-	return trackerResponse.PeersString, nil
+	return resp, nil
 }
@@ -0,0 +1,138 @@
+package ui
+
+import (
+	"fmt"
+
+	"github.com/0xNathanW/bittorrent-go/ratelimit"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// Rates the limits step through, in bytes per second.
+var limitSteps = []int{
+	32 << 10, 64 << 10, 128 << 10, 256 << 10, 512 << 10,
+	1 << 20, 2 << 20, 5 << 20, 10 << 20,
+}
+
+func newLimits() *tview.TextView {
+	limits := tview.NewTextView().
+		SetDynamicColors(true).
+		SetScrollable(false)
+	limits.SetBorder(true).
+		SetTitle(" Limits ").
+		SetBorderPadding(0, 0, 1, 1)
+	return limits
+}
+
+// BindLimits shows the upload and download limits and lets them be
+// changed at runtime, u/U lowers/raises upload and d/D download.
+func (ui *UI) BindLimits(up, down *ratelimit.Limiter) {
+	ui.upLimit, ui.downLimit = up, down
+	ui.updateLimits(up, down)
+
+	ui.bindKeys(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Rune() {
+		case 'u':
+			up.SetRate(stepLimit(up.Rate(), -1))
+		case 'U':
+			up.SetRate(stepLimit(up.Rate(), 1))
+		case 'd':
+			down.SetRate(stepLimit(down.Rate(), -1))
+		case 'D':
+			down.SetRate(stepLimit(down.Rate(), 1))
+		default:
+			return event
+		}
+		ui.updateLimits(up, down)
+		return nil
+	})
+}
+
+// BindSuperSeed shows whether super-seeding is on and lets s toggle it.
+func (ui *UI) BindSuperSeed(on bool, set func(bool)) {
+	ui.superSeed = &on
+	ui.updateLimits(ui.upLimit, ui.downLimit)
+
+	ui.bindKeys(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Rune() != 's' {
+			return event
+		}
+		on = !on
+		set(on)
+		ui.updateLimits(ui.upLimit, ui.downLimit)
+		return nil
+	})
+}
+
+// Adds a key handler ahead of those already bound.
+func (ui *UI) bindKeys(handler func(event *tcell.EventKey) *tcell.EventKey) {
+	prev := ui.App.GetInputCapture()
+	ui.App.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event = handler(event); event == nil || prev == nil {
+			return event
+		}
+		return prev(event)
+	})
+}
+
+func (ui *UI) updateLimits(up, down *ratelimit.Limiter) {
+	if up == nil || down == nil {
+		return
+	}
+	text := fmt.Sprintf(
+		"Up: [blue]%s[-]  Down: [blue]%s[-]  (u/U, d/D to change)",
+		limitString(up.Rate()), limitString(down.Rate()),
+	)
+	if ui.superSeed != nil {
+		text += fmt.Sprintf("  Super-seed: [blue]%s[-] (s)", onOff(*ui.superSeed))
+	}
+	ui.Limits.SetText(text)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// Moves to the next step up or down, unlimited is above the highest.
+func stepLimit(rate, dir int) int {
+	if rate == ratelimit.Unlimited {
+		if dir < 0 {
+			return limitSteps[len(limitSteps)-1]
+		}
+		return ratelimit.Unlimited
+	}
+	for i, step := range limitSteps {
+		if step >= rate {
+			if step > rate && dir > 0 {
+				dir = 0 // Between steps, raising lands on the step above.
+			}
+			i += dir
+			switch {
+			case i < 0:
+				return limitSteps[0]
+			case i >= len(limitSteps):
+				return ratelimit.Unlimited
+			}
+			return limitSteps[i]
+		}
+	}
+	// Above the highest step.
+	if dir < 0 {
+		return limitSteps[len(limitSteps)-1]
+	}
+	return ratelimit.Unlimited
+}
+
+func limitString(rate int) string {
+	switch {
+	case rate == ratelimit.Unlimited:
+		return "unlimited"
+	case rate >= 1<<20:
+		return fmt.Sprintf("%.1f MB/s", float64(rate)/(1<<20))
+	default:
+		return fmt.Sprintf("%d KB/s", rate>>10)
+	}
+}
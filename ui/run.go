@@ -0,0 +1,88 @@
+package ui
+
+import (
+	"context"
+	"time"
+
+	"github.com/0xNathanW/bittorrent-go/client"
+	"github.com/0xNathanW/bittorrent-go/ratelimit"
+)
+
+// Run shows the dashboard for a torrent until it is quit or ctx is done,
+// redrawing at most once every refreshRate.
+func Run(ctx context.Context, c *client.Client, refreshRate time.Duration) error {
+	if refreshRate <= 0 {
+		refreshRate = DefaultRefreshRate
+	}
+	ui, err := NewUI(c.Torrent)
+	if err != nil {
+		return err
+	}
+	ui.BindLimits(ratelimit.GlobalUp, ratelimit.GlobalDown)
+	ui.BindSuperSeed(c.SuperSeeding(), c.SetSuperSeed)
+
+	events, cancel := c.Subscribe()
+	defer cancel()
+	dirty := false // Only touched on the event loop.
+	go func() {
+		for e := range events {
+			e := e
+			ui.App.QueueUpdate(func() {
+				ui.handle(e)
+				dirty = true
+			})
+		}
+	}()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		tick := time.NewTicker(refreshRate)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				ui.App.Stop()
+				return
+			case <-stop:
+				return
+			}
+			ui.App.QueueUpdate(func() {
+				if dirty {
+					dirty = false
+					ui.App.Draw()
+				}
+			})
+		}
+	}()
+
+	// Run tview event loop.
+	return ui.App.SetFocus(ui.PeerTable).Run()
+}
+
+// Updates the dashboard with a torrent event.
+func (ui *UI) handle(e client.Event) {
+	switch e := e.(type) {
+	case client.PeerAdded:
+		if e.Replaced != nil {
+			ui.RemovePeer(e.Replaced)
+		}
+		ui.AddPeer(e.Peer)
+	case client.PeerRemoved:
+		ui.RemovePeer(e.Peer)
+	case client.PeerActivity:
+		ui.AddActivity(e.Activity)
+	case client.PeersChanged:
+		ui.UpdateTable()
+	case client.PieceDone:
+		ui.UpdateProgress(e.Done)
+		ui.UpdateTable()
+	case client.Transfer:
+		// Graph shows MiB per interval.
+		ui.Graph.Update(float64(e.Downloaded) / (1024 * 1024))
+	case client.BansChanged:
+		ui.UpdateBans(e.Bans)
+	case client.FilterChanged:
+		ui.UpdateFilter(e.Ranges, e.Blocked)
+	}
+}
@@ -6,14 +6,15 @@ import (
 	"time"
 
 	"github.com/0xNathanW/bittorrent-go/p2p"
+	"github.com/0xNathanW/bittorrent-go/ratelimit"
 	"github.com/0xNathanW/bittorrent-go/torrent"
 	"github.com/gdamore/tcell/v2"
 	"github.com/navidys/tvxwidgets"
 	"github.com/rivo/tview"
 )
 
-// Refresh rate for display.
-const RefreshRate = time.Second / 60
+// Refresh rate for display, unless given to Run.
+const DefaultRefreshRate = time.Second / 60
 
 const bannerTxt = `   ___ _ _  _____                          _          ___      
   / __(_) |/__   \___  _ __ _ __ ___ _ __ | |_       / _ \___  
@@ -23,17 +24,26 @@ const bannerTxt = `   ___ _ _  _____                          _          ___
 `
 
 type UI struct {
-	App       *tview.Application
-	Layout    *tview.Grid
-	Graph     *Graph
-	Progress  *tvxwidgets.PercentageModeGauge
+	App      *tview.Application
+	Layout   *tview.Grid
+	Graph    *Graph
+	Progress *tvxwidgets.PercentageModeGauge
+	Limits   *tview.TextView
+	Bans     *tview.TextView
+	banList  []string
+	filter   string // IP filter stats shown above the bans.
+	// Shown in the limits panel, see BindLimits and BindSuperSeed.
+	upLimit   *ratelimit.Limiter
+	downLimit *ratelimit.Limiter
+	superSeed *bool
 	PeerTable *tview.Table
 	PeerPages *tview.Pages
+	activity  map[string]*tview.TextView // Each peer's activity, by address.
 	rightFlex *tview.Flex
 }
 
-// Creates a new UI instance.
-func NewUI(t *torrent.Torrent, peers map[string]*p2p.Peer) (*UI, error) {
+// Creates a new UI instance, peers are added as they connect.
+func NewUI(t *torrent.Torrent) (*UI, error) {
 
 	ui := &UI{
 		App: tview.NewApplication(),
@@ -46,10 +56,15 @@ func NewUI(t *torrent.Torrent, peers map[string]*p2p.Peer) (*UI, error) {
 
 		Graph: newGraph(),
 
-		PeerPages: newPeerPages(peers),
+		PeerPages: tview.NewPages(),
+		activity:  make(map[string]*tview.TextView),
 
 		Progress: tvxwidgets.NewPercentageModeGauge(),
 
+		Limits: newLimits(),
+
+		Bans: newBans(),
+
 		rightFlex: tview.NewFlex().
 			SetDirection(tview.FlexRow),
 	}
@@ -59,8 +74,10 @@ func NewUI(t *torrent.Torrent, peers map[string]*p2p.Peer) (*UI, error) {
 
 	ui.rightFlex.AddItem(ui.Graph.Object, 0, 1, false)
 	ui.rightFlex.AddItem(ui.Progress, 5, 0, false)
+	ui.rightFlex.AddItem(ui.Limits, 3, 0, false)
+	ui.rightFlex.AddItem(ui.Bans, 6, 0, false)
 
-	ui.newPeerTable(peers)
+	ui.newPeerTable()
 	ui.PeerTable.SetSelectionChangedFunc(
 		func(row, column int) {
 			ui.PeerPages.SwitchToPage(ui.PeerTable.GetCell(row, 0).Text)
@@ -125,11 +142,47 @@ func (ui *UI) drawLayout(t *torrent.Torrent) {
 	)
 }
 
+func newBans() *tview.TextView {
+	bans := tview.NewTextView().
+		SetDynamicColors(true).
+		SetScrollable(true).
+		ScrollToEnd()
+	bans.SetBorder(true).
+		SetTitle(" Banned ").
+		SetBorderPadding(0, 0, 1, 1)
+	return bans
+}
+
+// Shows the banned peers, one per line with the reason.
+func (ui *UI) UpdateBans(list []string) {
+	ui.banList = list
+	ui.drawBans()
+}
+
+// Shows the number of ranges in the IP filter and addresses it blocked.
+func (ui *UI) UpdateFilter(ranges int, blocked uint64) {
+	if ranges == 0 {
+		ui.filter = ""
+	} else {
+		ui.filter = fmt.Sprintf("[yellow]filter: %d ranges, %d blocked[-]", ranges, blocked)
+	}
+	ui.drawBans()
+}
+
+func (ui *UI) drawBans() {
+	ui.Bans.SetTitle(fmt.Sprintf(" Banned (%d) ", len(ui.banList)))
+	lines := ui.banList
+	if ui.filter != "" {
+		lines = append([]string{ui.filter}, lines...)
+	}
+	ui.Bans.SetText(strings.Join(lines, "\n"))
+}
+
 func (ui *UI) UpdateProgress(done int) {
 	ui.Progress.SetValue(done)
 }
 
-func (ui *UI) newPeerTable(peers map[string]*p2p.Peer) {
+func (ui *UI) newPeerTable() {
 
 	s := tcell.Style{}.
 		Background(tcell.ColorWhite).
@@ -147,12 +200,14 @@ func (ui *UI) newPeerTable(peers map[string]*p2p.Peer) {
 
 	columnNames := []string{
 		"IP",
+		"Client",
 		"Active",
 		"Down",
 		"Up",
 		"Reciprocate",
 		"Choked",
 		"IsChoking",
+		"Snubbed",
 	}
 
 	// First row is the column names.
@@ -171,57 +226,113 @@ func (ui *UI) newPeerTable(peers map[string]*p2p.Peer) {
 		table.SetCell(0, i, cell)
 	}
 
-	// Fill table.
-	row := 1
-	for _, peer := range peers {
-		for c := range columnNames {
+	ui.PeerTable = table
+}
 
-			var alignment int // Align all center apart from IP column.
-			if c != 0 {
-				alignment = 1
-			}
+// Appends a row for the peer to the table.
+func (ui *UI) addRow(peer *p2p.Peer) {
+	row := ui.PeerTable.GetRowCount()
+	for c := 0; c < ui.PeerTable.GetColumnCount(); c++ {
 
-			colour := tcell.ColorWhite
-			cell := &tview.TableCell{
-				Reference: peer,
-				Align:     alignment,
-				Color:     colour,
-			}
-			cell.SetTransparency(true).
-				SetExpansion(1)
+		var alignment int // Align all center apart from IP column.
+		if c != 0 {
+			alignment = 1
+		}
 
-			table.SetCell(row, c, cell)
+		colour := tcell.ColorWhite
+		cell := &tview.TableCell{
+			Reference: peer,
+			Align:     alignment,
+			Color:     colour,
 		}
-		row++
+		cell.SetTransparency(true).
+			SetExpansion(1)
+
+		ui.PeerTable.SetCell(row, c, cell)
 	}
+}
 
-	ui.PeerTable = table
+// Adds a peer to the table and activity pages, unless already shown.
+// Must be called from the tview event loop, eg. through QueueUpdateDraw.
+func (ui *UI) AddPeer(peer *p2p.Peer) {
+	for r := 1; r < ui.PeerTable.GetRowCount(); r++ {
+		if ui.PeerTable.GetCell(r, 0).Reference == peer {
+			return
+		}
+	}
+	ui.addRow(peer)
+	ui.activityView(peer.IP.String())
+	if ui.PeerTable.GetRowCount() == 2 { // The first peer is selected.
+		ui.PeerPages.SwitchToPage(strings.Split(peer.IP.String(), ":")[0])
+	}
 	ui.UpdateTable()
 }
 
-func newPeerPages(peers map[string]*p2p.Peer) *tview.Pages {
-
-	peerPages := tview.NewPages()
+// Removes a peer from the table and activity pages, eg. when it is
+// replaced by a new connection from the same address.
+// Must be called from the tview event loop.
+func (ui *UI) RemovePeer(peer *p2p.Peer) {
+	for r := 1; r < ui.PeerTable.GetRowCount(); r++ {
+		if ui.PeerTable.GetCell(r, 0).Reference == peer {
+			ui.PeerTable.RemoveRow(r)
+			break
+		}
+	}
+	ui.PeerPages.RemovePage(strings.Split(peer.IP.String(), ":")[0])
+	delete(ui.activity, peer.IP.String())
+}
 
-	for address, peer := range peers {
-		peerPages.AddPage(strings.Split(address, ":")[0], peer.Activity, true, false)
+// Shows activity on a peer's connection.
+// Must be called from the tview event loop.
+func (ui *UI) AddActivity(a p2p.Activity) {
+	var line string
+	switch a.Kind {
+	case p2p.ActivitySent:
+		line = "==> " + a.Text
+	case p2p.ActivityReceived:
+		line = "<== " + a.Text
+	case p2p.ActivityOK:
+		line = "[green]" + tview.Escape(a.Text) + "[-]"
+	case p2p.ActivityError:
+		line = "[red]" + tview.Escape(a.Text) + "[-]"
+	default:
+		line = "[blue]" + tview.Escape(a.Text) + "[-]"
 	}
+	ui.activityView(a.Peer).Write([]byte(line + "\n\n"))
+}
 
-	name, _ := peerPages.GetFrontPage()
-	peerPages.SwitchToPage(name)
-	return peerPages
+// Returns the activity page for the peer at addr, creating it if needed.
+func (ui *UI) activityView(addr string) *tview.TextView {
+	if view, ok := ui.activity[addr]; ok {
+		return view
+	}
+	view := tview.NewTextView().
+		SetScrollable(true).
+		ScrollToEnd().
+		SetDynamicColors(true).
+		SetMaxLines(20)
+	view.SetBorder(true).
+		SetTitle("Activity").
+		SetTitleAlign(tview.AlignLeft).
+		SetBorderPadding(1, 1, 2, 2)
+
+	ui.activity[addr] = view
+	ui.PeerPages.AddPage(strings.Split(addr, ":")[0], view, true, false)
+	return view
 }
 
 func (ui *UI) UpdateTable() {
 
 	columnNames := []string{
 		"IP",
+		"Client",
 		"Active",
 		"Down",
 		"Up",
 		"Reciprocate",
 		"Choked",
 		"IsChoking",
+		"Snubbed",
 	}
 
 	for r := 1; r < ui.PeerTable.GetRowCount(); r++ {
@@ -229,15 +340,19 @@ func (ui *UI) UpdateTable() {
 
 			cell := ui.PeerTable.GetCell(r, c)
 			peer := cell.Reference.(*p2p.Peer)
+			snap := peer.Snapshot()
 
 			switch name {
 
 			case "IP":
 				cell.SetText(strings.Split(peer.IP.String(), ":")[0])
 
+			case "Client":
+				cell.SetText(tview.Escape(snap.Client)) // Named by the peer.
+
 			case "Active":
-				cell.SetText(boolString(peer.Active))
-				if peer.Active {
+				cell.SetText(boolString(snap.Active))
+				if snap.Active {
 					cell.SetTextColor(tcell.ColorGreen)
 				} else {
 					cell.SetTextColor(tcell.ColorRed)
@@ -245,47 +360,55 @@ func (ui *UI) UpdateTable() {
 
 			// For display, down/upload speed simply amount/(seconds since start)
 			case "Down":
-				if peer.Active {
+				if snap.Active {
 					cell.SetText(fmt.Sprintf("%4.2f",
-						(float64(peer.Rates.Downloaded)/1024/1024)/
-							(time.Since(peer.Start).Seconds())))
+						(float64(snap.Downloaded)/1024/1024)/
+							(time.Since(snap.Start).Seconds())))
 				} else {
 					cell.SetText(fmt.Sprintf("%4.2f", float64(0)))
 				}
 
 			case "Up":
-				if peer.Active {
+				if snap.Active {
 					cell.SetText(fmt.Sprintf("%4.2f",
-						(float64(peer.Rates.Uploaded)/1024/1024)/
-							(time.Since(peer.Start).Seconds())))
+						(float64(snap.Uploaded)/1024/1024)/
+							(time.Since(snap.Start).Seconds())))
 				} else {
 					cell.SetText(fmt.Sprintf("%4.2f", float64(0)))
 				}
 
 			case "Reciprocate":
-				cell.SetText(boolString(peer.Downloading))
-				if peer.Downloading {
+				cell.SetText(boolString(snap.Downloading))
+				if snap.Downloading {
 					cell.SetTextColor(tcell.ColorBlue)
 				} else {
 					cell.SetTextColor(tcell.ColorRed)
 				}
 
 			case "Choked":
-				cell.SetText(boolString(peer.Choked))
-				if !peer.Choked {
+				cell.SetText(boolString(snap.Choked))
+				if !snap.Choked {
 					cell.SetTextColor(tcell.ColorBlue)
 				} else {
 					cell.SetTextColor(tcell.ColorWhite)
 				}
 
 			case "IsChoking":
-				cell.SetText(boolString(peer.IsChoking))
-				if !peer.IsChoking {
+				cell.SetText(boolString(snap.IsChoking))
+				if !snap.IsChoking {
 					cell.SetTextColor(tcell.ColorBlue)
 				} else {
 					cell.SetTextColor(tcell.ColorWhite)
 				}
 
+			case "Snubbed":
+				cell.SetText(boolString(snap.Snubbed))
+				if snap.Snubbed {
+					cell.SetTextColor(tcell.ColorRed)
+				} else {
+					cell.SetTextColor(tcell.ColorWhite)
+				}
+
 			default:
 				continue
 			}
@@ -0,0 +1,686 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	mss            = 1400    // Maximum payload per packet.
+	maxWindow      = 1 << 20 // Upper bound on the congestion window.
+	recvBufferSize = 1 << 20 // Bytes we buffer before advertising a zero window.
+	maxRetransmits = 8       // Retransmissions before giving up on a packet.
+	synRetries     = 3       // SYN retransmissions when connecting.
+	minRTO         = 500 * time.Millisecond
+	maxRTO         = 60 * time.Second
+	finLinger      = 10 * time.Second // Time to wait for our FIN to be acked.
+
+	// LEDBAT congestion control, keeps the delay we add to the path
+	// near target so other traffic isn't pushed aside.
+	target            = 100000 // Target queuing delay in microseconds.
+	maxCwndIncrease   = 3000   // Most the window grows per RTT, in bytes.
+	baseDelayInterval = time.Minute
+	baseDelayHistory  = 2 // Minutes of base delay history kept.
+)
+
+var (
+	ErrReset   = errors.New("utp: connection reset by peer")
+	ErrTimeout = errors.New("utp: connection timed out")
+)
+
+type state int
+
+const (
+	stateSynSent state = iota
+	stateConnected
+	stateClosed
+)
+
+// An unacked packet.
+type outPacket struct {
+	typ           byte
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	fastResent    bool
+}
+
+// Conn is a uTP connection, it implements net.Conn.
+type Conn struct {
+	s          *Socket
+	raddr      net.Addr
+	recvID     uint16
+	sendID     uint16
+	ownsSocket bool // Socket was created by Dial and closes with the conn.
+
+	mu      sync.Mutex
+	changed chan struct{} // Closed and replaced whenever state changes.
+	state   state
+	err     error // Set once the connection fails.
+	closed  bool  // Close has been called.
+
+	// Sending.
+	seq        uint16       // Next sequence number to send.
+	outbuf     []*outPacket // Unacked packets, in sequence order.
+	inflight   int          // Payload bytes unacked.
+	cwnd       int          // Congestion window in bytes.
+	peerWnd    int          // The peer's advertised receive window.
+	lastAck    uint16
+	dupAcks    int
+	finSeq     uint16 // Sequence number of our FIN.
+	finSent    bool
+	finAt      time.Time
+	synAt      time.Time
+	synRetries int
+
+	// Round trip time estimates.
+	rtt    time.Duration
+	rttVar time.Duration
+	rto    time.Duration
+
+	// LEDBAT delay history.
+	baseDelays  []uint32 // Minimum delay seen in each interval.
+	baseStarted time.Time
+
+	// Receiving.
+	ack        uint16            // Last sequence number received in order.
+	ooo        map[uint16][]byte // Packets received out of order.
+	readBuf    []byte
+	replyMicro uint32 // Delay of the last packet received, echoed back.
+	gotFin     bool
+	peerFin    uint16 // Sequence number of the peer's FIN.
+	eof        bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		s:       s,
+		raddr:   raddr,
+		recvID:  recvID,
+		sendID:  sendID,
+		changed: make(chan struct{}),
+		cwnd:    2 * mss,
+		peerWnd: mss,
+		rto:     time.Second,
+		ooo:     make(map[uint16][]byte),
+	}
+}
+
+// Wakes anything waiting on the connection, c.mu must be held.
+func (c *Conn) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Waits for a state change or the deadline, c.mu must be held.
+func (c *Conn) wait(deadline time.Time) error {
+	ch := c.changed
+	c.mu.Unlock()
+	defer c.mu.Lock()
+
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// --------------------------- Setup / teardown ---------------------------//
+
+// Sends a SYN and waits for the peer's state packet.
+func (c *Conn) connect(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state = stateSynSent
+	c.seq = 2 // The SYN takes sequence number 1.
+	c.sendSyn()
+
+	deadline := time.Now().Add(timeout)
+	for c.state == stateSynSent && c.err == nil {
+		if err := c.wait(deadline); err != nil {
+			c.state = stateClosed
+			return ErrTimeout
+		}
+	}
+	return c.err
+}
+
+func (c *Conn) sendSyn() {
+	// SYN carries our receive ID, the peer replies on it.
+	h := header{typ: stSyn, connID: c.recvID, seq: 1, wnd: recvBufferSize}
+	h.timestamp = now()
+	c.s.write(h.marshal(nil), c.raddr)
+	c.synAt = time.Now()
+}
+
+// Sets up an accepted connection from the peer's SYN.
+func (c *Conn) accept(syn *header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = stateConnected
+	c.seq = uint16(time.Now().UnixNano())
+	c.ack = syn.seq
+	c.lastAck = c.seq - 1
+	c.replyMicro = now() - syn.timestamp
+	c.sendState()
+}
+
+// Close sends a FIN, the connection lingers until it is acked.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.state == stateConnected && c.err == nil {
+		c.finSeq = c.seq
+		c.finSent = true
+		c.finAt = time.Now()
+		c.sendPacket(stFin, nil)
+	} else {
+		c.shutdown()
+	}
+	c.broadcast()
+	return nil
+}
+
+// Fails the connection, waking anything blocked on it.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = stateClosed
+	c.broadcast()
+}
+
+// Removes the connection from its socket, c.mu must be held.
+func (c *Conn) shutdown() {
+	c.state = stateClosed
+	go func() {
+		c.s.remove(c)
+		if c.ownsSocket {
+			c.s.Close()
+		}
+	}()
+}
+
+// ------------------------------- Reading -------------------------------//
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.readBuf) == 0 {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		}
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+	wasFull := c.window() < mss
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	// Let the peer know the window has opened.
+	if wasFull && c.window() >= mss {
+		c.sendState()
+	}
+	return n, nil
+}
+
+// Our receive window, the space left in our buffers.
+func (c *Conn) window() int {
+	used := len(c.readBuf)
+	for _, p := range c.ooo {
+		used += len(p)
+	}
+	if used > recvBufferSize {
+		return 0
+	}
+	return recvBufferSize - used
+}
+
+// ------------------------------- Writing -------------------------------//
+
+// Write splits b into packets, sending each once the window allows.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		switch {
+		case c.closed || c.finSent:
+			return written, net.ErrClosed
+		case c.err != nil:
+			return written, c.err
+		}
+		size := len(b) - written
+		if size > mss {
+			size = mss
+		}
+		if !c.canSend(size) {
+			if err := c.wait(c.writeDeadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		payload := append([]byte(nil), b[written:written+size]...)
+		c.sendPacket(stData, payload)
+		written += size
+	}
+	return written, nil
+}
+
+// Reports whether a packet of size fits in the send window.
+func (c *Conn) canSend(size int) bool {
+	wnd := c.cwnd
+	if c.peerWnd < wnd {
+		wnd = c.peerWnd
+	}
+	// Always allow one packet in flight, so a zero window is probed.
+	if c.inflight == 0 {
+		return true
+	}
+	return c.inflight+size <= wnd
+}
+
+// Sends a sequenced packet and adds it to the unacked buffer.
+func (c *Conn) sendPacket(typ byte, payload []byte) {
+	p := &outPacket{typ: typ, seq: c.seq, payload: payload}
+	c.seq++
+	c.outbuf = append(c.outbuf, p)
+	c.inflight += len(payload)
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	h := c.header(p.typ)
+	h.seq = p.seq
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.s.write(h.marshal(p.payload), c.raddr)
+}
+
+// Sends an ack.
+func (c *Conn) sendState() {
+	h := c.header(stState)
+	h.seq = c.seq
+	h.sack = c.selectiveAck()
+	c.s.write(h.marshal(nil), c.raddr)
+}
+
+func (c *Conn) header(typ byte) header {
+	return header{
+		typ:       typ,
+		connID:    c.sendID,
+		timestamp: now(),
+		tsDiff:    c.replyMicro,
+		wnd:       uint32(c.window()),
+		ack:       c.ack,
+	}
+}
+
+// Builds a bitmask of the packets received out of order past ack + 1.
+func (c *Conn) selectiveAck() []byte {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+	sack := make([]byte, 4)
+	for seq := range c.ooo {
+		i := int(seq - c.ack - 2)
+		if i < 0 || i >= len(sack)*8 {
+			continue
+		}
+		sack[i/8] |= 1 << uint(i%8)
+	}
+	return sack
+}
+
+// ------------------------------- Receiving -------------------------------//
+
+// Handles a packet from the socket.
+func (c *Conn) receive(h *header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.broadcast()
+
+	c.replyMicro = now() - h.timestamp
+	c.peerWnd = int(h.wnd)
+
+	switch h.typ {
+	case stReset:
+		c.err = ErrReset
+		c.state = stateClosed
+		c.shutdown()
+		return
+
+	case stSyn: // Duplicate SYN.
+		c.sendState()
+		return
+	}
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		// The state packet carries the sequence number of the peer's
+		// first data packet.
+		c.state = stateConnected
+		c.ack = h.seq - 1
+		c.lastAck = h.ack
+		c.outbuf = nil
+		c.updateRTT(time.Since(c.synAt))
+		return
+	}
+
+	c.processAck(h)
+
+	switch h.typ {
+	case stData:
+		c.receiveData(h.seq, payload)
+		c.sendState()
+
+	case stFin:
+		if !c.gotFin {
+			c.gotFin = true
+			c.peerFin = h.seq
+		}
+		c.receiveData(h.seq, []byte{})
+		c.sendState()
+	}
+
+	// Both sides done, the connection can go.
+	if c.finSent && len(c.outbuf) == 0 && (c.eof || c.closed) {
+		c.shutdown()
+	}
+}
+
+// Places a data packet in order, buffering it if it arrived early.
+func (c *Conn) receiveData(seq uint16, payload []byte) {
+	if !seqLess(c.ack, seq) {
+		return // Duplicate.
+	}
+	if seq != c.ack+1 {
+		if _, ok := c.ooo[seq]; !ok && c.window() >= len(payload) {
+			c.ooo[seq] = payload
+		}
+		return
+	}
+	c.deliver(seq, payload)
+	// Drain packets that are now in order.
+	for {
+		next, ok := c.ooo[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.ooo, c.ack+1)
+		c.deliver(c.ack+1, next)
+	}
+}
+
+func (c *Conn) deliver(seq uint16, payload []byte) {
+	c.ack = seq
+	if !c.closed {
+		c.readBuf = append(c.readBuf, payload...)
+	}
+	if c.gotFin && c.ack == c.peerFin {
+		c.eof = true
+	}
+}
+
+// Removes acked packets from the send buffer, updating the window.
+func (c *Conn) processAck(h *header) {
+	acked := 0
+	remaining := c.outbuf[:0]
+	for _, p := range c.outbuf {
+		if !seqLess(h.ack, p.seq) || sacked(h.sack, h.ack, p.seq) {
+			acked += len(p.payload)
+			// Karn's algorithm, only sample packets sent once.
+			if p.transmissions == 1 {
+				c.updateRTT(time.Since(p.sentAt))
+			}
+			continue
+		}
+		remaining = append(remaining, p)
+	}
+	c.outbuf = remaining
+	c.inflight -= acked
+
+	if acked > 0 {
+		c.dupAcks = 0
+		c.lastAck = h.ack
+		c.resetRTO()
+		if h.tsDiff != 0 {
+			c.ledbat(acked, h.tsDiff)
+		}
+	} else if h.ack == c.lastAck && len(c.outbuf) > 0 && h.typ == stState {
+		c.dupAcks++
+	}
+
+	// Fast retransmit the first unacked packet after three duplicate
+	// acks, and any packet with three selectively acked after it.
+	resent := false
+	for i, p := range c.outbuf {
+		if p.fastResent {
+			continue
+		}
+		if (i == 0 && c.dupAcks >= 3) || sackedAfter(h.sack, h.ack, p.seq) >= 3 {
+			p.fastResent = true
+			resent = true
+			c.transmit(p)
+		}
+	}
+	if resent {
+		c.lost()
+	}
+}
+
+// Counts the packets after seq acked in the selective ack bitmask.
+func sackedAfter(sack []byte, ack, seq uint16) int {
+	n := 0
+	for i := 0; i < len(sack)*8; i++ {
+		if s := ack + 2 + uint16(i); seqLess(seq, s) && sacked(sack, ack, s) {
+			n++
+		}
+	}
+	return n
+}
+
+// LEDBAT, grows the window while the queuing delay we measure is below
+// target and shrinks it when above.
+func (c *Conn) ledbat(acked int, delay uint32) {
+	c.updateBaseDelay(delay)
+	base := c.baseDelay()
+	queuing := int64(delay - base)
+	offTarget := float64(target-queuing) / float64(target)
+
+	windowFactor := float64(acked) / float64(c.cwnd)
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	c.cwnd += int(maxCwndIncrease * offTarget * windowFactor)
+	if c.cwnd < mss {
+		c.cwnd = mss
+	}
+	if c.cwnd > maxWindow {
+		c.cwnd = maxWindow
+	}
+}
+
+// Tracks the minimum delay per interval, the lowest of which is
+// taken to be the delay of the path with empty queues.
+func (c *Conn) updateBaseDelay(delay uint32) {
+	if len(c.baseDelays) == 0 || time.Since(c.baseStarted) > baseDelayInterval {
+		c.baseDelays = append(c.baseDelays, delay)
+		if len(c.baseDelays) > baseDelayHistory {
+			c.baseDelays = c.baseDelays[1:]
+		}
+		c.baseStarted = time.Now()
+		return
+	}
+	last := len(c.baseDelays) - 1
+	if int32(delay-c.baseDelays[last]) < 0 {
+		c.baseDelays[last] = delay
+	}
+}
+
+func (c *Conn) baseDelay() uint32 {
+	base := c.baseDelays[0]
+	for _, d := range c.baseDelays[1:] {
+		if int32(d-base) < 0 {
+			base = d
+		}
+	}
+	return base
+}
+
+// Halves the window on loss.
+func (c *Conn) lost() {
+	c.cwnd /= 2
+	if c.cwnd < mss {
+		c.cwnd = mss
+	}
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.resetRTO()
+}
+
+// Sets the retransmission timeout from the RTT estimates, undoing backoff.
+func (c *Conn) resetRTO() {
+	if c.rtt == 0 {
+		return
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// Called periodically by the socket to retransmit timed out packets.
+func (c *Conn) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case stateClosed:
+		return
+
+	case stateSynSent:
+		if time.Since(c.synAt) < c.rto {
+			return
+		}
+		if c.synRetries >= synRetries {
+			c.err = ErrTimeout
+			c.state = stateClosed
+			c.broadcast()
+			return
+		}
+		c.synRetries++
+		c.rto *= 2
+		c.sendSyn()
+		return
+	}
+
+	if c.finSent && time.Since(c.finAt) > finLinger {
+		c.shutdown()
+		return
+	}
+	if len(c.outbuf) == 0 {
+		return
+	}
+	p := c.outbuf[0]
+	if time.Since(p.sentAt) < c.rto {
+		return
+	}
+	if p.transmissions > maxRetransmits {
+		c.err = ErrTimeout
+		c.shutdown()
+		c.broadcast()
+		return
+	}
+	// Timeout, back off and start again from a single packet.
+	c.cwnd = mss
+	c.rto *= 2
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+	c.transmit(p)
+	c.broadcast()
+}
+
+// ------------------------------- net.Conn -------------------------------//
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.broadcast()
+	return nil
+}
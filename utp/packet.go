@@ -0,0 +1,147 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+/* Every uTP packet starts with a 20 byte header:
+ *
+ * 0       4       8               16              24              32
+ * +-------+-------+---------------+---------------+---------------+
+ * | type  | ver   | extension     | connection_id                 |
+ * +-------+-------+---------------+---------------+---------------+
+ * | timestamp_microseconds                                        |
+ * +---------------+---------------+---------------+---------------+
+ * | timestamp_difference_microseconds                             |
+ * +---------------+---------------+---------------+---------------+
+ * | wnd_size                                                      |
+ * +---------------+---------------+---------------+---------------+
+ * | seq_nr                        | ack_nr                        |
+ * +---------------+---------------+---------------+---------------+
+ *
+ * Followed by a chain of extensions: <next extension><len><data>.
+ */
+
+const (
+	stData  = 0 // Regular data packet.
+	stFin   = 1 // Finalise the connection, the last packet.
+	stState = 2 // State packet, an ack with no data.
+	stReset = 3 // Terminate the connection forcefully.
+	stSyn   = 4 // Connect, starts a connection.
+
+	version    = 1
+	headerSize = 20
+
+	extNone      = 0
+	extSelectAck = 1
+)
+
+var typeNames = map[byte]string{
+	stData:  "ST_DATA",
+	stFin:   "ST_FIN",
+	stState: "ST_STATE",
+	stReset: "ST_RESET",
+	stSyn:   "ST_SYN",
+}
+
+type header struct {
+	typ       byte
+	connID    uint16
+	timestamp uint32
+	tsDiff    uint32
+	wnd       uint32
+	seq       uint16
+	ack       uint16
+	sack      []byte // Selective ack bitmask, nil if not present.
+}
+
+var errInvalidPacket = errors.New("utp: invalid packet")
+
+// Serialises the header and payload into a packet.
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	if h.sack != nil {
+		size += 2 + len(h.sack)
+	}
+	buf := make([]byte, size)
+	buf[0] = h.typ<<4 | version
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.tsDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+	n := headerSize
+	if h.sack != nil {
+		buf[1] = extSelectAck
+		buf[n] = extNone
+		buf[n+1] = byte(len(h.sack))
+		n += 2
+		n += copy(buf[n:], h.sack)
+	}
+	copy(buf[n:], payload)
+	return buf
+}
+
+// Parses a packet, returning its header and payload.
+func unmarshal(buf []byte) (*header, []byte, error) {
+	if len(buf) < headerSize || buf[0]&0x0F != version {
+		return nil, nil, errInvalidPacket
+	}
+	h := &header{
+		typ:       buf[0] >> 4,
+		connID:    binary.BigEndian.Uint16(buf[2:4]),
+		timestamp: binary.BigEndian.Uint32(buf[4:8]),
+		tsDiff:    binary.BigEndian.Uint32(buf[8:12]),
+		wnd:       binary.BigEndian.Uint32(buf[12:16]),
+		seq:       binary.BigEndian.Uint16(buf[16:18]),
+		ack:       binary.BigEndian.Uint16(buf[18:20]),
+	}
+	if h.typ > stSyn {
+		return nil, nil, errInvalidPacket
+	}
+	// Walk the extension chain.
+	ext, n := buf[1], headerSize
+	for ext != extNone {
+		if len(buf) < n+2 {
+			return nil, nil, errInvalidPacket
+		}
+		next, length := buf[n], int(buf[n+1])
+		n += 2
+		if len(buf) < n+length {
+			return nil, nil, errInvalidPacket
+		}
+		if ext == extSelectAck {
+			h.sack = buf[n : n+length]
+		}
+		ext = next
+		n += length
+	}
+	return h, buf[n:], nil
+}
+
+// ------------------------------ Helpers ------------------------------//
+
+// Sequence numbers wrap, a is before b if the distance forward is under half.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// Reports whether the selective ack bitmask acks seq.
+// Bit 0 of the first byte represents ack+2.
+func sacked(sack []byte, ack, seq uint16) bool {
+	i := int(seq - ack - 2)
+	if i < 0 || i >= len(sack)*8 {
+		return false
+	}
+	return sack[i/8]&(1<<uint(i%8)) != 0
+}
+
+var epoch = time.Now()
+
+// Microsecond timestamp used in packet headers.
+func now() uint32 {
+	return uint32(time.Since(epoch) / time.Microsecond)
+}
@@ -0,0 +1,265 @@
+package utp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// How often connections are checked for timeouts.
+const tickInterval = 50 * time.Millisecond
+
+var ErrClosed = errors.New("utp: socket closed")
+
+// Socket multiplexes uTP connections over a single UDP socket.
+// It implements net.Listener once created with Listen.
+type Socket struct {
+	pc        net.PacketConn
+	accepting bool // Whether incoming connections are accepted.
+
+	mu      sync.Mutex
+	conns   map[connKey]*Conn
+	acceptQ chan *Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// Connections are identified by remote address and our receive ID.
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Listen creates a socket that accepts uTP connections on addr,
+// it can also be used to dial out from the same port.
+func Listen(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newSocket(pc, true), nil
+}
+
+// NewSocket runs uTP over an existing packet connection.
+// Incoming connections are only accepted on sockets created with Listen.
+func NewSocket(pc net.PacketConn) *Socket {
+	return newSocket(pc, false)
+}
+
+func newSocket(pc net.PacketConn, accepting bool) *Socket {
+	s := &Socket{
+		pc:        pc,
+		accepting: accepting,
+		conns:     make(map[connKey]*Conn),
+		acceptQ:   make(chan *Conn, 32),
+		closed:    make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Accept waits for and returns the next incoming connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.acceptQ:
+		return c, nil
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the socket and every connection on it.
+func (s *Socket) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+		s.mu.Lock()
+		for _, c := range s.conns {
+			c.fail(ErrClosed)
+		}
+		s.mu.Unlock()
+	})
+	return err
+}
+
+// Dial connects to a uTP peer at addr from this socket.
+func (s *Socket) Dial(addr string, timeout time.Duration) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	// The initiator receives on a random ID and sends on ID + 1.
+	var id uint16
+	for {
+		id = uint16(rand.Intn(0xFFFF))
+		if _, ok := s.conns[connKey{raddr.String(), id}]; !ok {
+			break
+		}
+	}
+	c := newConn(s, raddr, id, id+1)
+	s.conns[connKey{raddr.String(), id}] = c
+	s.mu.Unlock()
+
+	if err := c.connect(timeout); err != nil {
+		s.remove(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// Dial connects to a uTP peer from a new socket on an ephemeral port,
+// the socket is closed along with the connection.
+func Dial(addr string, timeout time.Duration) (*Conn, error) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	s := NewSocket(pc)
+	c, err := s.Dial(addr, timeout)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	c.ownsSocket = true
+	return c, nil
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, connKey{c.raddr.String(), c.recvID})
+}
+
+func (s *Socket) write(b []byte, addr net.Addr) error {
+	_, err := s.pc.WriteTo(b, addr)
+	return err
+}
+
+// Reads packets from the UDP socket and hands them to their connection.
+func (s *Socket) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			// Eg. ICMP errors reported for an earlier write.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			s.Close()
+			return
+		}
+		h, payload, err := unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		// Copy, buf is reused.
+		payload = append([]byte(nil), payload...)
+		if h.sack != nil {
+			h.sack = append([]byte(nil), h.sack...)
+		}
+
+		if h.typ == stSyn {
+			s.handleSyn(h, addr)
+			continue
+		}
+
+		s.mu.Lock()
+		c, ok := s.conns[connKey{addr.String(), h.connID}]
+		if !ok && h.typ == stReset {
+			c, ok = s.resetConn(addr, h.connID)
+		}
+		s.mu.Unlock()
+		if !ok {
+			if h.typ != stReset {
+				s.reset(h, addr)
+			}
+			continue
+		}
+		c.receive(h, payload)
+	}
+}
+
+// Creates a connection for an incoming SYN.
+func (s *Socket) handleSyn(h *header, addr net.Addr) {
+	s.mu.Lock()
+	key := connKey{addr.String(), h.connID + 1}
+	c, ok := s.conns[key]
+	if !ok {
+		if !s.accepting {
+			s.mu.Unlock()
+			s.reset(h, addr)
+			return
+		}
+		// The acceptor receives on the SYN's ID + 1 and sends on its ID.
+		c = newConn(s, addr, h.connID+1, h.connID)
+		c.accept(h)
+		s.conns[key] = c
+		s.mu.Unlock()
+
+		select {
+		case s.acceptQ <- c:
+		default: // Backlog full.
+			c.Close()
+		}
+		return
+	}
+	s.mu.Unlock()
+	// Retransmitted SYN, our state packet was lost.
+	c.receive(h, nil)
+}
+
+// Tells the sender of a packet for an unknown connection to stop.
+// The reset carries the ID the packet was sent on, as libutp's do,
+// whether the sender initiated the connection or accepted it.
+func (s *Socket) reset(h *header, addr net.Addr) {
+	r := header{typ: stReset, connID: h.connID, timestamp: now(), ack: h.seq}
+	s.write(r.marshal(nil), addr)
+}
+
+// Finds the connection a reset is for by the ID we send on,
+// resets for a SYN carry the ID we receive on. s.mu must be held.
+func (s *Socket) resetConn(addr net.Addr, id uint16) (*Conn, bool) {
+	for key, c := range s.conns {
+		if key.addr == addr.String() && c.sendID == id {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Drives retransmission timeouts for every connection.
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.tick()
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Drops and reorders outgoing datagrams, counting what it sees.
+type lossyConn struct {
+	net.PacketConn
+	loss, reorder float64
+
+	mu          sync.Mutex
+	rng         *rand.Rand
+	dropped     int
+	delayed     int
+	sent        map[uint16]bool // Data packets sent, by sequence number.
+	retransmits int
+	sacks       int
+}
+
+func newLossyConn(t *testing.T, seed int64, loss, reorder float64) *lossyConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lossyConn{
+		PacketConn: pc,
+		loss:       loss,
+		reorder:    reorder,
+		rng:        rand.New(rand.NewSource(seed)),
+		sent:       make(map[uint16]bool),
+	}
+}
+
+func (l *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l.mu.Lock()
+	if h, _, err := unmarshal(b); err == nil {
+		switch {
+		case h.typ == stData && l.sent[h.seq]:
+			l.retransmits++
+		case h.typ == stData:
+			l.sent[h.seq] = true
+		case h.typ == stState && h.sack != nil:
+			l.sacks++
+		}
+	}
+	r := l.rng.Float64()
+	switch {
+	case r < l.loss:
+		l.dropped++
+		l.mu.Unlock()
+		return len(b), nil
+	case r < l.loss+l.reorder:
+		// Sent after the packets that follow it.
+		l.delayed++
+		l.mu.Unlock()
+		p := append([]byte(nil), b...)
+		time.AfterFunc(5*time.Millisecond, func() { l.PacketConn.WriteTo(p, addr) })
+		return len(b), nil
+	}
+	l.mu.Unlock()
+	return l.PacketConn.WriteTo(b, addr)
+}
+
+func (l *lossyConn) stats() (dropped, delayed, retransmits, sacks int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped, l.delayed, l.retransmits, l.sacks
+}
+
+func numConns(s *Socket) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func TestLossyTransfer(t *testing.T) {
+	serverPC := newLossyConn(t, 1, 0.03, 0.05)
+	clientPC := newLossyConn(t, 2, 0.03, 0.05)
+	server := newSocket(serverPC, true)
+	defer server.Close()
+	client := NewSocket(clientPC)
+	defer client.Close()
+
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		got, err := io.ReadAll(c)
+		if err != nil {
+			t.Errorf("read: %v", err)
+		}
+		c.Close()
+		received <- got
+	}()
+
+	conn, err := client.Dial(server.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(conn, bytes.NewReader(data)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.Close()
+
+	select {
+	case got := <-received:
+		if sha1.Sum(got) != sha1.Sum(data) {
+			t.Fatalf("received %d bytes that don't match the %d sent", len(got), len(data))
+		}
+	case <-time.After(2 * time.Minute):
+		t.Fatal("transfer timed out")
+	}
+
+	dropped, delayed, retransmits, _ := clientPC.stats()
+	_, _, _, sacks := serverPC.stats()
+	t.Logf("%d dropped, %d reordered, %d retransmits, %d selective acks", dropped, delayed, retransmits, sacks)
+	if dropped == 0 || delayed == 0 || retransmits == 0 {
+		t.Error("the sender saw no loss or reordering")
+	}
+	if sacks == 0 {
+		t.Error("the receiver sent no selective acks")
+	}
+
+	// Both FINs are acked well before the linger timeout.
+	deadline := time.Now().Add(finLinger / 2)
+	for numConns(client) > 0 || numConns(server) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connections not closed, %d client and %d server", numConns(client), numConns(server))
+		}
+		time.Sleep(tickInterval)
+	}
+}
+
+func TestResetUnknownConn(t *testing.T) {
+	server, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewSocket(pc)
+	defer client.Close()
+
+	for _, initiator := range []bool{true, false} {
+		conn, err := client.Dial(server.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The other side forgets the connection, the next packet sent
+		// on it is answered with a single reset.
+		var writer, forgetter *Conn = conn, accepted.(*Conn)
+		if !initiator {
+			writer, forgetter = forgetter, writer
+		}
+		forgetter.s.remove(forgetter)
+		writer.Write([]byte("hello"))
+		buf := make([]byte, 8)
+		writer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := writer.Read(buf); err != ErrReset {
+			t.Errorf("initiator %v: read got %v, want %v", initiator, err, ErrReset)
+		}
+	}
+}